@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/amenzhinsky/iothub/iotdevice"
+	iotmqtt "github.com/amenzhinsky/iothub/iotdevice/transport/mqtt"
+)
+
+func main() {
+	// IOTHUB_DEVICE_CONNECTION_STRING environment variable must be set
+	c, err := iotdevice.New(
+		iotdevice.WithTransport(iotmqtt.New()),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = c.Connect(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+
+	// increment the reported counter, re-reading the twin when another
+	// update lands between reading and writing, it's best-effort:
+	// an update landing between the check and the patch is overwritten
+	for {
+		_, reported, err := c.RetrieveTwinState(context.Background())
+		if err != nil {
+			log.Fatal(err)
+		}
+		n, _ := reported["counter"].(float64)
+		ver, err := c.CheckAndUpdateTwinState(context.Background(), reported.Version(),
+			iotdevice.TwinState{"counter": n + 1},
+		)
+		if errors.Is(err, iotdevice.ErrPreconditionFailed) {
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("counter = %v, version = %d", n+1, ver)
+		break
+	}
+}
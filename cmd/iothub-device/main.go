@@ -220,7 +220,7 @@ func directMethod(ctx context.Context, f *flag.FlagSet, c *iotdevice.Client) err
 	mu := &sync.Mutex{}
 
 	if err := c.RegisterMethod(ctx, f.Arg(0),
-		func(p map[string]interface{}) (map[string]interface{}, error) {
+		func(_ context.Context, p map[string]interface{}) (map[string]interface{}, error) {
 			mu.Lock()
 			defer mu.Unlock()
 
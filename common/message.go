@@ -11,12 +11,17 @@ type Message struct {
 	// MessageID is a user-settable identifier for the message used for request-reply patterns.
 	MessageID string `json:"MessageId,omitempty"`
 
-	// To is a destination specified in cloud-to-device messages.
+	// To is a destination of the message,
+	// it's always set in cloud-to-device messages.
 	To string `json:"To,omitempty"`
 
 	// ExpiryTime is time of message expiration.
 	ExpiryTime *time.Time `json:"ExpiryTimeUtc,omitempty"`
 
+	// CreationTime is time the message was created by the application,
+	// it's never set automatically, unlike EnqueuedTime.
+	CreationTime *time.Time `json:"CreationTimeUtc,omitempty"`
+
 	// EnqueuedTime is time the Cloud-to-Device message was received by IoT Hub.
 	EnqueuedTime *time.Time `json:"EnqueuedTime,omitempty"`
 
@@ -27,6 +32,18 @@ type Message struct {
 	// UserID is an ID used to specify the origin of messages.
 	UserID string `json:"UserId,omitempty"`
 
+	// ContentType is a MIME type of the payload, e.g. application/json,
+	// it's required for routing queries on the message body.
+	ContentType string `json:"ContentType,omitempty"`
+
+	// ContentEncoding is the payload charset, e.g. utf-8,
+	// it's required for routing queries on the message body too.
+	ContentEncoding string `json:"ContentEncoding,omitempty"`
+
+	// InterfaceID identifies the interface the message conforms to,
+	// security messages use it to reach Azure Defender for IoT.
+	InterfaceID string `json:"InterfaceId,omitempty"`
+
 	// ConnectionDeviceID is an ID set by IoT Hub on device-to-cloud messages.
 	// It contains the deviceId of the device that sent the message.
 	ConnectionDeviceID string `json:"ConnectionDeviceId,omitempty"`
@@ -53,3 +70,103 @@ type Message struct {
 	// TransportOptions transport specific options.
 	TransportOptions map[string]interface{} `json:"-"`
 }
+
+// NewMessage returns a builder of a message with the given payload.
+func NewMessage(payload []byte) *MessageBuilder {
+	return &MessageBuilder{msg: Message{
+		Payload:    payload,
+		Properties: map[string]string{},
+	}}
+}
+
+// MessageBuilder builds messages with all the maps initialized.
+type MessageBuilder struct {
+	msg Message
+}
+
+// WithMessageID sets the message id.
+func (b *MessageBuilder) WithMessageID(mid string) *MessageBuilder {
+	b.msg.MessageID = mid
+	return b
+}
+
+// WithCorrelationID sets the correlation id.
+func (b *MessageBuilder) WithCorrelationID(cid string) *MessageBuilder {
+	b.msg.CorrelationID = cid
+	return b
+}
+
+// WithUserID sets the user id.
+func (b *MessageBuilder) WithUserID(uid string) *MessageBuilder {
+	b.msg.UserID = uid
+	return b
+}
+
+// WithTo sets the message destination.
+func (b *MessageBuilder) WithTo(to string) *MessageBuilder {
+	b.msg.To = to
+	return b
+}
+
+// WithContentType sets the payload MIME type.
+func (b *MessageBuilder) WithContentType(ct string) *MessageBuilder {
+	b.msg.ContentType = ct
+	return b
+}
+
+// WithContentEncoding sets the payload charset.
+func (b *MessageBuilder) WithContentEncoding(ce string) *MessageBuilder {
+	b.msg.ContentEncoding = ce
+	return b
+}
+
+// WithInterfaceID sets the interface id.
+func (b *MessageBuilder) WithInterfaceID(id string) *MessageBuilder {
+	b.msg.InterfaceID = id
+	return b
+}
+
+// WithExpiryTime sets the message expiration time.
+func (b *MessageBuilder) WithExpiryTime(t time.Time) *MessageBuilder {
+	b.msg.ExpiryTime = &t
+	return b
+}
+
+// WithCreationTime sets the message creation time.
+func (b *MessageBuilder) WithCreationTime(t time.Time) *MessageBuilder {
+	b.msg.CreationTime = &t
+	return b
+}
+
+// WithProperty sets a custom message property.
+func (b *MessageBuilder) WithProperty(k, v string) *MessageBuilder {
+	b.msg.Properties[k] = v
+	return b
+}
+
+// WithProperties sets all the given custom message properties.
+func (b *MessageBuilder) WithProperties(m map[string]string) *MessageBuilder {
+	for k, v := range m {
+		b.msg.Properties[k] = v
+	}
+	return b
+}
+
+// Build returns the built message, the builder can be reused
+// since every call returns an independent copy.
+func (b *MessageBuilder) Build() *Message {
+	msg := b.msg
+	msg.Properties = make(map[string]string, len(b.msg.Properties))
+	for k, v := range b.msg.Properties {
+		msg.Properties[k] = v
+	}
+	if b.msg.ExpiryTime != nil {
+		t := *b.msg.ExpiryTime
+		msg.ExpiryTime = &t
+	}
+	if b.msg.CreationTime != nil {
+		t := *b.msg.CreationTime
+		msg.CreationTime = &t
+	}
+	return &msg
+}
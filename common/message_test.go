@@ -0,0 +1,26 @@
+package common
+
+import (
+	"testing"
+)
+
+func TestMessageBuilder(t *testing.T) {
+	b := NewMessage([]byte("hello")).
+		WithMessageID("1").
+		WithContentType("application/json").
+		WithProperty("k", "v")
+	m1 := b.Build()
+	m1.Properties["k"] = "changed"
+
+	m2 := b.Build()
+	if m2.MessageID != "1" || m2.ContentType != "application/json" ||
+		string(m2.Payload) != "hello" {
+		t.Fatalf("Build() = %#v", m2)
+	}
+	if v := m2.Properties["k"]; v != "v" {
+		t.Fatalf("property k = %q, want %q, built messages share properties", v, "v")
+	}
+
+	// properties map is always initialized
+	NewMessage(nil).Build().Properties["k"] = "v"
+}
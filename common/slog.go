@@ -0,0 +1,61 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// make sure that SlogLogger implements Logger interface.
+var _ Logger = (*SlogLogger)(nil)
+
+// NewSlogLogger returns a Logger writing to l, attributes such as
+// the device id can be attached to all messages with l.With.
+func NewSlogLogger(l *slog.Logger) *SlogLogger {
+	if l == nil {
+		panic("logger is nil")
+	}
+	return &SlogLogger{l: l}
+}
+
+// SlogLogger is a Logger adapter of the standard structured logger.
+type SlogLogger struct {
+	l *slog.Logger
+}
+
+func (l *SlogLogger) Errorf(format string, v ...interface{}) {
+	l.logf(slog.LevelError, format, v...)
+}
+
+func (l *SlogLogger) Warnf(format string, v ...interface{}) {
+	l.logf(slog.LevelWarn, format, v...)
+}
+
+func (l *SlogLogger) Infof(format string, v ...interface{}) {
+	l.logf(slog.LevelInfo, format, v...)
+}
+
+func (l *SlogLogger) Debugf(format string, v ...interface{}) {
+	l.logf(slog.LevelDebug, format, v...)
+}
+
+// With returns a logger that adds the given attributes to all messages,
+// the same way slog.Logger.With does.
+func (l *SlogLogger) With(args ...interface{}) *SlogLogger {
+	return &SlogLogger{l: l.l.With(args...)}
+}
+
+// logf formats messages only when the level is enabled
+// and reports callers of the logging methods as sources.
+func (l *SlogLogger) logf(lvl slog.Level, format string, v ...interface{}) {
+	ctx := context.Background()
+	if !l.l.Enabled(ctx, lvl) {
+		return
+	}
+	var pcs [1]uintptr
+	runtime.Callers(3, pcs[:]) // skip Callers, logf and the level method
+	r := slog.NewRecord(time.Now(), lvl, fmt.Sprintf(format, v...), pcs[0])
+	_ = l.l.Handler().Handle(ctx, r)
+}
@@ -0,0 +1,30 @@
+package common
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogLogger(t *testing.T) {
+	var b bytes.Buffer
+	l := NewSlogLogger(slog.New(slog.NewTextHandler(&b, &slog.HandlerOptions{
+		Level:     slog.LevelInfo,
+		AddSource: true,
+	}))).With("device", "golang")
+
+	l.Debugf("connecting to %s", "hub")
+	l.Warnf("connection lost: %s", "EOF")
+	s := b.String()
+	for _, want := range []string{
+		"level=WARN", `msg="connection lost: EOF"`, "device=golang", "slog_test.go:",
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("output %q doesn't contain %q", s, want)
+		}
+	}
+	if strings.Contains(s, "connecting") {
+		t.Errorf("output %q contains a debug message", s)
+	}
+}
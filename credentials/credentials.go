@@ -32,6 +32,8 @@ func ParseConnectionString(cs string) (*Credentials, error) {
 			m.HostName = c[1]
 		case "DeviceId":
 			m.DeviceID = c[1]
+		case "ModuleId":
+			m.ModuleID = c[1]
 		case "SharedAccessKey":
 			m.SharedAccessKey = c[1]
 		case "SharedAccessKeyName":
@@ -45,6 +47,7 @@ func ParseConnectionString(cs string) (*Credentials, error) {
 type Credentials struct {
 	HostName            string
 	DeviceID            string
+	ModuleID            string // empty unless it's a module identity
 	SharedAccessKey     string
 	SharedAccessKeyName string
 }
@@ -82,6 +85,23 @@ func (c *Credentials) GenerateToken(uri string, opts ...TokenOption) (string, er
 		return "", errors.New("SharedAccessKey is blank")
 	}
 
+	b, err := base64.StdEncoding.DecodeString(c.SharedAccessKey)
+	if err != nil {
+		return "", err
+	}
+	return GenerateTokenFromKey(b, c.SharedAccessKeyName, uri, opts...)
+}
+
+// GenerateTokenFromKey is GenerateToken with the already decoded
+// shared access key, it's cheaper when tokens are generated often.
+func GenerateTokenFromKey(key []byte, keyName, uri string, opts ...TokenOption) (string, error) {
+	if uri == "" {
+		return "", errors.New("uri is blank")
+	}
+	if len(key) == 0 {
+		return "", errors.New("key is empty")
+	}
+
 	topts := &options{
 		duration: time.Hour,
 		time:     time.Now(),
@@ -93,15 +113,10 @@ func (c *Credentials) GenerateToken(uri string, opts ...TokenOption) (string, er
 	sr := url.QueryEscape(uri)
 	se := topts.time.Add(topts.duration).Unix()
 
-	b, err := base64.StdEncoding.DecodeString(c.SharedAccessKey)
-	if err != nil {
-		return "", err
-	}
-
 	// generate signature from uri and expiration time.
 	e := fmt.Sprintf("%s\n%d", sr, se)
-	h := hmac.New(sha256.New, b)
-	if _, err = h.Write([]byte(e)); err != nil {
+	h := hmac.New(sha256.New, key)
+	if _, err := h.Write([]byte(e)); err != nil {
 		return "", err
 	}
 
@@ -109,5 +124,18 @@ func (c *Credentials) GenerateToken(uri string, opts ...TokenOption) (string, er
 		"sr=" + sr +
 		"&sig=" + url.QueryEscape(base64.StdEncoding.EncodeToString(h.Sum(nil))) +
 		"&se=" + url.QueryEscape(strconv.FormatInt(se, 10)) +
-		"&skn=" + url.QueryEscape(c.SharedAccessKeyName), nil
+		"&skn=" + url.QueryEscape(keyName), nil
+}
+
+// TokenExpiry returns the expiration time of the given SAS token.
+func TokenExpiry(token string) (time.Time, error) {
+	q, err := url.ParseQuery(strings.TrimPrefix(token, "SharedAccessSignature "))
+	if err != nil {
+		return time.Time{}, err
+	}
+	se, err := strconv.ParseInt(q.Get("se"), 10, 64)
+	if err != nil {
+		return time.Time{}, errors.New("token has no valid expiry")
+	}
+	return time.Unix(se, 0), nil
 }
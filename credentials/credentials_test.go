@@ -13,6 +13,12 @@ func TestParseConnectionString(t *testing.T) {
 			SharedAccessKey:     "c2VjcmV0",
 			SharedAccessKeyName: "",
 		},
+		"HostName=test.azure-devices.net;DeviceId=devnull;ModuleId=sensor;SharedAccessKey=c2VjcmV0": {
+			HostName:        "test.azure-devices.net",
+			DeviceID:        "devnull",
+			ModuleID:        "sensor",
+			SharedAccessKey: "c2VjcmV0",
+		},
 		"HostName=test.azure-devices.net;SharedAccessKeyName=device;SharedAccessKey=c2VjcmV0": {
 			HostName:            "test.azure-devices.net",
 			DeviceID:            "",
@@ -49,3 +55,31 @@ func TestCredentials_SAS(t *testing.T) {
 		t.Errorf("GenerateToken(time.Hour) = %q, want %q", g, w)
 	}
 }
+
+func TestGenerateTokenFromKey(t *testing.T) {
+	g, err := GenerateTokenFromKey([]byte("secret"), "", "test.azure-devices.net/devices/test",
+		WithDuration(time.Hour),
+		WithCurrentTime(time.Date(2017, 1, 1, 1, 1, 1, 0, time.UTC)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := "SharedAccessSignature sr=test.azure-devices.net%2Fdevices%2Ftest&sig=IMr3Y5GKbdixQSt96QgIEymAURnu3qzLvEHhGHPLxrU%3D&se=1483236061&skn="
+	if g != w {
+		t.Errorf("GenerateTokenFromKey(time.Hour) = %q, want %q", g, w)
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	g, err := TokenExpiry("SharedAccessSignature sr=test.azure-devices.net%2Fdevices%2Ftest&sig=IMr3Y5GKbdixQSt96QgIEymAURnu3qzLvEHhGHPLxrU%3D&se=1483236061&skn=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := time.Unix(1483236061, 0); !g.Equal(w) {
+		t.Errorf("TokenExpiry() = %s, want %s", g, w)
+	}
+	if _, err = TokenExpiry("SharedAccessSignature sr=test"); err == nil {
+		t.Error("TokenExpiry() of a token without expiry returned no error")
+	}
+}
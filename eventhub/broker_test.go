@@ -0,0 +1,664 @@
+package eventhub
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"pack.ag/amqp"
+)
+
+// broker is a minimal in-process AMQP 1.0 peer that lets clients be tested
+// without Event Hubs, it accepts any link, grants senders credit, settles
+// every transfer it receives and answers requests to the management node.
+type broker struct {
+	t  *testing.T
+	ln net.Listener
+	tc *tls.Config // client configuration trusting the broker
+
+	mu      sync.Mutex
+	conns   map[net.Conn]struct{}
+	msgs    []*amqp.Message   // messages received on sender links
+	credits map[string]uint32 // credit granted by receivers by source address
+	mgmt    func(props map[string]interface{}) map[string]interface{}
+	limit   uint64            // max-message-size of receiving links, zero is unlimited
+	sizes   map[string]uint64 // max-message-size of sender links by target address
+	wg      sync.WaitGroup
+}
+
+// newBroker starts a broker listening on a random local port,
+// it's stopped when the test finishes.
+func newBroker(t *testing.T) *broker {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	srv.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &broker{
+		t:       t,
+		ln:      ln,
+		tc:      &tls.Config{InsecureSkipVerify: true},
+		conns:   map[net.Conn]struct{}{},
+		credits: map[string]uint32{},
+		sizes:   map[string]uint64{},
+	}
+	b.wg.Add(1)
+	go b.accept()
+	t.Cleanup(b.close)
+	return b
+}
+
+// dial connects a client to the broker.
+func (b *broker) dial(opts ...Option) *Client {
+	b.t.Helper()
+	c, err := Dial(b.ln.Addr().String(), "hub", append([]Option{
+		WithTLSConfig(b.tc),
+	}, opts...)...)
+	if err != nil {
+		b.t.Fatal(err)
+	}
+	b.t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// drop terminates all client connections.
+func (b *broker) drop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for nc := range b.conns {
+		nc.Close()
+	}
+}
+
+// received returns messages received on sender links so far.
+func (b *broker) received() []*amqp.Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*amqp.Message(nil), b.msgs...)
+}
+
+// manage sets fn answering management requests by their application
+// properties, requests it returns nil for fail with the 404 status code.
+func (b *broker) manage(fn func(props map[string]interface{}) map[string]interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mgmt = fn
+}
+
+// limitSize makes links the broker receives on advertise
+// n as their max-message-size to clients attaching them.
+func (b *broker) limitSize(n uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.limit = n
+}
+
+// maxSize returns the max-message-size requested by the sender of addr.
+func (b *broker) maxSize(addr string) uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sizes[addr]
+}
+
+// credit returns the last credit granted by the receiver of addr.
+func (b *broker) credit(addr string) uint32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.credits[addr]
+}
+
+func (b *broker) close() {
+	b.ln.Close()
+	b.drop()
+	b.wg.Wait()
+}
+
+func (b *broker) accept() {
+	defer b.wg.Done()
+	for {
+		nc, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conns[nc] = struct{}{}
+		b.mu.Unlock()
+		b.wg.Add(1)
+		go func() {
+			defer b.wg.Done()
+			defer func() {
+				b.mu.Lock()
+				delete(b.conns, nc)
+				b.mu.Unlock()
+				nc.Close()
+			}()
+			if err := (&peer{b: b, nc: nc}).serve(); err != nil &&
+				!errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				b.t.Logf("broker: %v", err)
+			}
+		}()
+	}
+}
+
+// AMQP performative and section descriptor codes.
+const (
+	codeOpen        = 0x10
+	codeBegin       = 0x11
+	codeAttach      = 0x12
+	codeFlow        = 0x13
+	codeTransfer    = 0x14
+	codeDisposition = 0x15
+	codeDetach      = 0x16
+	codeEnd         = 0x17
+	codeClose       = 0x18
+	codeAccepted    = 0x24
+	codeSource      = 0x28
+	codeTarget      = 0x29
+)
+
+// peer serves a single client connection.
+type peer struct {
+	b        *broker
+	nc       net.Conn
+	sessions map[uint16]*peerSession
+}
+
+type peerSession struct {
+	in    uint32 // transfers received
+	out   uint32 // transfers sent
+	links map[uint32]*peerLink
+}
+
+type peerLink struct {
+	addr     string // address of the broker end
+	target   string // target address of client receivers, e.g. reply-to
+	receiver bool   // the client end is a receiver
+	count    uint32 // delivery count
+	credit   uint32 // credit granted by the client
+	partial  []byte // payload of a multi-frame transfer
+	queue    [][]byte
+}
+
+// maxPayload is the payload size of transfer frames sent to clients
+// that fits the default max frame size along with the performative.
+const maxPayload = 256
+
+func (p *peer) serve() error {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(p.nc, hdr); err != nil {
+		return err
+	}
+	if string(hdr) != "AMQP\x00\x01\x00\x00" {
+		return fmt.Errorf("unsupported protocol header %q", hdr)
+	}
+	if _, err := p.nc.Write(hdr); err != nil {
+		return err
+	}
+	p.sessions = map[uint16]*peerSession{}
+	for {
+		ch, code, f, payload, err := readFrame(p.nc)
+		if err != nil {
+			return err
+		}
+		if f == nil {
+			continue // heartbeat
+		}
+		if err = p.handle(ch, code, f, payload); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *peer) handle(ch uint16, code uint64, f fields, payload []byte) error {
+	s := p.sessions[ch]
+	if s == nil && code != codeOpen && code != codeBegin && code != codeClose {
+		return fmt.Errorf("performative %#x on unknown channel %d", code, ch)
+	}
+	switch code {
+	case codeOpen:
+		return p.write(0, described(codeOpen,
+			encString("broker"), encNull, encUint(math.MaxUint32),
+		), nil)
+	case codeBegin:
+		p.sessions[ch] = &peerSession{links: map[uint32]*peerLink{}}
+		return p.write(ch, described(codeBegin,
+			encUshort(ch), encUint(0), encUint(5000), encUint(5000),
+		), nil)
+	case codeAttach:
+		l := &peerLink{
+			addr:     f.described(6).str(0),
+			receiver: f.bool(2),
+		}
+		if l.receiver {
+			l.addr = f.described(5).str(0)
+			l.target = f.described(6).str(0)
+		}
+		h := f.uint(1)
+		s.links[h] = l
+		limit := encNull
+		if !l.receiver {
+			p.b.mu.Lock()
+			p.b.sizes[l.addr], _ = f.get(10).(uint64)
+			if p.b.limit != 0 {
+				limit = encUlong(p.b.limit)
+			}
+			p.b.mu.Unlock()
+		}
+		if err := p.write(ch, described(codeAttach,
+			encString(f.str(0)), encUint(h), encBool(!l.receiver), encNull, encNull,
+			described(codeSource, encString(f.described(5).str(0))),
+			described(codeTarget, encString(f.described(6).str(0))),
+			encNull, encNull, encUint(0), limit,
+		), nil); err != nil {
+			return err
+		}
+		if l.receiver {
+			return nil
+		}
+		return p.grant(ch, s, h, l)
+	case codeFlow:
+		if f.null(4) {
+			return nil
+		}
+		h := f.uint(4)
+		l := s.links[h]
+		if l == nil || !l.receiver {
+			return nil
+		}
+		l.credit = f.uint(5) + f.uint(6) - l.count
+		p.b.mu.Lock()
+		p.b.credits[l.addr] = f.uint(6)
+		p.b.mu.Unlock()
+		return p.flush(ch, s, h, l)
+	case codeTransfer:
+		s.in++
+		l := s.links[f.uint(0)]
+		if l == nil {
+			return fmt.Errorf("transfer on unknown handle %d", f.uint(0))
+		}
+		l.partial = append(l.partial, payload...)
+		if f.bool(5) {
+			return nil // more frames follow
+		}
+		var msg amqp.Message
+		if err := msg.UnmarshalBinary(l.partial); err != nil {
+			return err
+		}
+		l.partial = nil
+		l.count++
+		p.b.mu.Lock()
+		p.b.msgs = append(p.b.msgs, &msg)
+		p.b.mu.Unlock()
+		if !f.bool(4) {
+			if err := p.write(ch, described(codeDisposition,
+				encBool(true), encUint(f.uint(1)), encNull, encBool(true),
+				described(codeAccepted),
+			), nil); err != nil {
+				return err
+			}
+		}
+		if l.addr == "$management" {
+			if err := p.reply(ch, s, &msg); err != nil {
+				return err
+			}
+		}
+		return p.grant(ch, s, f.uint(0), l)
+	case codeDisposition:
+		return nil
+	case codeDetach:
+		delete(s.links, f.uint(0))
+		return p.write(ch, described(codeDetach, encUint(f.uint(0)), encBool(true)), nil)
+	case codeEnd:
+		delete(p.sessions, ch)
+		return p.write(ch, described(codeEnd), nil)
+	case codeClose:
+		if err := p.write(0, described(codeClose), nil); err != nil {
+			return err
+		}
+		return io.EOF
+	default:
+		return fmt.Errorf("unexpected performative %#x", code)
+	}
+}
+
+// grant replenishes credit of the link the client sends on.
+func (p *peer) grant(ch uint16, s *peerSession, h uint32, l *peerLink) error {
+	return p.write(ch, described(codeFlow,
+		encUint(s.in), encUint(5000), encUint(s.out), encUint(5000),
+		encUint(h), encUint(l.count), encUint(100),
+	), nil)
+}
+
+// reply answers a management request on the receiver link
+// attached to its reply-to address.
+func (p *peer) reply(ch uint16, s *peerSession, req *amqp.Message) error {
+	if req.Properties == nil {
+		return errors.New("management request without properties")
+	}
+	p.b.mu.Lock()
+	fn := p.b.mgmt
+	p.b.mu.Unlock()
+	var val map[string]interface{}
+	if fn != nil {
+		val = fn(req.ApplicationProperties)
+	}
+	props := map[string]interface{}{"status-code": int32(200)}
+	if val == nil {
+		props = map[string]interface{}{
+			"status-code":        int32(404),
+			"status-description": "not found",
+		}
+	}
+	b, err := (&amqp.Message{
+		Properties: &amqp.MessageProperties{
+			CorrelationID: req.Properties.MessageID,
+		},
+		ApplicationProperties: props,
+		Value:                 val,
+	}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	for h, l := range s.links {
+		if l.receiver && l.target == req.Properties.ReplyTo {
+			l.queue = append(l.queue, b)
+			return p.flush(ch, s, h, l)
+		}
+	}
+	return fmt.Errorf("no receiver attached to %q", req.Properties.ReplyTo)
+}
+
+// flush sends queued messages as long as the client grants credit,
+// they're sent settled and split into frames of up to maxPayload bytes.
+func (p *peer) flush(ch uint16, s *peerSession, h uint32, l *peerLink) error {
+	for ; l.credit > 0 && len(l.queue) > 0; l.credit-- {
+		id, b := s.out, l.queue[0]
+		l.queue = l.queue[1:]
+		l.count++
+		for more := true; more; {
+			n := len(b)
+			if more = n > maxPayload; more {
+				n = maxPayload
+			}
+			if err := p.write(ch, described(codeTransfer,
+				encUint(h), encUint(id), encBinary(encUint(id)), encUint(0),
+				encBool(true), encBool(more),
+			), b[:n]); err != nil {
+				return err
+			}
+			b = b[n:]
+			s.out++
+		}
+	}
+	return nil
+}
+
+// write writes a frame, payload is appended to the performative body.
+func (p *peer) write(ch uint16, body, payload []byte) error {
+	b := make([]byte, 8, 8+len(body)+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(cap(b)))
+	b[4], b[5] = 2, 0
+	binary.BigEndian.PutUint16(b[6:], ch)
+	b = append(append(b, body...), payload...)
+	_, err := p.nc.Write(b)
+	return err
+}
+
+// readFrame reads a frame and decodes its performative,
+// f is nil for empty frames used as heartbeats.
+func readFrame(r io.Reader) (ch uint16, code uint64, f fields, payload []byte, err error) {
+	hdr := make([]byte, 8)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return 0, 0, nil, nil, err
+	}
+	size, doff := binary.BigEndian.Uint32(hdr), int(hdr[4])*4
+	if size < 8 || doff < 8 || uint32(doff) > size {
+		return 0, 0, nil, nil, fmt.Errorf("malformed frame header %x", hdr)
+	}
+	b := make([]byte, size-8)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return 0, 0, nil, nil, err
+	}
+	ch = binary.BigEndian.Uint16(hdr[6:])
+	if b = b[doff-8:]; len(b) == 0 {
+		return ch, 0, nil, nil, nil
+	}
+	d := &decoder{b: b}
+	v, ok := d.value().(describedValue)
+	if d.err != nil {
+		return 0, 0, nil, nil, d.err
+	}
+	code, _ = v.code.(uint64)
+	if f, _ = v.value.([]interface{}); !ok || f == nil {
+		return 0, 0, nil, nil, fmt.Errorf("malformed performative %#v", v)
+	}
+	return ch, code, f, d.b, nil
+}
+
+// fields is a decoded list of composite type fields,
+// accessors return zero values for missing or null ones.
+type fields []interface{}
+
+func (f fields) get(i int) interface{} {
+	if i < len(f) {
+		return f[i]
+	}
+	return nil
+}
+
+func (f fields) null(i int) bool {
+	return f.get(i) == nil
+}
+
+func (f fields) uint(i int) uint32 {
+	v, _ := f.get(i).(uint64)
+	return uint32(v)
+}
+
+func (f fields) bool(i int) bool {
+	v, _ := f.get(i).(bool)
+	return v
+}
+
+func (f fields) str(i int) string {
+	v, _ := f.get(i).(string)
+	return v
+}
+
+func (f fields) described(i int) fields {
+	v, _ := f.get(i).(describedValue)
+	l, _ := v.value.([]interface{})
+	return l
+}
+
+// describedValue is a decoded described type.
+type describedValue struct {
+	code  interface{}
+	value interface{}
+}
+
+// decoder decodes AMQP values, unsigned integers are decoded as uint64,
+// signed ones as int64, maps, lists and arrays as []interface{},
+// strings and symbols as string.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.b) < n {
+		if d.err == nil {
+			d.err = io.ErrUnexpectedEOF
+		}
+		return make([]byte, 8)
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b
+}
+
+func (d *decoder) value() interface{} {
+	return d.typed(d.next(1)[0])
+}
+
+func (d *decoder) typed(code byte) interface{} {
+	switch code {
+	case 0x00:
+		return describedValue{code: d.value(), value: d.value()}
+	case 0x40:
+		return nil
+	case 0x41, 0x42:
+		return code == 0x41
+	case 0x56:
+		return d.next(1)[0] != 0
+	case 0x43, 0x44:
+		return uint64(0)
+	case 0x50, 0x52, 0x53:
+		return uint64(d.next(1)[0])
+	case 0x51, 0x54, 0x55:
+		return int64(int8(d.next(1)[0]))
+	case 0x60:
+		return uint64(binary.BigEndian.Uint16(d.next(2)))
+	case 0x61:
+		return int64(int16(binary.BigEndian.Uint16(d.next(2))))
+	case 0x70:
+		return uint64(binary.BigEndian.Uint32(d.next(4)))
+	case 0x71:
+		return int64(int32(binary.BigEndian.Uint32(d.next(4))))
+	case 0x72:
+		return math.Float32frombits(binary.BigEndian.Uint32(d.next(4)))
+	case 0x73:
+		return rune(binary.BigEndian.Uint32(d.next(4)))
+	case 0x80:
+		return binary.BigEndian.Uint64(d.next(8))
+	case 0x81, 0x83:
+		return int64(binary.BigEndian.Uint64(d.next(8)))
+	case 0x82:
+		return math.Float64frombits(binary.BigEndian.Uint64(d.next(8)))
+	case 0x98:
+		return append([]byte(nil), d.next(16)...)
+	case 0xa0, 0xa1, 0xa3:
+		return d.variable(code, int(d.next(1)[0]))
+	case 0xb0, 0xb1, 0xb3:
+		return d.variable(code, int(binary.BigEndian.Uint32(d.next(4))))
+	case 0x45:
+		return []interface{}{}
+	case 0xc0, 0xc1:
+		d.next(1)
+		return d.list(int(d.next(1)[0]))
+	case 0xd0, 0xd1:
+		d.next(4)
+		return d.list(int(binary.BigEndian.Uint32(d.next(4))))
+	case 0xe0:
+		d.next(1)
+		return d.array(int(d.next(1)[0]))
+	case 0xf0:
+		d.next(4)
+		return d.array(int(binary.BigEndian.Uint32(d.next(4))))
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("unsupported type code %#02x", code)
+		}
+		return nil
+	}
+}
+
+func (d *decoder) variable(code byte, n int) interface{} {
+	b := d.next(n)
+	if code&0x0f == 0 {
+		return append([]byte(nil), b...)
+	}
+	return string(b)
+}
+
+func (d *decoder) list(n int) []interface{} {
+	v := make([]interface{}, 0)
+	for i := 0; i < n && d.err == nil; i++ {
+		v = append(v, d.value())
+	}
+	return v
+}
+
+func (d *decoder) array(n int) []interface{} {
+	code := d.next(1)[0]
+	var desc interface{}
+	if code == 0x00 {
+		desc = d.value()
+		code = d.next(1)[0]
+	}
+	v := make([]interface{}, 0)
+	for i := 0; i < n && d.err == nil; i++ {
+		if desc != nil {
+			v = append(v, describedValue{code: desc, value: d.typed(code)})
+		} else {
+			v = append(v, d.typed(code))
+		}
+	}
+	return v
+}
+
+// described encodes a described list of the given encoded fields,
+// performatives are encoded this way too.
+func described(code byte, fields ...[]byte) []byte {
+	var size int
+	for _, f := range fields {
+		size += len(f)
+	}
+	b := make([]byte, 12, 12+size)
+	b[0], b[1], b[2], b[3] = 0x00, 0x53, code, 0xd0
+	binary.BigEndian.PutUint32(b[4:], uint32(4+size))
+	binary.BigEndian.PutUint32(b[8:], uint32(len(fields)))
+	for _, f := range fields {
+		b = append(b, f...)
+	}
+	return b
+}
+
+var encNull = []byte{0x40}
+
+func encBool(v bool) []byte {
+	if v {
+		return []byte{0x41}
+	}
+	return []byte{0x42}
+}
+
+func encUshort(v uint16) []byte {
+	b := []byte{0x60, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], v)
+	return b
+}
+
+func encUint(v uint32) []byte {
+	b := []byte{0x70, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], v)
+	return b
+}
+
+func encUlong(v uint64) []byte {
+	b := []byte{0x80, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[1:], v)
+	return b
+}
+
+func encBinary(v []byte) []byte {
+	b := []byte{0xb0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(len(v)))
+	return append(b, v...)
+}
+
+func encString(s string) []byte {
+	b := []byte{0xb1, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[1:], uint32(len(s)))
+	return append(b, s...)
+}
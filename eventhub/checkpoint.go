@@ -0,0 +1,336 @@
+package eventhub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/iothub/internal/clock"
+)
+
+// ErrNoCheckpoint is returned by checkpoint stores
+// when there's no checkpoint of a partition.
+var ErrNoCheckpoint = errors.New("eventhub: no checkpoint")
+
+// Checkpoint is the position of the last processed event of a partition.
+type Checkpoint struct {
+	Offset         string    `json:"offset"`
+	SequenceNumber int64     `json:"sequenceNumber"`
+	EnqueuedTime   time.Time `json:"enqueuedTime"`
+}
+
+// CheckpointStore persists checkpoints of partitions, it's used
+// by a single subscription so it's meant to be scoped to an event
+// hub and a consumer group by implementations.
+type CheckpointStore interface {
+	// Read returns the checkpoint of the partition or ErrNoCheckpoint.
+	Read(partitionID string) (Checkpoint, error)
+
+	// Write replaces the checkpoint of the partition.
+	Write(partitionID string, cp Checkpoint) error
+}
+
+// WithSubscribeCheckpointStore resumes partitions after events recorded
+// in store and writes positions of events that are handled without
+// errors to it every interval and when Subscribe returns.
+//
+// Partitions with positions set by WithSubscribeStartPositions don't
+// read their checkpoints and ones without checkpoints start at the
+// position set by WithSubscribeStartPosition or WithSubscribeSince.
+// With WithSubscribeConcurrency a checkpoint doesn't advance past
+// an event until all preceding events of its partition are handled.
+// It never advances past an event that fails, or that's released or
+// rejected with WithSubscribeManualAccept, so it's received again
+// after resuming even when later events succeed.
+func WithSubscribeCheckpointStore(store CheckpointStore, interval time.Duration) SubscribeOption {
+	if store == nil {
+		panic("store is nil")
+	}
+	if interval <= 0 {
+		panic("interval must be positive")
+	}
+	return func(s *sub) {
+		s.store = store
+		s.storeInterval = interval
+	}
+}
+
+// checkpointer tracks handled events of partitions and writes
+// checkpoints of the ones that all preceding events are handled.
+type checkpointer struct {
+	store CheckpointStore
+	debug func(format string, v ...interface{})
+
+	// delay holds checkpoints back after events are handled,
+	// until dispositions batched with their events are sent
+	clock clock.Clock
+	delay time.Duration
+
+	mu    sync.Mutex
+	parts map[string]*partitionCheckpoint
+}
+
+type partitionCheckpoint struct {
+	running  map[int64]struct{}    // events being handled by sequence numbers
+	finished map[int64]*Checkpoint // handled events waiting for preceding ones
+	barrier  int64                 // the earliest failed event, -1 when none
+	delayed  []delayedCheckpoint   // checkpoints held back by the delay
+	last     *Checkpoint           // the latest checkpoint to write
+	dirty    bool                  // last isn't written yet
+}
+
+type delayedCheckpoint struct {
+	cp *Checkpoint
+	at time.Time // when it can be written
+}
+
+func newCheckpointer(store CheckpointStore, debug func(string, ...interface{})) *checkpointer {
+	return &checkpointer{
+		store: store,
+		debug: debug,
+		clock: clock.Real,
+		parts: map[string]*partitionCheckpoint{},
+	}
+}
+
+func (c *checkpointer) partition(id string) *partitionCheckpoint {
+	p, ok := c.parts[id]
+	if !ok {
+		p = &partitionCheckpoint{
+			running:  map[int64]struct{}{},
+			finished: map[int64]*Checkpoint{},
+			barrier:  -1,
+		}
+		c.parts[id] = p
+	}
+	return p
+}
+
+// start registers ev as being handled, events have to
+// be registered in the order they're received.
+func (c *checkpointer) start(ev *Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.partition(ev.PartitionID).running[ev.SequenceNumber] = struct{}{}
+}
+
+// finish marks ev as handled, failed events are never checkpointed
+// and checkpoints don't advance past them, events following them
+// are dropped since they cannot be checkpointed either.
+func (c *checkpointer) finish(ev *Event, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.partition(ev.PartitionID)
+	delete(p.running, ev.SequenceNumber)
+	if !ok {
+		if p.barrier == -1 || ev.SequenceNumber < p.barrier {
+			p.barrier = ev.SequenceNumber
+		}
+		for seq := range p.finished {
+			if seq > p.barrier {
+				delete(p.finished, seq)
+			}
+		}
+		return
+	}
+	if p.barrier != -1 && ev.SequenceNumber > p.barrier {
+		return
+	}
+	p.finished[ev.SequenceNumber] = &Checkpoint{
+		Offset:         ev.Offset,
+		SequenceNumber: ev.SequenceNumber,
+		EnqueuedTime:   ev.EnqueuedTime,
+	}
+
+	// only events preceding all running and failed ones can be checkpointed
+	min := p.barrier
+	for seq := range p.running {
+		if min == -1 || seq < min {
+			min = seq
+		}
+	}
+	var next *Checkpoint
+	for seq, cp := range p.finished {
+		if min != -1 && seq > min {
+			continue
+		}
+		if next == nil || seq > next.SequenceNumber {
+			next = cp
+		}
+		delete(p.finished, seq)
+	}
+	if next == nil {
+		return
+	}
+	if c.delay == 0 {
+		if p.last == nil || next.SequenceNumber > p.last.SequenceNumber {
+			p.last, p.dirty = next, true
+		}
+		return
+	}
+	p.delayed = append(p.delayed, delayedCheckpoint{cp: next, at: c.clock.Now().Add(c.delay)})
+}
+
+// promote makes delayed checkpoints that are due by now,
+// or all of them when now is zero, the latest to write.
+func (p *partitionCheckpoint) promote(now time.Time) {
+	var i int
+	for ; i < len(p.delayed); i++ {
+		d := p.delayed[i]
+		if !now.IsZero() && d.at.After(now) {
+			break
+		}
+		if p.last == nil || d.cp.SequenceNumber > p.last.SequenceNumber {
+			p.last, p.dirty = d.cp, true
+		}
+	}
+	p.delayed = p.delayed[i:]
+}
+
+// wrap returns fn that marks events handled.
+func (c *checkpointer) wrap(fn func(*Event) error) func(*Event) error {
+	return func(ev *Event) error {
+		err := fn(ev)
+		c.finish(ev, err == nil)
+		return err
+	}
+}
+
+// flush writes checkpoints that have advanced since the last flush.
+func (c *checkpointer) flush() error {
+	return c.write(c.clock.Now())
+}
+
+// flushAll is flush that doesn't hold delayed checkpoints back,
+// it's called when there are no dispositions left to be sent.
+func (c *checkpointer) flushAll() error {
+	return c.write(time.Time{})
+}
+
+func (c *checkpointer) write(now time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, p := range c.parts {
+		p.promote(now)
+		if !p.dirty {
+			continue
+		}
+		if err := c.store.Write(id, *p.last); err != nil {
+			return err
+		}
+		p.dirty = false
+		c.debug("checkpoint of partition %s: %d", id, p.last.SequenceNumber)
+	}
+	return nil
+}
+
+// run flushes checkpoints every interval until ctx is done,
+// failures are retried on the next interval.
+func (c *checkpointer) run(ctx context.Context, clk clock.Clock, interval time.Duration) {
+	for {
+		select {
+		case <-clk.After(interval):
+			if err := c.flush(); err != nil {
+				c.debug("checkpoint error: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// MemoryCheckpointStore is an in-memory CheckpointStore,
+// it's useful for tests and for resuming within a process.
+type MemoryCheckpointStore struct {
+	mu  sync.RWMutex
+	cps map[string]Checkpoint
+}
+
+// NewMemoryCheckpointStore returns an empty in-memory checkpoint store.
+func NewMemoryCheckpointStore() *MemoryCheckpointStore {
+	return &MemoryCheckpointStore{cps: map[string]Checkpoint{}}
+}
+
+// Read implements CheckpointStore.
+func (s *MemoryCheckpointStore) Read(partitionID string) (Checkpoint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cp, ok := s.cps[partitionID]
+	if !ok {
+		return Checkpoint{}, ErrNoCheckpoint
+	}
+	return cp, nil
+}
+
+// Write implements CheckpointStore.
+func (s *MemoryCheckpointStore) Write(partitionID string, cp Checkpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cps[partitionID] = cp
+	return nil
+}
+
+// FileCheckpointStore is a CheckpointStore keeping
+// checkpoints in JSON files of a directory, one per partition.
+type FileCheckpointStore struct {
+	dir string
+}
+
+// NewFileCheckpointStore returns a store of checkpoints
+// in the given directory creating it when it doesn't exist.
+func NewFileCheckpointStore(dir string) (*FileCheckpointStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileCheckpointStore{dir: dir}, nil
+}
+
+func (s *FileCheckpointStore) path(partitionID string) string {
+	return filepath.Join(s.dir, url.PathEscape(partitionID)+".json")
+}
+
+// Read implements CheckpointStore.
+func (s *FileCheckpointStore) Read(partitionID string) (Checkpoint, error) {
+	var cp Checkpoint
+	b, err := ioutil.ReadFile(s.path(partitionID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cp, ErrNoCheckpoint
+		}
+		return cp, err
+	}
+	return cp, json.Unmarshal(b, &cp)
+}
+
+// Write implements CheckpointStore, files are replaced
+// atomically so a crash never leaves a partial checkpoint.
+func (s *FileCheckpointStore) Write(partitionID string, cp Checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(s.dir, ".checkpoint")
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err = os.Rename(f.Name(), s.path(partitionID)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
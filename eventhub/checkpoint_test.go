@@ -0,0 +1,150 @@
+package eventhub
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/internal/clock"
+)
+
+func TestCheckpointer(t *testing.T) {
+	store := NewMemoryCheckpointStore()
+	ck := newCheckpointer(store, t.Logf)
+	evs := make([]*Event, 4)
+	for i := range evs {
+		evs[i] = &Event{PartitionID: "0", SequenceNumber: int64(i), Offset: string(rune('a' + i))}
+		ck.start(evs[i])
+	}
+
+	// later events finish first, the checkpoint waits for preceding ones
+	ck.finish(evs[2], true)
+	ck.finish(evs[1], true)
+	if err := ck.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Read("0"); err != ErrNoCheckpoint {
+		t.Fatalf("Read = %v, want %v", err, ErrNoCheckpoint)
+	}
+	ck.finish(evs[0], true)
+	ck.finish(evs[3], false)
+	if err := ck.flush(); err != nil {
+		t.Fatal(err)
+	}
+	cp, err := store.Read("0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cp.SequenceNumber != 2 || cp.Offset != "c" {
+		t.Fatalf("checkpoint = %+v, want sequence number 2", cp)
+	}
+
+	// an earlier event fails and later ones succeed,
+	// the checkpoint never advances past the failed one
+	for i := range evs {
+		evs[i] = &Event{PartitionID: "1", SequenceNumber: int64(i), Offset: string(rune('a' + i))}
+		ck.start(evs[i])
+	}
+	ck.finish(evs[0], true)
+	ck.finish(evs[2], true)
+	ck.finish(evs[1], false)
+	ck.finish(evs[3], true)
+	if err := ck.flushAll(); err != nil {
+		t.Fatal(err)
+	}
+	if cp, err = store.Read("1"); err != nil {
+		t.Fatal(err)
+	}
+	if cp.SequenceNumber != 0 || cp.Offset != "a" {
+		t.Fatalf("checkpoint = %+v, want sequence number 0", cp)
+	}
+}
+
+func TestCheckpointerDelay(t *testing.T) {
+	store := NewMemoryCheckpointStore()
+	clk := clock.NewFake(time.Now())
+	ck := newCheckpointer(store, t.Logf)
+	ck.clock, ck.delay = clk, time.Second
+
+	evs := []*Event{
+		{PartitionID: "0", SequenceNumber: 0},
+		{PartitionID: "0", SequenceNumber: 1},
+	}
+	read := func() int64 {
+		t.Helper()
+		if err := ck.flush(); err != nil {
+			t.Fatal(err)
+		}
+		cp, err := store.Read("0")
+		if err == ErrNoCheckpoint {
+			return -1
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return cp.SequenceNumber
+	}
+
+	ck.start(evs[0])
+	ck.finish(evs[0], true)
+	if seq := read(); seq != -1 {
+		t.Fatalf("checkpoint = %d before the delay passed, want none", seq)
+	}
+	clk.Advance(time.Second)
+	if seq := read(); seq != 0 {
+		t.Fatalf("checkpoint = %d, want 0", seq)
+	}
+
+	ck.start(evs[1])
+	ck.finish(evs[1], true)
+	if err := ck.flushAll(); err != nil {
+		t.Fatal(err)
+	}
+	if seq := read(); seq != 1 {
+		t.Fatalf("checkpoint = %d after flushAll, want 1", seq)
+	}
+}
+
+func TestFileCheckpointStore(t *testing.T) {
+	store, err := NewFileCheckpointStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.Read("1"); err != ErrNoCheckpoint {
+		t.Fatalf("Read = %v, want %v", err, ErrNoCheckpoint)
+	}
+	want := Checkpoint{Offset: "4096", SequenceNumber: 42, EnqueuedTime: time.Unix(1, 0).UTC()}
+	if err = store.Write("1", want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.Read("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Read = %+v, want %+v", got, want)
+	}
+}
+
+func TestCheckpointStartPosition(t *testing.T) {
+	store := NewMemoryCheckpointStore()
+	if err := store.Write("0", Checkpoint{SequenceNumber: 7}); err != nil {
+		t.Fatal(err)
+	}
+	var s sub
+	for _, opt := range []SubscribeOption{
+		WithSubscribeStartPosition(FromStart()),
+		WithSubscribeStartPositions(map[string]StartPosition{"1": FromOffset("1")}),
+		WithSubscribeCheckpointStore(store, time.Second),
+	} {
+		opt(&s)
+	}
+	for id, want := range map[string]StartPosition{
+		"0": FromSequenceNumber(7),
+		"1": FromOffset("1"),
+		"2": FromStart(),
+	} {
+		if p, ok, err := s.startPosition(id); err != nil || !ok || p != want {
+			t.Errorf("startPosition(%q) = %+v, %t, %v, want %+v", id, p, ok, err, want)
+		}
+	}
+}
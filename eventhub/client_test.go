@@ -2,9 +2,20 @@ package eventhub
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"reflect"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/amenzhinsky/iothub/internal/clock"
+	"pack.ag/amqp"
 )
 
 func TestParseConnectionString(t *testing.T) {
@@ -52,3 +63,730 @@ func TestClient_Subscribe(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// BenchmarkSubscribeDispositions compares receiving throughput of busy
+// partitions with a disposition frame per event and batched dispositions.
+func BenchmarkSubscribeDispositions(b *testing.B) {
+	cs := os.Getenv("TEST_EVENTHUB_CONNECTION_STRING")
+	if cs == "" {
+		b.Fatal("$TEST_EVENTHUB_CONNECTION_STRING is empty")
+	}
+	for name, opts := range map[string][]SubscribeOption{
+		"single": {WithSubscribeManualAccept(256)},
+		"batched": {
+			WithSubscribeManualAccept(256),
+			WithSubscribeDispositionBatching(256, time.Second),
+		},
+	} {
+		b.Run(name, func(b *testing.B) {
+			c, err := DialConnectionString(cs)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer c.Close()
+
+			start := time.Now()
+			if err = c.Subscribe(context.Background(), func(msg *Event) error {
+				return msg.Accept()
+			}, append(opts,
+				WithSubscribeSince(time.Unix(0, 0)),
+				WithSubscribeMaxMessages(b.N),
+			)...); err != nil {
+				b.Fatal(err)
+			}
+			b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msgs/s")
+		})
+	}
+}
+
+func TestNewEvent(t *testing.T) {
+	now := time.Now().UTC()
+	e := newEvent("3", &amqp.Message{
+		Annotations: amqp.Annotations{
+			"x-opt-offset":          "4096",
+			"x-opt-sequence-number": int64(42),
+			"x-opt-enqueued-time":   now,
+		},
+	})
+	if e.PartitionID != "3" || e.Offset != "4096" || e.SequenceNumber != 42 || !e.EnqueuedTime.Equal(now) {
+		t.Fatalf("event = %q, %q, %d, %s", e.PartitionID, e.Offset, e.SequenceNumber, e.EnqueuedTime)
+	}
+}
+
+func TestEventSettle(t *testing.T) {
+	var n int
+	e := &Event{done: func(bool) { n++ }}
+	e.settle(true)
+	e.settle(false)
+	if n != 1 {
+		t.Fatalf("done called %d times, want 1", n)
+	}
+
+	// auto-accept mode events have no done func
+	(&Event{}).settle(true)
+}
+
+func TestPartitionStatus(t *testing.T) {
+	start := time.Now()
+	ps := &partitionState{id: "1"}
+	if seq := ps.sequenceNumber(); seq != -1 {
+		t.Fatalf("sequenceNumber = %d, want -1", seq)
+	}
+	if s := ps.status(start.Add(time.Second), start); s.Idle != time.Second ||
+		!s.LastReceived.IsZero() {
+		t.Fatalf("status = %#v, want idle since start", s)
+	}
+
+	ps.update(&amqp.Message{
+		Annotations: amqp.Annotations{
+			"x-opt-offset":          "4096",
+			"x-opt-sequence-number": int64(42),
+		},
+	}, start.Add(2*time.Second))
+	s := ps.status(start.Add(5*time.Second), start)
+	if s.PartitionID != "1" || s.Offset != "4096" || s.SequenceNumber != 42 ||
+		s.Idle != 3*time.Second {
+		t.Fatalf("status = %#v", s)
+	}
+	if seq := ps.sequenceNumber(); seq != 42 {
+		t.Fatalf("sequenceNumber = %d, want 42", seq)
+	}
+}
+
+func TestReportStatus(t *testing.T) {
+	start := time.Now()
+	clk := clock.NewFake(start)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sc := make(chan *PartitionStatus, 1)
+	var s sub
+	WithSubscribeStatus(time.Minute, func(ps *PartitionStatus) {
+		sc <- ps
+	})(&s)
+	go reportStatus(ctx, clk, &s, []*partitionState{{id: "0"}}, start)
+
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clk.Advance(time.Minute)
+	select {
+	case ps := <-sc:
+		if ps.PartitionID != "0" || ps.Idle != time.Minute {
+			t.Fatalf("status = %#v", ps)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("status is not reported")
+	}
+}
+
+func TestConnectionLoss(t *testing.T) {
+	c := &Client{done: make(chan struct{})}
+	local, remote := net.Pipe()
+	nc := &notifyConn{Conn: local, fn: func(err error) { c.terminate(c.done, err) }}
+	go remote.Close()
+	if _, err := nc.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expected a read error")
+	}
+
+	select {
+	case <-c.Done():
+	default:
+		t.Fatal("Done is not closed after connection loss")
+	}
+	if c.Err() == nil {
+		t.Fatal("Err() = nil, want the connection loss cause")
+	}
+}
+
+func TestConnTLSOption(t *testing.T) {
+	for name, opt := range map[string]amqp.ConnOption{
+		"ConnTLS":       amqp.ConnTLS(true),
+		"ConnTLSConfig": amqp.ConnTLSConfig(&tls.Config{}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Dial("127.0.0.1:1", "hub", WithConnOption(opt)); err != errConnTLS {
+				t.Fatalf("Dial error = %v, want %v", err, errConnTLS)
+			}
+		})
+	}
+	if err := checkConnOptions([]amqp.ConnOption{
+		amqp.ConnSASLPlain("user", "pass"),
+		amqp.ConnIdleTimeout(time.Minute),
+	}); err != nil {
+		t.Fatalf("checkConnOptions error = %v, want nil", err)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	c := &Client{done: make(chan struct{})}
+	if err := c.reconnect(); err != nil {
+		t.Fatalf("reconnect with a live connection = %v, want nil", err)
+	}
+	if c.lost() {
+		t.Fatal("lost() = true, want false")
+	}
+
+	c.terminate(c.done, errors.New("connection reset"))
+	if !c.lost() {
+		t.Fatal("lost() = false, want true")
+	}
+	c.closed = true
+	if err := c.reconnect(); err != errClosed {
+		t.Fatalf("reconnect of a closed client = %v, want %v", err, errClosed)
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := &RetryPolicy{MaxInterval: 5 * time.Second, MaxAttempts: 5}
+	for i, want := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second,
+	} {
+		d, ok := p.delay(i)
+		if !ok || d != want {
+			t.Errorf("delay(%d) = %s, %t, want %s, true", i, d, ok, want)
+		}
+	}
+	if _, ok := p.delay(5); ok {
+		t.Error("delay(5) ok = true, want false")
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+	c := &Client{clock: clock.Real, done: make(chan struct{})}
+	s := &sub{acceptOnSuccess: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// receivers outpace the handler, so they block on the full buffer
+	msgc := make(chan *Event, 1)
+	errc := make(chan error, 2)
+	settled := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, id := range []string{"0", "1"} {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			c.receive(ctx, s, endlessReceiver{}, &partitionState{id: id}, 0, false, nil, settled, msgc, errc)
+		}(id)
+	}
+	var n int
+	err := dispatch(ctx, cancel, s, 2, msgc, errc, func(*Event) error {
+		if n++; n == 10 {
+			cancel()
+		}
+		return nil
+	})
+	close(settled)
+	wg.Wait()
+	if err = c.stopped(ctx, err); err != nil {
+		t.Fatalf("stopped = %v, want nil", err)
+	}
+
+	// goroutines of other tests may still be finishing
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("goroutines = %d, want %d", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispositionBatchingOptions(t *testing.T) {
+	c := &Client{}
+	for _, opt := range []SubscribeOption{
+		WithSubscribeDispositionBatching(1, time.Second),
+		WithSubscribeDispositionBatching(2, 0),
+	} {
+		if err := c.Subscribe(context.Background(), func(*Event) error {
+			return nil
+		}, opt); err == nil {
+			t.Fatal("expected an error on invalid arguments")
+		}
+	}
+}
+
+func TestAwaitDispositions(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	c := &Client{clock: clk}
+	s := &sub{batchSize: 2, batchAge: time.Second}
+	ps := &partitionState{id: "0"}
+	ps.settle(clk.Now())
+
+	done := make(chan struct{})
+	go func() {
+		c.awaitDispositions(s, []*partitionState{{id: "1"}, ps})
+		close(done)
+	}()
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clk.Advance(time.Second / 2)
+	select {
+	case <-done:
+		t.Fatal("returned before the batch max age passed")
+	case <-time.After(10 * time.Millisecond):
+	}
+	clk.Advance(time.Second / 2)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("didn't return after the batch max age passed")
+	}
+}
+
+func TestStopped(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Client{}
+	fail := errors.New("handler failed")
+	if err := c.stopped(ctx, &receiveError{amqp.ErrLinkClosed}); err != amqp.ErrLinkClosed {
+		t.Fatalf("stopped = %v, want %v", err, amqp.ErrLinkClosed)
+	}
+	cancel()
+	for _, err := range []error{ctx.Err(), &receiveError{amqp.ErrLinkClosed}, errClosed} {
+		if err = c.stopped(ctx, err); err != nil {
+			t.Errorf("stopped = %v, want nil", err)
+		}
+	}
+	if err := c.stopped(ctx, fail); err != fail {
+		t.Fatalf("stopped = %v, want %v", err, fail)
+	}
+	c.closed = true
+	if err := c.stopped(context.Background(), &receiveError{amqp.ErrSessionClosed}); err != nil {
+		t.Fatalf("stopped after Close = %v, want nil", err)
+	}
+}
+
+func TestManualAcceptCheckpoints(t *testing.T) {
+	store := NewMemoryCheckpointStore()
+	ck := newCheckpointer(store, t.Logf)
+	c := &Client{clock: clock.Real}
+	s := &sub{maxInFlight: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	msgc := make(chan *Event)
+	errc := make(chan error, 1)
+	settled := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.receive(ctx, s, &seqReceiver{}, &partitionState{id: "0"}, 0, false, ck, settled, msgc, errc)
+	}()
+	defer func() {
+		cancel()
+		close(settled)
+		<-done
+	}()
+
+	checkpoint := func() int64 {
+		t.Helper()
+		if err := ck.flushAll(); err != nil {
+			t.Fatal(err)
+		}
+		cp, err := store.Read("0")
+		if err == ErrNoCheckpoint {
+			return -1
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return cp.SequenceNumber
+	}
+
+	// handlers have returned but nothing is accepted yet
+	ev0, ev1 := <-msgc, <-msgc
+	if seq := checkpoint(); seq != -1 {
+		t.Fatalf("checkpoint = %d before accepting, want none", seq)
+	}
+
+	// events are settled the way Accept does after sending the disposition
+	ev1.settle(true)
+	if seq := checkpoint(); seq != -1 {
+		t.Fatalf("checkpoint = %d before accepting the preceding event, want none", seq)
+	}
+	ev0.settle(true)
+	if seq := checkpoint(); seq != 1 {
+		t.Fatalf("checkpoint = %d, want 1", seq)
+	}
+}
+
+// seqReceiver receives empty messages with increasing
+// sequence numbers starting at zero until ctx is done.
+type seqReceiver struct {
+	seq int64
+}
+
+func (r *seqReceiver) Receive(ctx context.Context) (*amqp.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	msg := &amqp.Message{Annotations: amqp.Annotations{"x-opt-sequence-number": r.seq}}
+	r.seq++
+	return msg, nil
+}
+
+func (r *seqReceiver) Close(ctx context.Context) error {
+	return nil
+}
+
+// endlessReceiver receives empty messages until ctx is done.
+type endlessReceiver struct{}
+
+func (endlessReceiver) Receive(ctx context.Context) (*amqp.Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &amqp.Message{}, nil
+}
+
+func (endlessReceiver) Close(ctx context.Context) error {
+	return nil
+}
+
+func TestFenced(t *testing.T) {
+	err := fenced("1", &amqp.DetachError{RemoteError: &amqp.Error{
+		Condition:   amqp.ErrorStolen,
+		Description: "receiver with a higher epoch '2' is created",
+	}})
+	if !errors.Is(err, ErrReceiverFenced) {
+		t.Fatalf("fenced = %v, want %v", err, ErrReceiverFenced)
+	}
+	for _, err := range []error{
+		&amqp.DetachError{},
+		&amqp.DetachError{RemoteError: &amqp.Error{Condition: amqp.ErrorInternalError}},
+		amqp.ErrLinkClosed,
+	} {
+		if got := fenced("1", err); got != err {
+			t.Errorf("fenced(%v) = %v, want it unchanged", err, got)
+		}
+	}
+
+	var s sub
+	WithSubscribeEpoch(2)(&s)
+	if v := s.props[epochProperty]; v != int64(2) {
+		t.Fatalf("epoch property = %v, want 2", v)
+	}
+}
+
+func TestExpandLinkName(t *testing.T) {
+	if got, want := expandLinkName(
+		"{eventHub}/{consumerGroup}-{partition}-{host}", "hub", "$Default", "3", "box",
+	), "hub/$Default-3-box"; got != want {
+		t.Fatalf("expandLinkName() = %q, want %q", got, want)
+	}
+}
+
+func TestDispatchConcurrency(t *testing.T) {
+	var s sub
+	WithSubscribeConcurrency(3)(&s)
+	WithSubscribeMaxMessages(10)(&s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgc := make(chan *Event)
+	go func() {
+		for {
+			select {
+			case msgc <- &Event{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var running, max, handled int32
+	if err := dispatch(ctx, cancel, &s, 1, msgc, nil, func(*Event) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		atomic.AddInt32(&handled, 1)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if max > 3 {
+		t.Errorf("max concurrent handlers = %d, want at most %d", max, 3)
+	}
+	if handled != 10 {
+		t.Errorf("handled = %d, want %d", handled, 10)
+	}
+}
+
+func TestDispatchPartitionOrder(t *testing.T) {
+	var s sub
+	WithSubscribeConcurrency(4)(&s)
+	WithSubscribePartitionOrder()(&s)
+	WithSubscribeMaxMessages(30)(&s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	msgc := make(chan *Event, 30)
+	for i := 0; i < 10; i++ {
+		for _, id := range []string{"0", "1", "2"} {
+			msgc <- &Event{PartitionID: id, SequenceNumber: int64(i)}
+		}
+	}
+
+	var mu sync.Mutex
+	running := map[string]bool{}
+	seqs := map[string][]int64{}
+	var parallel bool
+	if err := dispatch(ctx, cancel, &s, 3, msgc, nil, func(ev *Event) error {
+		mu.Lock()
+		if running[ev.PartitionID] {
+			t.Errorf("partition %s events are handled concurrently", ev.PartitionID)
+		}
+		running[ev.PartitionID] = true
+		parallel = parallel || len(running) > 1
+		seqs[ev.PartitionID] = append(seqs[ev.PartitionID], ev.SequenceNumber)
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		delete(running, ev.PartitionID)
+		mu.Unlock()
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := []int64{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+	for _, id := range []string{"0", "1", "2"} {
+		if !reflect.DeepEqual(seqs[id], want) {
+			t.Errorf("partition %s order = %v, want %v", id, seqs[id], want)
+		}
+	}
+	if !parallel {
+		t.Errorf("partitions are not handled in parallel")
+	}
+}
+
+func BenchmarkDispatchSlowHandler(b *testing.B) {
+	var s sub
+	WithSubscribeConcurrency(8)(&s)
+	WithSubscribeMaxMessages(b.N)(&s)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	msgc := make(chan *Event, 4)
+	go func() {
+		for {
+			select {
+			case msgc <- &Event{}:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var goroutines int32
+	b.ResetTimer()
+	if err := dispatch(ctx, cancel, &s, 1, msgc, nil, func(*Event) error {
+		if n := int32(runtime.NumGoroutine()); n > atomic.LoadInt32(&goroutines) {
+			atomic.StoreInt32(&goroutines, n)
+		}
+		time.Sleep(100 * time.Microsecond)
+		return nil
+	}); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportMetric(float64(goroutines), "max-goroutines")
+}
+
+func TestStartPosition(t *testing.T) {
+	var s sub
+	for _, opt := range []SubscribeOption{
+		WithSubscribeStartPosition(FromStart()),
+		WithSubscribeSequenceNumbers(map[string]int64{"1": 42}),
+		WithSubscribeStartPositions(map[string]StartPosition{
+			"2": FromOffset("1024"),
+			"3": FromEnqueuedTime(time.Unix(1, 0)),
+		}),
+	} {
+		opt(&s)
+	}
+	for id, want := range map[string]StartPosition{
+		"0": {filter: "amqp.annotation.x-opt-offset > '-1'"},
+		"1": {seq: 42, isSeq: true},
+		"2": {filter: "amqp.annotation.x-opt-offset > '1024'"},
+		"3": {filter: "amqp.annotation.x-opt-enqueuedtimeutc > '1000'"},
+	} {
+		if p, ok, err := s.startPosition(id); err != nil || !ok || p != want {
+			t.Errorf("position(%q) = %+v, %t, want %+v", id, p, ok, want)
+		}
+	}
+
+	if _, ok, _ := (&sub{}).startPosition("0"); ok {
+		t.Errorf("position is set without options")
+	}
+}
+
+func TestCheckExpired(t *testing.T) {
+	for _, v := range []struct {
+		seq     int64
+		info    PartitionInfo
+		expired bool
+	}{
+		{10, PartitionInfo{BeginSequenceNumber: 5, LastEnqueuedSequenceNumber: 20}, false},
+		{4, PartitionInfo{BeginSequenceNumber: 5, LastEnqueuedSequenceNumber: 20}, false},
+		{3, PartitionInfo{BeginSequenceNumber: 5, LastEnqueuedSequenceNumber: 20}, true},
+		{20, PartitionInfo{LastEnqueuedSequenceNumber: 20, Empty: true}, false},
+		{10, PartitionInfo{LastEnqueuedSequenceNumber: 20, Empty: true}, true},
+	} {
+		e := checkExpired("0", v.seq, &v.info)
+		if (e != nil) != v.expired {
+			t.Errorf("checkExpired(%d, %+v) = %v, want expired = %t", v.seq, v.info, e, v.expired)
+		}
+	}
+}
+
+func TestParsePartitionIDs(t *testing.T) {
+	want := []string{"0", "1"}
+	for _, v := range []interface{}{
+		[]string{"0", "1"},
+		[]interface{}{"0", "1"},
+	} {
+		ids, err := parsePartitionIDs(map[string]interface{}{"partition_ids": v})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, want) {
+			t.Errorf("parsePartitionIDs(%#v) = %v, want %v", v, ids, want)
+		}
+	}
+	for _, v := range []interface{}{nil, []interface{}{"0", int64(1)}, "0"} {
+		if _, err := parsePartitionIDs(map[string]interface{}{"partition_ids": v}); err == nil {
+			t.Errorf("parsePartitionIDs(%#v) error = nil", v)
+		}
+	}
+}
+
+func TestParsePartitionInfo(t *testing.T) {
+	now := time.Now().UTC()
+	info, err := parsePartitionInfo("1", map[string]interface{}{
+		"begin_sequence_number":         int64(5),
+		"last_enqueued_sequence_number": int64(20),
+		"last_enqueued_offset":          "4096",
+		"last_enqueued_time_utc":        now,
+		"is_partition_empty":            false,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &PartitionInfo{
+		PartitionID:                "1",
+		BeginSequenceNumber:        5,
+		LastEnqueuedSequenceNumber: 20,
+		LastEnqueuedOffset:         "4096",
+		LastEnqueuedTime:           now,
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Fatalf("parsePartitionInfo = %+v, want %+v", info, want)
+	}
+	if _, err = parsePartitionInfo("1", map[string]interface{}{}); err == nil {
+		t.Fatal("expected an error on an incomplete response")
+	}
+}
+
+func TestGetPartitionRuntimeInformation(t *testing.T) {
+	enqueued := time.Unix(1600000000, 0).UTC()
+	b := newBroker(t)
+	b.manage(func(props map[string]interface{}) map[string]interface{} {
+		if props["operation"] != "READ" || props["name"] != "hub" ||
+			props["type"] != "com.microsoft:partition" || props["partition"] != "1" {
+			return nil
+		}
+		return map[string]interface{}{
+			"begin_sequence_number":         int64(5),
+			"last_enqueued_sequence_number": int64(20),
+			"last_enqueued_offset":          "4096",
+			"last_enqueued_time_utc":        enqueued,
+			"is_partition_empty":            false,
+		}
+	})
+	c := b.dial()
+
+	info, err := c.GetPartitionRuntimeInformation(context.Background(), "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.PartitionID != "1" || info.BeginSequenceNumber != 5 ||
+		info.LastEnqueuedSequenceNumber != 20 || info.LastEnqueuedOffset != "4096" ||
+		!info.LastEnqueuedTime.Equal(enqueued) || info.Empty {
+		t.Fatalf("GetPartitionRuntimeInformation = %+v", info)
+	}
+	if _, err = c.GetPartitionRuntimeInformation(context.Background(), "2"); err == nil {
+		t.Fatal("expected an error on an unknown partition")
+	}
+}
+
+func TestWithIDGenerator(t *testing.T) {
+	b := newBroker(t)
+	b.manage(func(props map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"begin_sequence_number":         int64(0),
+			"last_enqueued_sequence_number": int64(0),
+			"is_partition_empty":            true,
+		}
+	})
+	var n int32
+	c := b.dial(WithIDGenerator(func() string {
+		return fmt.Sprintf("id-%d", atomic.AddInt32(&n, 1))
+	}))
+
+	if _, err := c.GetPartitionRuntimeInformation(context.Background(), "0"); err != nil {
+		t.Fatal(err)
+	}
+	msgs := b.received()
+	if len(msgs) != 1 {
+		t.Fatalf("received %d requests, want 1", len(msgs))
+	}
+	if p := msgs[0].Properties; p.ReplyTo != "id-1" || p.MessageID != "id-2" {
+		t.Fatalf("reply-to = %q, message-id = %v, want id-1 and id-2", p.ReplyTo, p.MessageID)
+	}
+}
+
+func TestSubscribePrefetch(t *testing.T) {
+	b := newBroker(t)
+	b.manage(func(props map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"partition_ids": []string{"0"}}
+	})
+	c := b.dial()
+
+	for group, tc := range map[string]struct {
+		opts []SubscribeOption
+		want uint32
+	}{
+		"default":  {nil, DefaultPrefetch},
+		"prefetch": {[]SubscribeOption{WithSubscribePrefetch(7)}, 7},
+		"batching": {[]SubscribeOption{
+			WithSubscribeDispositionBatching(4, time.Second),
+			WithSubscribePrefetch(7),
+		}, 7},
+		"manual": {[]SubscribeOption{
+			WithSubscribePrefetch(7),
+			WithSubscribeManualAccept(2),
+		}, 2},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		errc := make(chan error, 1)
+		go func(opts []SubscribeOption) {
+			errc <- c.Subscribe(ctx, func(*Event) error { return nil }, opts...)
+		}(append(tc.opts, WithSubscribeConsumerGroup(group)))
+
+		addr := "/hub/ConsumerGroups/" + group + "/Partitions/0"
+		deadline := time.Now().Add(time.Second)
+		for b.credit(addr) == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+		if err := <-errc; err != nil && err != context.Canceled {
+			t.Fatalf("%s: Subscribe error = %v", group, err)
+		}
+		if got := b.credit(addr); got != tc.want {
+			t.Errorf("%s: credit = %d, want %d", group, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package eventhub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"pack.ag/amqp"
+)
+
+// MaxMessageSize is the maximum size of an encoded message
+// or a batch of messages accepted by Event Hubs Standard,
+// it's the default limit, see WithMaxMessageSize.
+const MaxMessageSize = 1 << 20
+
+// batchMessageFormat is the message format code of batched messages.
+const batchMessageFormat = 0x80013700
+
+// MessageSizeError is returned when a single message
+// cannot be sent because it exceeds the size limit.
+type MessageSizeError struct {
+	Index int // index of the message in the sent slice
+	Size  int
+	Limit int
+}
+
+func (e *MessageSizeError) Error() string {
+	return fmt.Sprintf("message %d size %d exceeds the limit of %d bytes",
+		e.Index, e.Size, e.Limit)
+}
+
+// partitionKeyAnnotation is the message annotation events are partitioned by.
+const partitionKeyAnnotation = "x-opt-partition-key"
+
+// SendOption is a send configuration option.
+type SendOption func(o *sendOptions)
+
+type sendOptions struct {
+	partitionKey string
+}
+
+// WithSendPartitionKey makes the hub store all events sent with the same
+// key in the same partition, so consumers can process them in order.
+//
+// IoT Hub ignores partition keys supplied by devices and always partitions
+// device-to-cloud messages by device id, so it's available only here.
+func WithSendPartitionKey(key string) SendOption {
+	return func(o *sendOptions) {
+		o.partitionKey = key
+	}
+}
+
+// Send sends the given message to the hub over a sender link that's
+// opened on the first send and reused by subsequent ones.
+//
+// Messages exceeding the size limit, see WithMaxMessageSize,
+// are rejected with *MessageSizeError.
+func (c *Client) Send(ctx context.Context, msg *amqp.Message, opts ...SendOption) error {
+	if msg == nil {
+		return errors.New("message is nil")
+	}
+	var o sendOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	msg = withPartitionKey(msg, o.partitionKey)
+
+	b, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if limit := c.MaxMessageSize(); len(b) > limit {
+		return &MessageSizeError{Index: 0, Size: len(b), Limit: limit}
+	}
+	send, err := c.getSendLink(ctx)
+	if err != nil {
+		return err
+	}
+	return send.Send(ctx, msg)
+}
+
+// withPartitionKey returns a shallow copy of msg with the partition key
+// annotation set leaving msg intact, it returns msg when key is empty.
+func withPartitionKey(msg *amqp.Message, key string) *amqp.Message {
+	if key == "" || msg == nil {
+		return msg
+	}
+	cp := *msg
+	cp.Annotations = make(amqp.Annotations, len(msg.Annotations)+1)
+	for k, v := range msg.Annotations {
+		cp.Annotations[k] = v
+	}
+	cp.Annotations[partitionKeyAnnotation] = key
+	return &cp
+}
+
+// SendBatch sends the given messages to the hub packing them into
+// as few batches as possible without exceeding the size limit,
+// see WithMaxMessageSize, and returns the number of sent batches.
+//
+// When a message cannot fit into a batch even alone a *MessageSizeError
+// is returned, batches preceding the message are sent anyway.
+func (c *Client) SendBatch(
+	ctx context.Context,
+	msgs []*amqp.Message,
+	opts ...SendOption,
+) (int, error) {
+	if len(msgs) == 0 {
+		return 0, errors.New("no messages to send")
+	}
+	var o sendOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// the key has to be set on both the batch and every message in it
+	var ann amqp.Annotations
+	if o.partitionKey != "" {
+		ann = amqp.Annotations{partitionKeyAnnotation: o.partitionKey}
+		keyed := make([]*amqp.Message, len(msgs))
+		for i, msg := range msgs {
+			keyed[i] = withPartitionKey(msg, o.partitionKey)
+		}
+		msgs = keyed
+	}
+	batches, err := splitBatches(msgs, c.MaxMessageSize(), ann)
+	if err != nil && len(batches) == 0 {
+		return 0, err
+	}
+	send, serr := c.getSendLink(ctx)
+	if serr != nil {
+		return 0, serr
+	}
+	for i, b := range batches {
+		if serr = send.Send(ctx, b); serr != nil {
+			return i, serr
+		}
+	}
+	return len(batches), err
+}
+
+// MaxMessageSize returns the maximum size of an encoded message or batch
+// the client sends, see WithMaxMessageSize.
+//
+// It's not the max-message-size negotiated with the hub when the sender
+// link is attached, pack.ag/amqp doesn't export it, so on tiers with lower
+// limits, e.g. 256KB of Event Hubs Basic, WithMaxMessageSize has to be set
+// for SendBatch to build batches the hub accepts. The link enforces the
+// negotiated limit anyway, larger messages fail without being sent.
+func (c *Client) MaxMessageSize() int {
+	if c.maxSize > 0 {
+		return c.maxSize
+	}
+	return MaxMessageSize
+}
+
+// splitBatches encodes msgs into batch messages with the given annotations
+// each not exceeding limit.
+//
+// On an oversized message it returns batches preceding it and an error.
+func splitBatches(msgs []*amqp.Message, limit int, ann amqp.Annotations) ([]*amqp.Message, error) {
+	// each data section adds a descriptor and a 32-bit length prefix
+	const sectionOverhead = 8
+
+	base, err := (&amqp.Message{
+		Format:      batchMessageFormat,
+		Annotations: ann,
+	}).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	var batches []*amqp.Message
+	var cur *amqp.Message
+	var size int
+	for i, msg := range msgs {
+		if msg == nil {
+			return batches, fmt.Errorf("message %d is nil", i)
+		}
+		b, err := msg.MarshalBinary()
+		if err != nil {
+			return batches, err
+		}
+		n := len(b) + sectionOverhead
+		if len(base)+n > limit {
+			return batches, &MessageSizeError{Index: i, Size: len(b), Limit: limit}
+		}
+		if cur == nil || size+n > limit {
+			cur = &amqp.Message{Format: batchMessageFormat, Annotations: ann}
+			size = len(base)
+			batches = append(batches, cur)
+		}
+		cur.Data = append(cur.Data, b)
+		size += n
+	}
+	return batches, nil
+}
+
+// getSendLink caches sender link between calls to speed up sending events.
+func (c *Client) getSendLink(ctx context.Context) (*amqp.Sender, error) {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if c.sendLink != nil {
+		return c.sendLink, nil
+	}
+
+	sess, err := c.connection().NewSession()
+	if err != nil {
+		return nil, err
+	}
+	send, err := sess.NewSender(
+		amqp.LinkTargetAddress(c.name),
+		amqp.LinkMaxMessageSize(uint64(c.MaxMessageSize())),
+	)
+	if err != nil {
+		_ = sess.Close(context.Background())
+		return nil, err
+	}
+	c.sendSess, c.sendLink = sess, send
+	c.debugf("opened sender link to %s", c.name)
+	return send, nil
+}
+
+// closeSendLink closes the cached sender link along with its session,
+// c.sendMu must be held by the caller.
+func (c *Client) closeSendLink() {
+	if c.sendLink == nil {
+		return
+	}
+	_ = c.sendLink.Close(context.Background())
+	_ = c.sendSess.Close(context.Background())
+	c.sendSess, c.sendLink = nil, nil
+}
@@ -0,0 +1,211 @@
+package eventhub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"pack.ag/amqp"
+)
+
+func TestSplitBatches(t *testing.T) {
+	msgs := make([]*amqp.Message, 10)
+	for i := range msgs {
+		msgs[i] = amqp.NewMessage(bytes.Repeat([]byte{'a'}, 100))
+	}
+	batches, err := splitBatches(msgs, 512, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) < 2 {
+		t.Fatalf("len(batches) = %d, want messages to be split", len(batches))
+	}
+	var n int
+	for _, b := range batches {
+		if b.Format != batchMessageFormat {
+			t.Errorf("Format = %x, want %x", b.Format, batchMessageFormat)
+		}
+		p, err := b.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(p) > 512 {
+			t.Errorf("batch size = %d, exceeds %d", len(p), 512)
+		}
+		n += len(b.Data)
+	}
+	if n != len(msgs) {
+		t.Errorf("number of batched messages = %d, want %d", n, len(msgs))
+	}
+}
+
+func TestSplitBatchesOversized(t *testing.T) {
+	msgs := []*amqp.Message{
+		amqp.NewMessage([]byte("a")),
+		amqp.NewMessage(bytes.Repeat([]byte{'a'}, 1024)),
+	}
+	batches, err := splitBatches(msgs, 512, nil)
+	serr, ok := err.(*MessageSizeError)
+	if !ok {
+		t.Fatalf("err = %v, want *MessageSizeError", err)
+	}
+	if serr.Index != 1 {
+		t.Errorf("Index = %d, want %d", serr.Index, 1)
+	}
+	if len(batches) != 1 {
+		t.Errorf("len(batches) = %d, want %d", len(batches), 1)
+	}
+}
+
+func TestSplitBatchesAnnotations(t *testing.T) {
+	ann := amqp.Annotations{partitionKeyAnnotation: "key"}
+	batches, err := splitBatches([]*amqp.Message{
+		amqp.NewMessage([]byte("a")),
+	}, 512, ann)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 {
+		t.Fatalf("len(batches) = %d, want %d", len(batches), 1)
+	}
+	if k := batches[0].Annotations[partitionKeyAnnotation]; k != "key" {
+		t.Fatalf("partition key = %v, want %q", k, "key")
+	}
+}
+
+func TestWithPartitionKey(t *testing.T) {
+	msg := amqp.NewMessage([]byte("a"))
+	if withPartitionKey(msg, "") != msg {
+		t.Fatal("message is copied without a key")
+	}
+	msg.Annotations = amqp.Annotations{"x-opt-custom": "v"}
+	cp := withPartitionKey(msg, "key")
+	if k := cp.Annotations[partitionKeyAnnotation]; k != "key" {
+		t.Fatalf("partition key = %v, want %q", k, "key")
+	}
+	if v := cp.Annotations["x-opt-custom"]; v != "v" {
+		t.Fatalf("x-opt-custom = %v, want %q", v, "v")
+	}
+	if _, ok := msg.Annotations[partitionKeyAnnotation]; ok {
+		t.Fatal("the original message is modified")
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	c := &Client{}
+	if n := c.MaxMessageSize(); n != MaxMessageSize {
+		t.Fatalf("MaxMessageSize = %d, want %d", n, MaxMessageSize)
+	}
+	WithMaxMessageSize(64)(c)
+	if n := c.MaxMessageSize(); n != 64 {
+		t.Fatalf("MaxMessageSize = %d, want %d", n, 64)
+	}
+
+	// the limit is checked before the sender link is opened
+	err := c.Send(context.Background(), amqp.NewMessage(make([]byte, 64)))
+	var serr *MessageSizeError
+	if !errors.As(err, &serr) || serr.Limit != 64 {
+		t.Fatalf("Send = %v, want a *MessageSizeError with the limit of 64", err)
+	}
+	if _, err = c.SendBatch(context.Background(), []*amqp.Message{
+		amqp.NewMessage(make([]byte, 64)),
+	}); !errors.As(err, &serr) {
+		t.Fatalf("SendBatch = %v, want a *MessageSizeError", err)
+	}
+}
+
+func TestSendLinkMaxMessageSize(t *testing.T) {
+	b := newBroker(t)
+	b.limitSize(512)
+	c := b.dial(WithMaxMessageSize(1024))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := c.Send(ctx, amqp.NewMessage([]byte("hello"))); err != nil {
+		t.Fatal(err)
+	}
+	if n := b.maxSize("hub"); n != 1024 {
+		t.Fatalf("sender max-message-size = %d, want %d", n, 1024)
+	}
+
+	// the limit advertised by the hub is enforced by the link
+	// even though the client's own limit is higher
+	if err := c.Send(ctx, amqp.NewMessage(make([]byte, 768))); err == nil {
+		t.Fatal("a message exceeding the negotiated limit is sent")
+	}
+	if err := c.Send(ctx, amqp.NewMessage([]byte("last"))); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msgs := b.received()
+		if n := len(msgs); n != 0 && string(msgs[n-1].GetData()) == "last" {
+			if n != 2 {
+				t.Fatalf("received %d messages, want %d", n, 2)
+			}
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("messages are not received")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestSendReconnect(t *testing.T) {
+	b := newBroker(t)
+	c := b.dial()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// sends fail while the connection is down, they
+	// only have to keep going without races or deadlocks
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_ = c.Send(ctx, amqp.NewMessage([]byte("hello")))
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		b.drop()
+		select {
+		case <-c.Done():
+		case <-ctx.Done():
+			t.Fatal("connection loss is not noticed")
+		}
+		if err := c.reconnect(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if err := c.Send(ctx, amqp.NewMessage([]byte("last"))); err != nil {
+		t.Fatalf("Send after reconnect = %v", err)
+	}
+	for {
+		msgs := b.received()
+		if len(msgs) != 0 && string(msgs[len(msgs)-1].GetData()) == "last" {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("the last message is not received")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
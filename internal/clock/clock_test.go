@@ -0,0 +1,41 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	c1 := f.After(time.Second)
+	c2 := f.After(time.Minute)
+	if n := f.Waiters(); n != 2 {
+		t.Fatalf("Waiters = %d, want 2", n)
+	}
+
+	f.Advance(time.Second)
+	select {
+	case now := <-c1:
+		if want := start.Add(time.Second); !now.Equal(want) {
+			t.Fatalf("fired at %s, want %s", now, want)
+		}
+	default:
+		t.Fatal("timer didn't fire")
+	}
+	select {
+	case <-c2:
+		t.Fatal("timer fired too early")
+	default:
+	}
+
+	f.Advance(time.Minute)
+	select {
+	case <-c2:
+	default:
+		t.Fatal("timer didn't fire")
+	}
+	if n := f.Waiters(); n != 0 {
+		t.Fatalf("Waiters = %d, want 0", n)
+	}
+}
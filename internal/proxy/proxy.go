@@ -0,0 +1,144 @@
+// Package proxy dials TCP connections through HTTP proxies with CONNECT.
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Parse parses a proxy URL, the scheme defaults to http when omitted.
+//
+// Only http and https proxies are supported, basic
+// auth credentials can be passed in the userinfo part.
+func Parse(s string) (*url.URL, error) {
+	if !strings.Contains(s, "://") {
+		s = "http://" + s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("proxy: unsupported scheme %q", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("proxy: host is empty")
+	}
+	return u, nil
+}
+
+// FromEnvironment returns the proxy for TLS connections to addr
+// according to HTTPS_PROXY and NO_PROXY environment variables,
+// the same way net/http does, nil means no proxy is needed.
+func FromEnvironment(addr string) (*url.URL, error) {
+	return http.ProxyFromEnvironment(&http.Request{
+		URL: &url.URL{Scheme: "https", Host: addr},
+	})
+}
+
+// Dial connects to addr through the proxy u or directly when it's nil.
+func Dial(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+	var d net.Dialer
+	if u == nil {
+		return d.DialContext(ctx, "tcp", addr)
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	}
+
+	// abort the handshake when ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	conn, err = connect(conn, u, addr)
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// connect requests a tunnel to addr over conn and closes it on failure.
+func connect(conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString(
+			[]byte(u.User.Username()+":"+pass),
+		))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &Error{Addr: addr, Status: res.Status}
+	}
+	if br.Buffered() != 0 {
+		return &bufConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// Error is returned when a proxy refuses to open a tunnel.
+type Error struct {
+	Addr   string
+	Status string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("proxy: CONNECT %s: %s", e.Addr, e.Status)
+}
+
+// bufConn reads data the proxy sent after its response first.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
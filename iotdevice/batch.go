@@ -0,0 +1,144 @@
+package iotdevice
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+// MaxBatchSize is the maximum total size of messages sent by SendEvents
+// in bytes, it's the hub's limit of a single device-to-cloud message,
+// WithMaxSendSize overrides it as well.
+const MaxBatchSize = MaxMessageSize
+
+// BatchError is returned by SendEvents when some messages fail to be sent,
+// Errs holds errors at indexes of the failed messages and nils otherwise.
+type BatchError struct {
+	Errs []error
+}
+
+func (e *BatchError) Error() string {
+	var n int
+	var first error
+	for _, err := range e.Errs {
+		if err != nil {
+			if first == nil {
+				first = err
+			}
+			n++
+		}
+	}
+	return fmt.Sprintf("%d of %d messages failed to send: %s", n, len(e.Errs), first)
+}
+
+// Unwrap makes errors.Is and errors.As match errors of the failed messages.
+func (e *BatchError) Unwrap() []error {
+	return e.Errs
+}
+
+// SendEvents sends the given device-to-cloud messages at once, each keeps
+// its own properties, message id and expiry time, default properties and send
+// interceptors are applied to copies of them as to messages of SendEvent.
+//
+// Transports that cannot send messages in a single batch send them in order
+// without waiting for acknowledgements in between, e.g. MQTT publishes them
+// back to back, others send them one by one. When some messages fail the
+// error is *BatchError. Batches larger than MaxBatchSize on the wire or
+// with larger messages are rejected with *PayloadSizeError and batches with
+// already expired messages with ErrMessageExpired before anything is sent.
+func (c *Client) SendEvents(ctx context.Context, msgs []*common.Message) error {
+	if ctx == nil {
+		return errNilContext
+	}
+	if err := c.checkConnection(ctx); err != nil {
+		return err
+	}
+	batch := make([]*common.Message, len(msgs))
+	var size int
+	for i, msg := range msgs {
+		if msg == nil || msg.Payload == nil {
+			return fmt.Errorf("message %d payload is nil", i)
+		}
+		m := *msg
+		if len(c.props) != 0 || len(msg.Properties) != 0 {
+			m.Properties = make(map[string]string, len(c.props)+len(msg.Properties))
+			for k, v := range c.props {
+				m.Properties[k] = v
+			}
+			for k, v := range msg.Properties {
+				m.Properties[k] = v
+			}
+		}
+		if err := c.intercept(&m); err != nil {
+			return err
+		}
+		if err := c.checkExpiry(&m); err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+		if err := c.checkSize(&m); err != nil {
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+		n, err := c.wireSize(&m)
+		if err != nil {
+			return err
+		}
+		size += n
+		batch[i] = &m
+	}
+	if limit := c.sendLimit(); size > limit {
+		return &PayloadSizeError{Size: size, Limit: limit}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+
+	if err := c.sends.add(); err != nil {
+		return err
+	}
+	errs := c.sendBatch(ctx, batch)
+	abandoned := c.sends.done()
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if abandoned {
+			return &SendAbandonedError{}
+		}
+		return &BatchError{Errs: errs}
+	}
+	c.logger.Debugf("device-to-cloud: %d messages", len(batch))
+	return nil
+}
+
+// sendBatch sends msgs and returns an error per message.
+func (c *Client) sendBatch(ctx context.Context, msgs []*common.Message) []error {
+	errs := make([]error, len(msgs))
+	b, ok := c.tr.(transport.BatchSender)
+	if !ok {
+		for i, msg := range msgs {
+			errs[i] = c.send(ctx, msg)
+		}
+		return errs
+	}
+	if c.limiter != nil {
+		for range msgs {
+			if err := c.limiter.wait(ctx); err != nil {
+				for i := range errs {
+					errs[i] = err
+				}
+				return errs
+			}
+		}
+	}
+	start := c.sendStarted(len(msgs))
+	errs = b.SendBatch(ctx, msgs)
+	if len(errs) != len(msgs) {
+		panic("transport returned wrong number of errors")
+	}
+	for _, err := range errs {
+		c.sendDone(ctx, start, err)
+	}
+	return errs
+}
@@ -0,0 +1,97 @@
+package iotdevice
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+// batchTransport is a fakeTransport sending batches,
+// messages with failing payloads fail to be sent.
+type batchTransport struct {
+	fakeTransport
+	sent []*common.Message
+}
+
+func (tr *batchTransport) SendBatch(ctx context.Context, msgs []*common.Message) []error {
+	errs := make([]error, len(msgs))
+	for i, msg := range msgs {
+		if bytes.Equal(msg.Payload, []byte("failing")) {
+			errs[i] = errors.New("nack")
+			continue
+		}
+		tr.sent = append(tr.sent, msg)
+	}
+	return errs
+}
+
+func TestSendEvents(t *testing.T) {
+	tr := &batchTransport{}
+	c := newTestClient(t, tr, WithDefaultProperties(map[string]string{"fw": "1.0"}))
+	defer c.Close()
+
+	msgs := []*common.Message{
+		{MessageID: "1", Payload: []byte("a")},
+		{MessageID: "2", Payload: []byte("b"), Properties: map[string]string{"fw": "2.0"}},
+	}
+	if err := c.SendEvents(context.Background(), msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(tr.sent) != 2 || tr.sent[0].MessageID != "1" || tr.sent[1].MessageID != "2" {
+		t.Fatalf("sent = %v, want messages 1 and 2", tr.sent)
+	}
+	if p := tr.sent[1].Properties; !reflect.DeepEqual(p, map[string]string{"fw": "2.0"}) {
+		t.Fatalf("properties = %v, want own properties to override defaults", p)
+	}
+	if msgs[0].Properties != nil {
+		t.Fatal("given message is modified")
+	}
+
+	err := c.SendEvents(context.Background(), []*common.Message{
+		{Payload: []byte("a")},
+		{Payload: []byte("failing")},
+	})
+	var berr *BatchError
+	if !errors.As(err, &berr) || berr.Errs[0] != nil || berr.Errs[1] == nil {
+		t.Fatalf("SendEvents() = %v, want the second message failed", err)
+	}
+	if s := c.Stats(); s.MessagesSent != 3 || s.SendErrors != 1 {
+		t.Fatalf("sent = %d, errors = %d, want 3 and 1", s.MessagesSent, s.SendErrors)
+	}
+}
+
+func TestSendEventsSizeLimit(t *testing.T) {
+	tr := &batchTransport{}
+	c := newTestClient(t, tr)
+	defer c.Close()
+
+	msgs := []*common.Message{
+		{Payload: make([]byte, MaxBatchSize/2)},
+		{Payload: make([]byte, MaxBatchSize/2+1)},
+	}
+	err := c.SendEvents(context.Background(), msgs)
+	if perr, ok := err.(*PayloadSizeError); !ok || perr.Size != MaxBatchSize+1 {
+		t.Fatalf("SendEvents() = %v, want *PayloadSizeError", err)
+	}
+	if len(tr.sent) != 0 {
+		t.Fatal("oversized batch is sent")
+	}
+}
+
+func TestSendEventsFallback(t *testing.T) {
+	c := newTestClient(t, &fakeTransport{sendErr: errors.New("nack")})
+	defer c.Close()
+
+	err := c.SendEvents(context.Background(), []*common.Message{
+		{Payload: []byte("a")},
+		{Payload: []byte("b")},
+	})
+	var berr *BatchError
+	if !errors.As(err, &berr) || len(berr.Errs) != 2 {
+		t.Fatalf("SendEvents() = %v, want both messages failed", err)
+	}
+}
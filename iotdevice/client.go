@@ -5,10 +5,18 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
 	"os"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 
 	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/internal/clock"
 	"github.com/amenzhinsky/iothub/iotdevice/transport"
 )
 
@@ -46,7 +54,8 @@ func WithCredentials(creds transport.Credentials) ClientOption {
 }
 
 // WithConnectionString same as WithCredentials,
-// but it parses the given connection string first.
+// but it parses the given connection string first,
+// strings with ModuleId authenticate as a module.
 func WithConnectionString(cs string) ClientOption {
 	return func(c *Client) error {
 		var err error
@@ -70,6 +79,22 @@ func WithX509FromCert(deviceID, hostname string, crt *tls.Certificate) ClientOpt
 	}
 }
 
+// WithX509FromCallback enables x509 authentication with the client
+// certificate returned by fn, see NewX509CredentialsFromCallback.
+func WithX509FromCallback(
+	deviceID, hostname string,
+	fn func(*tls.CertificateRequestInfo) (*tls.Certificate, error),
+) ClientOption {
+	return func(c *Client) error {
+		var err error
+		c.creds, err = NewX509CredentialsFromCallback(deviceID, hostname, fn)
+		if err != nil {
+			return err
+		}
+		return nil
+	}
+}
+
 // WithX509FromFile is same as `WithX509FromCert` but parses the given pem files first.
 func WithX509FromFile(deviceID, hostname, certFile, keyFile string) ClientOption {
 	return func(c *Client) error {
@@ -81,16 +106,253 @@ func WithX509FromFile(deviceID, hostname, certFile, keyFile string) ClientOption
 	}
 }
 
+// WithX509ModuleFromFile is WithX509FromFile of a module identity.
+func WithX509ModuleFromFile(deviceID, moduleID, hostname, certFile, keyFile string) ClientOption {
+	return func(c *Client) error {
+		crt, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		c.creds, err = NewX509ModuleCredentials(deviceID, moduleID, hostname, &crt)
+		return err
+	}
+}
+
+// WithTLSConfig makes transports dial with a clone of cfg, e.g. to pin
+// the hub's root CA or restrict cipher suites, regardless of the order
+// of options. ServerName, RootCAs and the client certificate
+// are taken from the credentials when they're unset in cfg.
+func WithTLSConfig(cfg *tls.Config) ClientOption {
+	return func(c *Client) error {
+		if cfg == nil {
+			return errors.New("cfg is nil")
+		}
+		c.tls = cfg
+		return nil
+	}
+}
+
+// WithAdaptiveSendRate limits the rate of sent messages to max per second
+// and adapts it to the hub's quota, the rate is halved down to min every
+// time a send fails and slowly ramps back up while sends succeed.
+//
+// MQTT has no dedicated throttling responses, when a device exceeds
+// its quota the hub delays acknowledgements or drops the connection,
+// so any send failure except context errors is considered throttling.
+func WithAdaptiveSendRate(min, max float64) ClientOption {
+	return func(c *Client) error {
+		if min <= 0 || max < min {
+			return errors.New("rate limits must be positive and min must not exceed max")
+		}
+		c.limiter = newRateLimiter(c.clock, min, max)
+		return nil
+	}
+}
+
+// WithTwinTimeout limits duration of twin retrievals and updates,
+// when a response isn't received in time ErrTwinTimeout is returned
+// regardless of the deadline of the context passed to the operation.
+//
+// By default operations are limited only by their contexts
+// and the transport's own timeout.
+func WithTwinTimeout(d time.Duration) ClientOption {
+	return func(c *Client) error {
+		if d <= 0 {
+			return errors.New("twin timeout must be positive")
+		}
+		c.twinTimeout = d
+		return nil
+	}
+}
+
+// WithMethodResponseErrorHandler registers fn to be called when a direct
+// method response cannot be delivered, e.g. because the connection dropped,
+// the invocation's outcome is unknown to the service that times out then.
+//
+// fn is called from the transport's goroutine so it must not block.
+func WithMethodResponseErrorHandler(fn func(methodName, rid string, err error)) ClientOption {
+	return func(c *Client) error {
+		if fn == nil {
+			return errors.New("fn is nil")
+		}
+		c.dmMux.respErr = fn
+		return nil
+	}
+}
+
+// WithMethodContext sets fn deriving contexts passed to direct method
+// handlers, e.g. to attach a logger tagged with the request id or to start
+// a span from the invocation's trace context, see MethodRequest.
+func WithMethodContext(fn func(ctx context.Context, r *MethodRequest) context.Context) ClientOption {
+	return func(c *Client) error {
+		if fn == nil {
+			return errors.New("fn is nil")
+		}
+		c.dmMux.wrapCtx = fn
+		return nil
+	}
+}
+
+// DefaultMethodResponseTimeout is the default response timeout
+// of direct methods, it's the service's default one.
+const DefaultMethodResponseTimeout = 30 * time.Second
+
+// WithMethodResponseTimeout sets the response timeout of direct methods,
+// defaults to DefaultMethodResponseTimeout. The hub doesn't tell devices
+// invocations timeouts, so it's meant to match the timeout services invoke
+// methods with, it should be the longest one when they differ.
+//
+// Handlers contexts are cancelled when it elapses and responses
+// of handlers returning after that are discarded, since
+// the caller has already got a timeout error by then.
+func WithMethodResponseTimeout(d time.Duration) ClientOption {
+	return func(c *Client) error {
+		if d <= 0 {
+			return errors.New("method response timeout must be positive")
+		}
+		c.dmMux.timeout = d
+		return nil
+	}
+}
+
+// Subscription lifecycle types, see WithSubscriptionObserver.
+type (
+	SubscriptionKind     = transport.SubscriptionKind
+	SubscriptionObserver = transport.SubscriptionObserver
+)
+
+// Subscription kinds.
+const (
+	SubscriptionEvents = transport.SubscriptionEvents
+	SubscriptionTwin   = transport.SubscriptionTwin
+	SubscriptionMethod = transport.SubscriptionMethod
+)
+
+// WithSubscriptionObserver makes o notified when subscriptions to events and
+// twin updates and direct method registrations are made, fail or are closed,
+// and when the transport restores them after reconnects if it supports that.
+func WithSubscriptionObserver(o SubscriptionObserver) ClientOption {
+	return func(c *Client) error {
+		if o == nil {
+			return errors.New("o is nil")
+		}
+		c.observer = o
+		return nil
+	}
+}
+
+// WithDefaultProperties sets properties added to every sent message,
+// e.g. firmware version or site id, properties set with send options
+// override them on key conflicts. The map is copied.
+func WithDefaultProperties(m map[string]string) ClientOption {
+	return func(c *Client) error {
+		c.props = make(map[string]string, len(m))
+		for k, v := range m {
+			c.props[k] = v
+		}
+		return nil
+	}
+}
+
+// WithSendInterceptor adds fn called for every sent message after send
+// options are applied and before it's handed to the transport, fn can
+// modify the message or reject it by returning an error that's returned
+// by the send then. Interceptors are called in the order they're added.
+func WithSendInterceptor(fn func(msg *common.Message) error) ClientOption {
+	return func(c *Client) error {
+		if fn == nil {
+			return errors.New("fn is nil")
+		}
+		c.interceptors = append(c.interceptors, fn)
+		return nil
+	}
+}
+
+// WithMaxEventSize limits the payload size of cloud-to-device messages,
+// larger messages are dropped and reported as *PayloadSizeError
+// to the oversized payloads handler, see WithOversizedPayloadHandler.
+//
+// Transports still read whole packets, limits prevent decoding
+// and queueing oversized payloads on memory-constrained devices.
+func WithMaxEventSize(n int) ClientOption {
+	return func(c *Client) error {
+		if n <= 0 {
+			return errors.New("max event size must be positive")
+		}
+		c.evMux.max = n
+		return nil
+	}
+}
+
+// WithMaxTwinSize limits the size of twin documents, larger desired state
+// updates are dropped and reported to the oversized payloads handler
+// and larger retrieved twins fail with *PayloadSizeError.
+func WithMaxTwinSize(n int) ClientOption {
+	return func(c *Client) error {
+		if n <= 0 {
+			return errors.New("max twin size must be positive")
+		}
+		c.tsMux.max = n
+		return nil
+	}
+}
+
+// WithMaxMethodSize limits the size of direct method requests below
+// MaxMethodPayloadSize, larger requests are responded with the 413 code
+// without invoking handlers.
+func WithMaxMethodSize(n int) ClientOption {
+	return func(c *Client) error {
+		if n <= 0 || n > MaxMethodPayloadSize {
+			return fmt.Errorf("max method size must be in range (0, %d]", MaxMethodPayloadSize)
+		}
+		c.dmMux.max = n
+		return nil
+	}
+}
+
+// WithOversizedPayloadHandler sets fn called when a cloud-to-device message
+// or a desired state update is dropped because it exceeds its size limit,
+// by default they're logged as warnings.
+//
+// fn is called from the transport's goroutine so it must not block.
+func WithOversizedPayloadHandler(fn func(kind SubscriptionKind, err *PayloadSizeError)) ClientOption {
+	return func(c *Client) error {
+		if fn == nil {
+			return errors.New("fn is nil")
+		}
+		c.oversized = fn
+		return nil
+	}
+}
+
+// WithTwinOnConnect makes Connect retrieve the twin right after connecting
+// to cache the reported properties version, see TwinVersion.
+//
+// A failed retrieval doesn't fail Connect, it's only logged
+// and the version stays unknown until the twin is retrieved or updated.
+func WithTwinOnConnect() ClientOption {
+	return func(c *Client) error {
+		c.twinOnConnect = true
+		return nil
+	}
+}
+
 // NewLogger returns new iothub client.
 func New(opts ...ClientOption) (*Client, error) {
+	ctx, cancel := context.WithCancel(context.Background())
 	c := &Client{
 		ready:  make(chan struct{}),
 		done:   make(chan struct{}),
+		cancel: cancel,
 		logger: common.NewLoggerFromEnv("iotdevice", "IOTHUB_DEVICE_LOG_LEVEL"),
+		clock:  clock.Real,
+
+		backoff:     newBackoff(),
+		renewMargin: DefaultTokenRenewalMargin,
 
 		evMux: newEventsMux(),
 		tsMux: newTwinStateMux(),
-		dmMux: newMethodMux(),
+		dmMux: newMethodMux(ctx),
 	}
 
 	var err error
@@ -112,22 +374,85 @@ func New(opts ...ClientOption) (*Client, error) {
 			return nil, err
 		}
 	}
+	if c.tls != nil {
+		c.creds = &tlsCreds{Credentials: c.creds, tls: c.tls}
+	}
+
+	if c.oversized == nil {
+		c.oversized = func(kind SubscriptionKind, err *PayloadSizeError) {
+			c.logger.Warnf("%s dropped: %s", kind, err)
+		}
+	}
+	c.evMux.reject = func(err *PayloadSizeError) {
+		c.oversized(SubscriptionEvents, err)
+	}
+	c.tsMux.reject = func(err *PayloadSizeError) {
+		c.oversized(SubscriptionTwin, err)
+	}
+	if c.metrics != nil {
+		c.tsMux.updated = c.metrics.TwinUpdated
+		c.dmMux.now = c.clock.Now
+		c.dmMux.observe = func(method string, start time.Time, rc int) {
+			c.metrics.MethodInvoked(method, c.clock.Now().Sub(start), rc)
+		}
+	}
 
 	// transport uses the same logger as the client
 	c.tr.SetLogger(c.logger)
+	if o, ok := c.tr.(transport.ObservableTransport); ok && c.observer != nil {
+		o.SetSubscriptionObserver(c.observer)
+	}
+	if n, ok := c.tr.(transport.ConnectionLossNotifier); ok {
+		n.SetConnectionLostHandler(c.connectionLost)
+	}
 	return c, nil
 }
 
 // Client is iothub device client.
 type Client struct {
+	// counters are updated atomically without locking,
+	// they go first to be 64-bit aligned on 32-bit platforms
+	sent      uint64
+	sendErr   uint64
+	twinVer   int64 // last known reported properties version
+	connected int32 // 1 once connected for the first time
+
 	creds transport.Credentials
 	tr    transport.Transport
+	tls   *tls.Config // overrides credentials TLS config when set
+
+	logger   common.Logger
+	clock    clock.Clock
+	observer SubscriptionObserver // nil unless set
+	metrics  MetricsObserver      // nil unless set
+	state    *stateNotifier       // nil unless set
+
+	sends         sendTracker
+	limiter       *rateLimiter // nil unless adaptive send rate is enabled
+	maxSend       int          // device-to-cloud message size limit, see sendLimit
+	twinTimeout   time.Duration
+	twinOnConnect bool
+	props         map[string]string // default message properties
+	interceptors  []func(msg *common.Message) error
+	oversized     func(kind SubscriptionKind, err *PayloadSizeError)
+	backoff       *backoff
+	renewMargin   time.Duration
+	tmu           sync.Mutex // serializes CheckAndUpdateTwinState calls
 
-	logger common.Logger
+	// file upload http clients, made for every upload when nil
+	uploadHTTP *http.Client
+	blobHTTP   *http.Client
 
-	mu    sync.RWMutex
-	ready chan struct{}
-	done  chan struct{}
+	mu     sync.RWMutex
+	done   chan struct{}
+	err    error              // terminal error, see Err
+	cancel context.CancelFunc // cancels the base context of method handlers
+
+	// connection state is guarded separately from mu
+	// that's held by Connect for the whole connection attempt
+	rmu     sync.Mutex
+	ready   chan struct{} // closed while the connection is up
+	lastErr error         // last connection failure, see LastError
 
 	evMux *eventsMux
 	tsMux *twinStateMux
@@ -135,40 +460,89 @@ type Client struct {
 }
 
 // DirectMethodHandler handles direct method invocations.
-type DirectMethodHandler func(p map[string]interface{}) (map[string]interface{}, error)
+//
+// The ctx is cancelled when the client is closed, so handlers
+// doing blocking operations can abort them on shutdown.
+// Invocation metadata is available via MethodRequestFromContext.
+type DirectMethodHandler func(ctx context.Context, p map[string]interface{}) (map[string]interface{}, error)
+
+// TypedMethodHandler is DirectMethodHandler that gets the raw JSON payload
+// to decode into its own type and controls the response status code,
+// result is marshaled with encoding/json as the response payload.
+//
+// When err is not nil the response payload is the error message and
+// status defaults to 500, otherwise it defaults to 200.
+type TypedMethodHandler func(ctx context.Context, payload json.RawMessage) (status int, result interface{}, err error)
 
 // DeviceID returns iothub device id.
 func (c *Client) DeviceID() string {
 	return c.creds.DeviceID()
 }
 
+// ModuleID returns iothub module id, it's empty for device identities.
+func (c *Client) ModuleID() string {
+	return transport.ModuleID(c.creds)
+}
+
 // Connect connects to the iothub all subsequent calls
 // will block until this function finishes with no error so it's clien's
 // responsibility to connect in the background by running it in a goroutine
 // and control other method invocations or call in in a synchronous way.
 func (c *Client) Connect(ctx context.Context) error {
 	c.mu.Lock()
-	select {
-	case <-c.ready:
+	if atomic.LoadInt32(&c.connected) == 1 {
 		c.mu.Unlock()
 		return errors.New("already connected")
-	default:
 	}
 	err := c.tr.Connect(ctx, c.creds)
 	if err == nil {
-		close(c.ready)
+		atomic.StoreInt32(&c.connected, 1)
+		c.setReady(true)
+		c.state.notify(true, nil, false)
+		if r, ok := c.tr.(transport.TokenRenewer); ok && c.creds.IsSAS() {
+			go c.renewTokens(r)
+		}
 	}
 	c.mu.Unlock()
-	// TODO: c.err = err
+	if err != nil {
+		c.setLastError(err)
+	}
+	if err == nil && c.twinOnConnect {
+		if _, _, err := c.retrieveTwinState(ctx); err != nil {
+			c.logger.Warnf("twin retrieval on connect error: %s", err)
+		}
+	}
 	return err
 }
 
 // ErrClosed the client is already closed.
 var ErrClosed = errors.New("closed")
 
+// Connection refusal errors returned by Connect wrapped into *ConnectError,
+// a disabled device needs re-provisioning, unauthorized usually means the
+// credentials are out of date and only server unavailable is worth retrying.
+var (
+	ErrDeviceDisabled     = transport.ErrDeviceDisabled
+	ErrUnauthorized       = transport.ErrUnauthorized
+	ErrServerUnavailable  = transport.ErrServerUnavailable
+	ErrBadProtocolVersion = transport.ErrBadProtocolVersion
+)
+
+// ConnectError is a connection refusal with the raw protocol code.
+type ConnectError = transport.ConnectError
+
+// ErrTwinTimeout is returned by twin operations that
+// get no response within the twin timeout, see WithTwinTimeout.
+var ErrTwinTimeout = transport.ErrTwinTimeout
+
+// checkConnection blocks until the client is connected,
+// including while it's reconnecting after a connection loss.
 func (c *Client) checkConnection(ctx context.Context) error {
+	c.rmu.Lock()
+	ready := c.ready
+	c.rmu.Unlock()
 	select {
-	case <-c.ready:
+	case <-ready:
 		return nil
 	case <-c.done:
 		return ErrClosed
@@ -177,46 +551,331 @@ func (c *Client) checkConnection(ctx context.Context) error {
 	}
 }
 
+// Connected reports whether the client has connected and isn't closed yet,
+// it never blocks.
+func (c *Client) Connected() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	return atomic.LoadInt32(&c.connected) == 1
+}
+
+// WaitReady blocks until the client is connected,
+// returns ErrClosed when it's closed first or ctx error.
+func (c *Client) WaitReady(ctx context.Context) error {
+	if ctx == nil {
+		return errNilContext
+	}
+	return c.checkConnection(ctx)
+}
+
+// setReady unblocks operations waiting for the connection
+// when ready is true and makes them wait otherwise.
+func (c *Client) setReady(ready bool) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	select {
+	case <-c.ready:
+		if !ready {
+			c.ready = make(chan struct{})
+		}
+	default:
+		if ready {
+			close(c.ready)
+		}
+	}
+}
+
+// State reports the connection state the way WithConnectionStateHandler does:
+// connected is true while a transport session is up, otherwise err is
+// the most recent connection failure, a failed connection attempt or
+// a connection loss the client is reconnecting after, or the error
+// the client is terminated with, see Err. It's nil before connecting
+// and after Close.
+//
+// It never blocks and doesn't generate any network traffic.
+func (c *Client) State() (connected bool, err error) {
+	select {
+	case <-c.done:
+		return false, c.Err()
+	default:
+	}
+	c.rmu.Lock()
+	ready, lastErr := c.ready, c.lastErr
+	c.rmu.Unlock()
+	select {
+	case <-ready:
+		if c.transportConnected() {
+			return true, nil
+		}
+	default:
+	}
+	return false, lastErr
+}
+
+// ErrNotConnected is returned by Ready and Healthy
+// when the client is not connected.
+var ErrNotConnected = errors.New("not connected")
+
+// Ready returns nil once the client has connected for the first time
+// and until it's closed, it's meant for readiness probes.
+//
+// It never blocks and doesn't generate any network traffic.
+func (c *Client) Ready() error {
+	select {
+	case <-c.done:
+		return ErrClosed
+	default:
+	}
+	if !c.Connected() {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// Healthy returns nil while the connection is currently up, unlike Ready
+// it fails while the transport is reconnecting, it's meant for liveness probes.
+//
+// It never blocks and doesn't generate any network traffic.
+func (c *Client) Healthy() error {
+	if err := c.Ready(); err != nil {
+		return err
+	}
+	if ok, _ := c.State(); !ok {
+		return ErrNotConnected
+	}
+	return nil
+}
+
+// IsConnected reports whether a transport session is currently up,
+// it's false before connecting, while reconnecting and after closing.
+func (c *Client) IsConnected() bool {
+	ok, _ := c.State()
+	return ok
+}
+
+// LastError returns the most recent connection failure: a failed
+// connection attempt, a connection loss or the error the client is
+// terminated with, it's nil when the connection has never failed.
+// Unlike State it's kept after reconnecting.
+func (c *Client) LastError() error {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	return c.lastErr
+}
+
+// transportConnected reports whether the transport connection is up,
+// transports not implementing transport.ConnectionChecker are
+// considered connected while the client is ready.
+func (c *Client) transportConnected() bool {
+	if cc, ok := c.tr.(transport.ConnectionChecker); ok {
+		return cc.IsConnected()
+	}
+	return true
+}
+
+func (c *Client) setLastError(err error) {
+	c.rmu.Lock()
+	c.lastErr = err
+	c.rmu.Unlock()
+}
+
+var errNilContext = errors.New("ctx is nil")
+
 // SubscribeEvents subscribes to cloud-to-device events and returns a subscription struct.
-func (c *Client) SubscribeEvents(ctx context.Context) (*EventSub, error) {
+//
+// Messages sent by the service with the iothub-ack property expect the device
+// to complete or reject them. The MQTT transport has no means to do that
+// explicitly: messages are completed once they're acknowledged on QoS 1
+// or immediately after sending on QoS 0, so positive feedback is generated
+// on delivery and negative feedback only when a message expires or
+// exceeds the maximum delivery count before reaching the device.
+// CompleteEvent is a no-op then, AbandonEvent and RejectEvent are no-ops
+// for messages without feedback and fail with ErrFeedbackUnsupported otherwise.
+//
+// Transports implementing transport.MessageSettler deliver messages
+// unsettled instead, they have to be settled with CompleteEvent,
+// AbandonEvent or RejectEvent, abandoned ones are redelivered.
+func (c *Client) SubscribeEvents(ctx context.Context, opts ...SubscribeOption) (*EventSub, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
 	if err := c.checkConnection(ctx); err != nil {
 		return nil, err
 	}
+	// subscribe first to receive messages delivered
+	// right after the transport subscription is made
+	sub := c.evMux.sub(opts...)
 	if err := c.evMux.once(func() error {
 		return c.tr.SubscribeEvents(ctx, c.evMux)
 	}); err != nil {
+		c.evMux.unsub(sub, err)
+		c.observeSubscribe(SubscriptionEvents, "", err)
 		return nil, err
 	}
-	return c.evMux.sub(), nil
+	c.observeSubscribe(SubscriptionEvents, "", nil)
+	return sub, nil
+}
+
+// observeSubscribe reports a subscription result to the observer.
+func (c *Client) observeSubscribe(kind SubscriptionKind, name string, err error) {
+	if c.observer == nil {
+		return
+	}
+	if err != nil {
+		c.observer.OnSubscribeError(kind, name, err)
+	} else {
+		c.observer.OnSubscribe(kind, name)
+	}
+}
+
+// observeUnsubscribe reports a closed subscription to the observer.
+func (c *Client) observeUnsubscribe(kind SubscriptionKind, name string) {
+	if c.observer != nil {
+		c.observer.OnUnsubscribe(kind, name)
+	}
 }
 
 // UnsubscribeEvents makes the given subscription to stop receiving messages.
+// It's a no-op when sub is nil or already unsubscribed.
 func (c *Client) UnsubscribeEvents(sub *EventSub) {
-	c.evMux.unsub(sub)
+	if sub == nil {
+		return
+	}
+	if c.evMux.unsub(sub, nil) {
+		c.observeUnsubscribe(SubscriptionEvents, "")
+	}
+}
+
+// SubscribeEventsContext is the same as SubscribeEvents but the subscription
+// is tied to ctx, when it's done the subscription is unsubscribed and closed
+// with the context's error.
+//
+// UnsubscribeEvents can still be used for closing it earlier.
+func (c *Client) SubscribeEventsContext(ctx context.Context, opts ...SubscribeOption) (*EventSub, error) {
+	sub, err := c.SubscribeEvents(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	go c.unsubOnDone(ctx, sub)
+	return sub, nil
+}
+
+func (c *Client) unsubOnDone(ctx context.Context, sub *EventSub) {
+	select {
+	case <-ctx.Done():
+		if c.evMux.unsub(sub, ctx.Err()) {
+			c.observeUnsubscribe(SubscriptionEvents, "")
+		}
+	case <-sub.done:
+	}
 }
 
 // RegisterMethod registers the given direct method handler,
 // returns an error when method is already registered.
 // If f returns an error and empty body its error string
 // used as value of the error attribute in the result json.
+//
+// Name and fn are validated before waiting for the connection,
+// so invalid arguments are reported immediately.
+//
+// Registered handlers survive reconnects, the transport
+// only restores its subscription and never re-adds them.
 func (c *Client) RegisterMethod(ctx context.Context, name string, fn DirectMethodHandler) error {
+	if ctx == nil {
+		return errNilContext
+	}
+	if name == "" {
+		return errors.New("name cannot be blank")
+	}
+	if fn == nil {
+		return errors.New("handler is nil")
+	}
 	if err := c.checkConnection(ctx); err != nil {
 		return err
 	}
+	err := c.dmMux.once(func() error {
+		return c.tr.RegisterDirectMethods(ctx, c.dmMux)
+	})
+	if err == nil {
+		err = c.dmMux.handle(name, fn)
+	}
+	c.observeSubscribe(SubscriptionMethod, name, err)
+	return err
+}
+
+// RegisterMethodTyped is RegisterMethod of a TypedMethodHandler.
+func (c *Client) RegisterMethodTyped(ctx context.Context, name string, fn TypedMethodHandler) error {
+	if ctx == nil {
+		return errNilContext
+	}
 	if name == "" {
 		return errors.New("name cannot be blank")
 	}
-	if err := c.dmMux.once(func() error {
+	if fn == nil {
+		return errors.New("handler is nil")
+	}
+	if err := c.checkConnection(ctx); err != nil {
+		return err
+	}
+	err := c.dmMux.once(func() error {
 		return c.tr.RegisterDirectMethods(ctx, c.dmMux)
-	}); err != nil {
+	})
+	if err == nil {
+		err = c.dmMux.handleTyped(name, fn)
+	}
+	c.observeSubscribe(SubscriptionMethod, name, err)
+	return err
+}
+
+// RegisterMethodPrefix registers fn for all methods which names start
+// with prefix, e.g. `sensor/` matches `sensor/temp/read`, and have no
+// handler registered with RegisterMethod, when several prefixes match
+// the longest one wins.
+//
+// fn gets the full method name from MethodRequestFromContext.
+func (c *Client) RegisterMethodPrefix(ctx context.Context, prefix string, fn DirectMethodHandler) error {
+	if ctx == nil {
+		return errNilContext
+	}
+	if prefix == "" {
+		return errors.New("prefix cannot be blank")
+	}
+	if fn == nil {
+		return errors.New("handler is nil")
+	}
+	if err := c.checkConnection(ctx); err != nil {
 		return err
 	}
-	return c.dmMux.handle(name, fn)
+	err := c.dmMux.once(func() error {
+		return c.tr.RegisterDirectMethods(ctx, c.dmMux)
+	})
+	if err == nil {
+		err = c.dmMux.handlePrefix(prefix, fn)
+	}
+	c.observeSubscribe(SubscriptionMethod, prefix, err)
+	return err
+}
+
+// UnregisterMethodPrefix unregisters the given method prefix.
+func (c *Client) UnregisterMethodPrefix(prefix string) {
+	if c.dmMux.removePrefix(prefix) {
+		c.observeUnsubscribe(SubscriptionMethod, prefix)
+	}
 }
 
 // UnregisterMethod unregisters the named method.
 func (c *Client) UnregisterMethod(name string) {
-	c.dmMux.remove(name)
+	if c.dmMux.remove(name) {
+		c.observeUnsubscribe(SubscriptionMethod, name)
+	}
+}
+
+// RegisteredMethods returns names of currently registered direct methods in sorted order.
+func (c *Client) RegisteredMethods() []string {
+	return c.dmMux.names()
 }
 
 // TwinState is both desired and reported twin device's state.
@@ -228,15 +887,111 @@ func (s TwinState) Version() int {
 	return int(v)
 }
 
+// Decode decodes the state into v the way encoding/json does it,
+// the hub's top-level $-prefixed fields such as $version and
+// $metadata are left out, use Version and Metadata for them.
+func (s TwinState) Decode(v interface{}) error {
+	m := make(map[string]interface{}, len(s))
+	for k, x := range s {
+		if !strings.HasPrefix(k, "$") {
+			m[k] = x
+		}
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// Removed returns dot-separated paths of properties the state removes,
+// i.e. that are null in update patches, including nested ones, sorted.
+// Properties absent from a patch are left unchanged by it.
+func (s TwinState) Removed() []string {
+	var paths []string
+	var walk func(prefix string, m map[string]interface{})
+	walk = func(prefix string, m map[string]interface{}) {
+		for k, v := range m {
+			if strings.HasPrefix(k, "$") {
+				continue
+			}
+			switch v := v.(type) {
+			case nil:
+				paths = append(paths, prefix+k)
+			case map[string]interface{}:
+				walk(prefix+k+".", v)
+			}
+		}
+	}
+	walk("", s)
+	sort.Strings(paths)
+	return paths
+}
+
+// PropertyMetadata is the hub's bookkeeping of a twin property.
+type PropertyMetadata struct {
+	LastUpdated        time.Time // zero when it's unknown
+	LastUpdatedVersion int       // set only for desired properties
+}
+
+// Metadata returns metadata of the named top-level property from the
+// state's $metadata section, ok is false when the section or the
+// property is missing, the hub includes it only in some documents.
+func (s TwinState) Metadata(key string) (md PropertyMetadata, ok bool) {
+	m, _ := s["$metadata"].(map[string]interface{})
+	v, ok := m[key].(map[string]interface{})
+	if !ok {
+		return md, false
+	}
+	if ts, _ := v["$lastUpdated"].(string); ts != "" {
+		md.LastUpdated, _ = time.Parse(time.RFC3339Nano, ts)
+	}
+	n, _ := v["$lastUpdatedVersion"].(float64)
+	md.LastUpdatedVersion = int(n)
+	return md, true
+}
+
 // RetrieveTwinState returns desired and reported twin device states.
 func (c *Client) RetrieveTwinState(ctx context.Context) (desired TwinState, reported TwinState, err error) {
 	if err := c.checkConnection(ctx); err != nil {
 		return nil, nil, err
 	}
-	b, err := c.tr.RetrieveTwinProperties(ctx)
+	return c.retrieveTwinState(ctx)
+}
+
+// RetrieveTwinStateInto is RetrieveTwinState that decodes desired and
+// reported states into the given values, see TwinState.Decode,
+// either can be nil to skip decoding the corresponding state.
+func (c *Client) RetrieveTwinStateInto(ctx context.Context, desired, reported interface{}) error {
+	d, r, err := c.RetrieveTwinState(ctx)
 	if err != nil {
+		return err
+	}
+	if desired != nil {
+		if err = d.Decode(desired); err != nil {
+			return fmt.Errorf("desired state: %w", err)
+		}
+	}
+	if reported != nil {
+		if err = r.Decode(reported); err != nil {
+			return fmt.Errorf("reported state: %w", err)
+		}
+	}
+	return nil
+}
+
+func (c *Client) retrieveTwinState(ctx context.Context) (TwinState, TwinState, error) {
+	var b []byte
+	if err := c.twinCall(ctx, func(ctx context.Context) error {
+		var err error
+		b, err = c.tr.RetrieveTwinProperties(ctx)
+		return err
+	}); err != nil {
 		return nil, nil, err
 	}
+	if c.tsMux.max != 0 && len(b) > c.tsMux.max {
+		return nil, nil, &PayloadSizeError{Size: len(b), Limit: c.tsMux.max}
+	}
 	var v struct {
 		Desired  TwinState `json:"desired"`
 		Reported TwinState `json:"reported"`
@@ -244,9 +999,17 @@ func (c *Client) RetrieveTwinState(ctx context.Context) (desired TwinState, repo
 	if err := json.Unmarshal(b, &v); err != nil {
 		return nil, nil, err
 	}
+	atomic.StoreInt64(&c.twinVer, int64(v.Reported.Version()))
+	c.backoff.reset()
 	return v.Desired, v.Reported, nil
 }
 
+// TwinVersion returns the reported properties version known from the last
+// twin retrieval or update, it's zero until the twin is retrieved or updated.
+func (c *Client) TwinVersion() int {
+	return int(atomic.LoadInt64(&c.twinVer))
+}
+
 // UpdateTwinState updates twin device's state and returns new version.
 // To remove any attribute set its value to nil.
 func (c *Client) UpdateTwinState(ctx context.Context, s TwinState) (int, error) {
@@ -257,25 +1020,146 @@ func (c *Client) UpdateTwinState(ctx context.Context, s TwinState) (int, error)
 	if err != nil {
 		return 0, err
 	}
-	return c.tr.UpdateTwinProperties(ctx, b)
+	return c.updateTwinState(ctx, b)
+}
+
+// UpdateTwinStateFrom is UpdateTwinState that takes a struct or any other
+// value marshaled to a JSON object honoring json tags as the patch.
+//
+// Patches only change properties present in them: fields tagged with
+// omitempty are left untouched when empty, to remove a property use
+// a pointer field without omitempty, a nil pointer is marshaled to null.
+func (c *Client) UpdateTwinStateFrom(ctx context.Context, v interface{}) (int, error) {
+	if err := c.checkConnection(ctx); err != nil {
+		return 0, err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) == 0 || b[0] != '{' {
+		return 0, fmt.Errorf("%T is not marshaled to a json object", v)
+	}
+	return c.updateTwinState(ctx, b)
+}
+
+// ErrPreconditionFailed is returned by CheckAndUpdateTwinState
+// when the reported properties version has moved on.
+var ErrPreconditionFailed = errors.New("twin version precondition failed")
+
+// CheckAndUpdateTwinState is a best-effort conditional UpdateTwinState:
+// it retrieves the twin and applies the patch only when the reported
+// properties version is still the given one, e.g. the version of the
+// reported state returned by RetrieveTwinState, and returns
+// ErrPreconditionFailed otherwise, so callers can re-read and retry.
+//
+// It's not atomic, devices cannot make conditional twin updates and
+// IoT Hub accepts reported patches unconditionally. Calls made through
+// the client are serialized, but an update made by another client of the
+// same device between the check and the patch is silently overwritten,
+// the returned version is greater than version + 1 then.
+func (c *Client) CheckAndUpdateTwinState(ctx context.Context, version int, s TwinState) (int, error) {
+	if err := c.checkConnection(ctx); err != nil {
+		return 0, err
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return 0, err
+	}
+	c.tmu.Lock()
+	defer c.tmu.Unlock()
+	_, reported, err := c.retrieveTwinState(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if v := reported.Version(); v != version {
+		return 0, fmt.Errorf("%w: version is %d, want %d", ErrPreconditionFailed, v, version)
+	}
+	return c.updateTwinState(ctx, b)
+}
+
+func (c *Client) updateTwinState(ctx context.Context, b []byte) (int, error) {
+	var ver int
+	if err := c.twinCall(ctx, func(ctx context.Context) error {
+		var err error
+		ver, err = c.tr.UpdateTwinProperties(ctx, b)
+		return err
+	}); err != nil {
+		return 0, err
+	}
+	atomic.StoreInt64(&c.twinVer, int64(ver))
+	c.backoff.reset()
+	return ver, nil
+}
+
+// twinCall calls fn with the twin timeout applied to ctx,
+// reporting its expiration as ErrTwinTimeout.
+func (c *Client) twinCall(ctx context.Context, fn func(ctx context.Context) error) error {
+	if c.twinTimeout == 0 {
+		return fn(ctx)
+	}
+	tctx, cancel := context.WithTimeout(ctx, c.twinTimeout)
+	defer cancel()
+	err := fn(tctx)
+	if err != nil && ctx.Err() == nil && tctx.Err() == context.DeadlineExceeded {
+		return ErrTwinTimeout
+	}
+	return err
 }
 
 // SubscribeTwinUpdates registers fn as a desired state changes handler.
+//
+// Updates are patches: properties removed by the operator are null
+// in them, see TwinState.Removed, and absent ones are unchanged.
+//
+// IoT Hub doesn't redeliver desired state updates published while the device
+// is disconnected, they are lost unless ResyncTwin is called after reconnecting.
+//
+// Updates are buffered and delivered without blocking the connection,
+// when a subscriber falls behind by more than the buffer size the oldest
+// ones are dropped and counted in Stats, ResyncTwin catches it up then.
 func (c *Client) SubscribeTwinUpdates(ctx context.Context) (*TwinStateSub, error) {
+	if ctx == nil {
+		return nil, errNilContext
+	}
 	if err := c.checkConnection(ctx); err != nil {
 		return nil, err
 	}
 	if err := c.tsMux.once(func() error {
 		return c.tr.SubscribeTwinUpdates(ctx, c.tsMux)
 	}); err != nil {
+		c.observeSubscribe(SubscriptionTwin, "", err)
 		return nil, err
 	}
+	c.observeSubscribe(SubscriptionTwin, "", nil)
 	return c.tsMux.sub(), nil
 }
 
+// ResyncTwin retrieves the current twin state and delivers the desired state
+// to twin update subscribers when its version is greater than the version of
+// the last delivered update, so the device converges with the hub state
+// after missing updates during a disconnect.
+//
+// Unlike regular updates that contain only changed properties,
+// subscribers receive the whole desired state document.
+func (c *Client) ResyncTwin(ctx context.Context) (desired TwinState, reported TwinState, err error) {
+	desired, reported, err = c.RetrieveTwinState(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.tsMux.dispatch(desired, true)
+	return desired, reported, nil
+}
+
 // UnsubscribeTwinUpdates unsubscribes the given handler from twin state updates.
+// It's a no-op when sub is nil or already unsubscribed.
 func (c *Client) UnsubscribeTwinUpdates(sub *TwinStateSub) {
-	c.tsMux.unsub(sub)
+	if sub == nil {
+		return
+	}
+	if c.tsMux.unsub(sub) {
+		c.observeUnsubscribe(SubscriptionTwin, "")
+	}
 }
 
 // SendOption is a send event options.
@@ -293,6 +1177,112 @@ func WithSendQoS(qos int) SendOption {
 	}
 }
 
+// WithSendRetain sets the MQTT retain flag so a broker keeps the message
+// as the last value of its topic for new subscribers (MQTT only).
+//
+// IoT Hub ignores the flag on the telemetry endpoint, it's meaningful only
+// for brokers honoring retained messages, e.g. a local gateway, other
+// transports silently ignore it.
+func WithSendRetain(retain bool) SendOption {
+	return func(msg *common.Message) error {
+		if msg.TransportOptions == nil {
+			msg.TransportOptions = map[string]interface{}{}
+		}
+		msg.TransportOptions["retain"] = retain
+		return nil
+	}
+}
+
+// WithSendContentType sets the payload MIME type, e.g. application/json,
+// IoT Hub routing queries on the message body need it and the content encoding.
+func WithSendContentType(ct string) SendOption {
+	return func(msg *common.Message) error {
+		msg.ContentType = ct
+		return nil
+	}
+}
+
+// WithSendContentEncoding sets the payload charset,
+// it's one of utf-8, utf-16 and utf-32.
+func WithSendContentEncoding(ce string) SendOption {
+	return func(msg *common.Message) error {
+		switch strings.ToLower(ce) {
+		case "utf-8", "utf-16", "utf-32":
+		default:
+			return fmt.Errorf("unsupported content encoding %q", ce)
+		}
+		msg.ContentEncoding = ce
+		return nil
+	}
+}
+
+// WithSendExpiryTime sets the message expiry time, the hub drops messages
+// that aren't delivered to their endpoints by then, sends of messages
+// that are already expired fail with ErrMessageExpired.
+func WithSendExpiryTime(t time.Time) SendOption {
+	return func(msg *common.Message) error {
+		t := t
+		msg.ExpiryTime = &t
+		return nil
+	}
+}
+
+// WithSendCreationTime sets the time the message is created at, it's
+// delivered to consumers as iothub-creation-time-utc, messages don't
+// have it unless it's set, the hub only stamps the enqueued time.
+func WithSendCreationTime(t time.Time) SendOption {
+	return func(msg *common.Message) error {
+		t := t
+		msg.CreationTime = &t
+		return nil
+	}
+}
+
+// WithSendTTL is WithSendExpiryTime relative to when the client
+// sends the message, d must be positive.
+func WithSendTTL(d time.Duration) SendOption {
+	return func(msg *common.Message) error {
+		if d <= 0 {
+			return errors.New("ttl must be positive")
+		}
+		if msg.TransportOptions == nil {
+			msg.TransportOptions = map[string]interface{}{}
+		}
+		msg.TransportOptions[ttlOption] = d
+		return nil
+	}
+}
+
+// ttlOption is the TransportOptions key WithSendTTL stores the ttl under
+// until the client turns it into the expiry time using its clock.
+const ttlOption = "ttl"
+
+// applyTTL sets the expiry time of msg sent with WithSendTTL.
+func (c *Client) applyTTL(msg *common.Message) {
+	d, ok := msg.TransportOptions[ttlOption].(time.Duration)
+	if !ok {
+		return
+	}
+	delete(msg.TransportOptions, ttlOption)
+	t := c.clock.Now().Add(d)
+	msg.ExpiryTime = &t
+}
+
+// ErrMessageExpired is returned by sends of messages which expiry time has passed.
+var ErrMessageExpired = errors.New("message is expired")
+
+// checkExpiry fails when msg is already expired.
+func (c *Client) checkExpiry(msg *common.Message) error {
+	if msg.ExpiryTime == nil || msg.ExpiryTime.IsZero() {
+		return nil
+	}
+	if now := c.clock.Now(); !msg.ExpiryTime.After(now) {
+		return fmt.Errorf("%w: expiry time %s is %s in the past",
+			ErrMessageExpired, msg.ExpiryTime.Format(time.RFC3339), now.Sub(*msg.ExpiryTime))
+	}
+	return nil
+}
+
 // WithSendMessageID sets message id.
 func WithSendMessageID(mid string) SendOption {
 	return func(msg *common.Message) error {
@@ -309,6 +1299,44 @@ func WithSendCorrelationID(cid string) SendOption {
 	}
 }
 
+// WithSendUserID sets the origin of the message, it must be a valid UTF-8 string.
+func WithSendUserID(uid string) SendOption {
+	return func(msg *common.Message) error {
+		if !utf8.ValidString(uid) {
+			return errors.New("user id is not a valid utf-8 string")
+		}
+		msg.UserID = uid
+		return nil
+	}
+}
+
+// WithSendTo sets the message destination.
+func WithSendTo(to string) SendOption {
+	return func(msg *common.Message) error {
+		msg.To = to
+		return nil
+	}
+}
+
+// SecurityInterfaceID is the interface id of security messages.
+const SecurityInterfaceID = "urn:azureiot:Security:SecurityAgent:1"
+
+// WithSendSecurityMessage marks the message as a security message
+// to be routed to Azure Defender for IoT instead of the regular telemetry.
+//
+// It sets the iothub-interface-id system property ($.ifid in MQTT) to
+// SecurityInterfaceID and the content type to application/json
+// unless it's already set, security payloads must be JSON.
+func WithSendSecurityMessage() SendOption {
+	return func(msg *common.Message) error {
+		msg.InterfaceID = SecurityInterfaceID
+		if msg.ContentType == "" {
+			msg.ContentType = "application/json"
+		}
+		return nil
+	}
+}
+
 // WithSendProperty sets a message option.
 func WithSendProperty(k, v string) SendOption {
 	return func(msg *common.Message) error {
@@ -335,37 +1363,283 @@ func WithSendProperties(m map[string]string) SendOption {
 
 // SendEvent sends a device-to-cloud message.
 // Panics when event is nil.
+//
+// Messages larger than MaxMessageSize, counting the payload and
+// properties, fail with *PayloadSizeError before they're sent.
 func (c *Client) SendEvent(ctx context.Context, payload []byte, opts ...SendOption) error {
+	_, err := c.sendEvent(ctx, payload, opts)
+	return err
+}
+
+// SendEventSize is SendEvent that also returns the number of bytes
+// the message took on the wire including encoded properties and
+// protocol framing, when the transport cannot tell that,
+// it's the payload length.
+func (c *Client) SendEventSize(ctx context.Context, payload []byte, opts ...SendOption) (int, error) {
+	msg, err := c.sendEvent(ctx, payload, opts)
+	if err != nil {
+		return 0, err
+	}
+	return c.wireSize(msg)
+}
+
+// SentMessage describes a sent device-to-cloud message.
+type SentMessage struct {
+	// MessageID and CorrelationID are the final identifiers
+	// after send options and interceptors are applied,
+	// they're empty unless set by them.
+	MessageID     string
+	CorrelationID string
+
+	// Size is the number of bytes the message took on the wire, see SendEventSize.
+	Size int
+}
+
+// SendEventWithResult is SendEvent that also returns identifiers
+// of the sent message to correlate it with the backend.
+//
+// The hub doesn't assign sequence numbers to messages until they're
+// routed, so they're known only to event hub consumers.
+func (c *Client) SendEventWithResult(
+	ctx context.Context,
+	payload []byte,
+	opts ...SendOption,
+) (SentMessage, error) {
+	msg, err := c.sendEvent(ctx, payload, opts)
+	if err != nil {
+		return SentMessage{}, err
+	}
+	n, err := c.wireSize(msg)
+	if err != nil {
+		return SentMessage{}, err
+	}
+	return SentMessage{
+		MessageID:     msg.MessageID,
+		CorrelationID: msg.CorrelationID,
+		Size:          n,
+	}, nil
+}
+
+// wireSize returns the message size on the wire when
+// the transport can tell that or the payload length.
+func (c *Client) wireSize(msg *common.Message) (int, error) {
+	if s, ok := c.tr.(transport.WireSizer); ok {
+		return s.WireSize(msg)
+	}
+	return len(msg.Payload), nil
+}
+
+func (c *Client) sendEvent(ctx context.Context, payload []byte, opts []SendOption) (*common.Message, error) {
 	if err := c.checkConnection(ctx); err != nil {
-		return err
+		return nil, err
 	}
 	if payload == nil {
-		return errors.New("payload is nil")
+		return nil, errors.New("payload is nil")
 	}
 	msg := &common.Message{Payload: payload}
+	if len(c.props) != 0 {
+		msg.Properties = make(map[string]string, len(c.props))
+		for k, v := range c.props {
+			msg.Properties[k] = v
+		}
+	}
 	for _, opt := range opts {
 		if err := opt(msg); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	if err := c.tr.Send(ctx, msg); err != nil {
-		return err
+	c.applyTTL(msg)
+	if err := c.intercept(msg); err != nil {
+		return nil, err
+	}
+	if err := c.checkExpiry(msg); err != nil {
+		return nil, err
+	}
+	if err := c.checkSize(msg); err != nil {
+		return nil, err
+	}
+
+	if err := c.sends.add(); err != nil {
+		return nil, err
+	}
+	err := c.send(ctx, msg)
+	if c.sends.done() && err != nil {
+		return nil, &SendAbandonedError{MessageID: msg.MessageID}
+	}
+	if err != nil {
+		if ctx.Err() == nil && c.backoff.reconnecting() {
+			return nil, fmt.Errorf("%w: %s", ErrReconnecting, err)
+		}
+		return nil, err
 	}
 	c.logger.Debugf("device-to-cloud: %#v", msg)
+	return msg, nil
+}
+
+// send sends msg obeying the adaptive send rate when it's enabled.
+func (c *Client) send(ctx context.Context, msg *common.Message) error {
+	if c.limiter != nil {
+		if err := c.limiter.wait(ctx); err != nil {
+			return err
+		}
+	}
+	start := c.sendStarted(1)
+	err := c.tr.Send(ctx, msg)
+	c.sendDone(ctx, start, err)
+	return err
+}
+
+// sendStarted reports n sends starting and returns their start time.
+func (c *Client) sendStarted(n int) time.Time {
+	if c.metrics != nil {
+		for i := 0; i < n; i++ {
+			c.metrics.SendStarted()
+		}
+	}
+	return c.clock.Now()
+}
+
+// sendDone accounts a send result.
+func (c *Client) sendDone(ctx context.Context, start time.Time, err error) {
+	if c.metrics != nil {
+		c.metrics.SendCompleted(err, c.clock.Now().Sub(start))
+	}
+	if err != nil {
+		atomic.AddUint64(&c.sendErr, 1)
+		if c.limiter != nil && ctx.Err() == nil {
+			c.limiter.throttled()
+		}
+		return
+	}
+	atomic.AddUint64(&c.sent, 1)
+	c.backoff.reset()
+	if c.limiter != nil {
+		c.limiter.succeeded()
+	}
+}
+
+// intercept runs send interceptors on msg.
+func (c *Client) intercept(msg *common.Message) error {
+	for _, fn := range c.interceptors {
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Close closes transport connection.
+// PendingSends returns the number of sends awaiting acknowledgement.
+func (c *Client) PendingSends() int {
+	return c.sends.len()
+}
+
+// Stats is a snapshot of the client's runtime state.
+type Stats struct {
+	// SendRate is the currently allowed number of messages per second,
+	// it's zero when the adaptive send rate is disabled.
+	SendRate float64
+
+	MessagesSent     uint64 // successfully sent device-to-cloud messages
+	SendErrors       uint64 // failed device-to-cloud sends
+	MessagesReceived uint64 // dispatched cloud-to-device messages
+	MessagesDropped  uint64 // messages dropped by subscriptions, see WithSubscribeDropOldest, and transports
+	MethodsInvoked   uint64 // dispatched direct method calls
+
+	TwinUpdatesDropped uint64 // twin updates dropped by subscriptions, see SubscribeTwinUpdates
+
+	Reconnecting      bool          // the client is reconnecting
+	ReconnectAttempts int           // reconnect attempts since the connection was last healthy
+	ReconnectBackoff  time.Duration // the current delay between attempts
+}
+
+// Stats returns the client's runtime statistics.
+//
+// Counters are maintained atomically, so neither collecting
+// them nor calling Stats contends with sending or receiving.
+func (c *Client) Stats() Stats {
+	s := Stats{
+		MessagesSent:     atomic.LoadUint64(&c.sent),
+		SendErrors:       atomic.LoadUint64(&c.sendErr),
+		MessagesReceived: atomic.LoadUint64(&c.evMux.received),
+		MessagesDropped:  atomic.LoadUint64(&c.evMux.dropped),
+		MethodsInvoked:   atomic.LoadUint64(&c.dmMux.invoked),
+
+		TwinUpdatesDropped: atomic.LoadUint64(&c.tsMux.dropped),
+	}
+	if r, ok := c.tr.(transport.DropReporter); ok {
+		s.MessagesDropped += r.DroppedMessages()
+	}
+	if c.limiter != nil {
+		s.SendRate = c.limiter.current()
+	}
+	s.Reconnecting, s.ReconnectAttempts, s.ReconnectBackoff = c.backoff.state()
+	return s
+}
+
+// Err returns the error the client is closed with when it gives up
+// reconnecting, it's nil while it's open or when it's closed by Close.
+func (c *Client) Err() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.err
+}
+
+// DefaultCloseTimeout is the time Close waits for
+// pending sends and method invocations to complete.
+const DefaultCloseTimeout = 5 * time.Second
+
+// CloseContext closes the client gracefully: it stops accepting new sends
+// and method invocations, waits for pending sends to be acknowledged and
+// running method handlers to return so their responses are published,
+// then closes the transport. When ctx is done before that the transport
+// is closed anyway, sends failed by it return *SendAbandonedError and
+// contexts of running handlers are cancelled.
+//
+// It's safe to call it and Close multiple times, subsequent calls are no-op.
+func (c *Client) CloseContext(ctx context.Context) error {
+	if ctx == nil {
+		return errNilContext
+	}
+	if err := c.sends.drain(ctx); err != nil {
+		c.sends.abandon()
+	}
+	if err := c.dmMux.runs.drain(ctx); err != nil {
+		c.dmMux.runs.abandon()
+	}
+	return c.close(nil)
+}
+
+// Close is CloseContext that waits for at most DefaultCloseTimeout.
+//
+// It closes transport connection gracefully, transports supporting it
+// notify the hub so it registers the device as disconnected immediately
+// instead of after the keep-alive timeout, e.g. MQTT sends DISCONNECT.
 func (c *Client) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCloseTimeout)
+	defer cancel()
+	return c.CloseContext(ctx)
+}
+
+// close closes the client, err is the reason it's
+// terminated with or nil when it's closed by the user.
+func (c *Client) close(err error) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	select {
 	case <-c.done:
 		return nil
 	default:
+		c.err = err
+		if err != nil {
+			c.setLastError(err)
+		}
 		close(c.done)
+		if atomic.LoadInt32(&c.connected) == 1 {
+			c.state.notify(false, err, true)
+		}
 		c.evMux.close(ErrClosed)
 		c.tsMux.close(ErrClosed)
+		c.cancel()
 		return c.tr.Close()
 	}
 }
@@ -0,0 +1,862 @@
+package iotdevice
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/internal/clock"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+const testConnectionString = "HostName=test.azure-devices.net;DeviceId=dev;SharedAccessKey=YWJj"
+
+// fakeTransport is an in-memory transport, sendErr is returned by Send,
+// twin is the retrieved twin document, a fixed one when it's empty,
+// sends and twin requests block until their contexts are done
+// when sendHang and twinHang are set respectively, hanging sends
+// also fail when the transport is closed.
+type fakeTransport struct {
+	twin     string
+	sendErr  error
+	sendHang bool
+	twinHang bool
+	offline  bool
+	dropped  uint64 // reported as dropped inbound messages
+
+	mu     sync.Mutex
+	closed chan struct{}
+}
+
+// closing returns the channel closed by Close.
+func (tr *fakeTransport) closing() chan struct{} {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.closed == nil {
+		tr.closed = make(chan struct{})
+	}
+	return tr.closed
+}
+
+func (tr *fakeTransport) SetLogger(logger common.Logger) {}
+
+func (tr *fakeTransport) Connect(ctx context.Context, creds transport.Credentials) error {
+	return nil
+}
+
+func (tr *fakeTransport) Send(ctx context.Context, msg *common.Message) error {
+	if tr.sendHang {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tr.closing():
+			return errors.New("transport is closed")
+		}
+	}
+	return tr.sendErr
+}
+
+func (tr *fakeTransport) RegisterDirectMethods(ctx context.Context, mux transport.MethodDispatcher) error {
+	return nil
+}
+
+func (tr *fakeTransport) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
+	return nil
+}
+
+func (tr *fakeTransport) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
+	return nil
+}
+
+func (tr *fakeTransport) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
+	if tr.twinHang {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if tr.twin != "" {
+		return []byte(tr.twin), nil
+	}
+	return []byte(`{"desired":{"$version":2},"reported":{"$version":3}}`), nil
+}
+
+func (tr *fakeTransport) UpdateTwinProperties(ctx context.Context, payload []byte) (int, error) {
+	return 4, nil
+}
+
+func (tr *fakeTransport) IsConnected() bool {
+	return !tr.offline
+}
+
+func (tr *fakeTransport) DroppedMessages() uint64 {
+	return tr.dropped
+}
+
+func (tr *fakeTransport) Close() error {
+	closed := tr.closing()
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	select {
+	case <-closed:
+	default:
+		close(closed)
+	}
+	return nil
+}
+
+// newTestClient returns a client connected with the given transport.
+func newTestClient(tb testing.TB, tr transport.Transport, opts ...ClientOption) *Client {
+	c, err := New(append([]ClientOption{
+		WithTransport(tr),
+		WithConnectionString(testConnectionString),
+	}, opts...)...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err = c.Connect(context.Background()); err != nil {
+		tb.Fatal(err)
+	}
+	return c
+}
+
+func TestWithSendUserID(t *testing.T) {
+	msg := &common.Message{}
+	if err := WithSendUserID("user")(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.UserID != "user" {
+		t.Fatalf("UserID = %q, want %q", msg.UserID, "user")
+	}
+	if err := WithSendUserID("\xff")(msg); err == nil {
+		t.Fatal("expected an error on invalid utf-8")
+	}
+}
+
+func TestSendEventWithResult(t *testing.T) {
+	c := newTestClient(t, &fakeTransport{}, WithSendInterceptor(func(msg *common.Message) error {
+		msg.CorrelationID = "trace-1"
+		return nil
+	}))
+	defer c.Close()
+
+	res, err := c.SendEventWithResult(context.Background(), []byte("hello"),
+		WithSendMessageID("mid-1"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SentMessage{MessageID: "mid-1", CorrelationID: "trace-1", Size: 5}
+	if res != want {
+		t.Fatalf("SendEventWithResult = %+v, want %+v", res, want)
+	}
+}
+
+func TestWithSendContentEncoding(t *testing.T) {
+	msg := &common.Message{}
+	for _, opt := range []SendOption{
+		WithSendContentType("application/json"),
+		WithSendContentEncoding("utf-8"),
+	} {
+		if err := opt(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msg.ContentType != "application/json" || msg.ContentEncoding != "utf-8" {
+		t.Fatalf("content type = %q, encoding = %q", msg.ContentType, msg.ContentEncoding)
+	}
+	if err := WithSendContentEncoding("latin1")(msg); err == nil {
+		t.Fatal("expected an error on unsupported encoding")
+	}
+}
+
+func TestSendExpired(t *testing.T) {
+	tr := &batchTransport{}
+	c := newTestClient(t, tr)
+	defer c.Close()
+
+	past := time.Now().Add(-time.Minute)
+	err := c.SendEvent(context.Background(), []byte("hello"), WithSendExpiryTime(past))
+	if !errors.Is(err, ErrMessageExpired) {
+		t.Fatalf("SendEvent() = %v, want %v", err, ErrMessageExpired)
+	}
+	if err = c.SendEvent(context.Background(), []byte("hello"), WithSendTTL(0)); err == nil {
+		t.Fatal("expected an error on a non-positive ttl")
+	}
+
+	future := time.Now().Add(time.Hour)
+	err = c.SendEvents(context.Background(), []*common.Message{
+		{Payload: []byte("a"), ExpiryTime: &future},
+		{Payload: []byte("b"), ExpiryTime: &past},
+	})
+	if !errors.Is(err, ErrMessageExpired) {
+		t.Fatalf("SendEvents() = %v, want %v", err, ErrMessageExpired)
+	}
+	if len(tr.sent) != 0 {
+		t.Fatal("batch with an expired message is sent")
+	}
+}
+
+func TestNilCallbackOptions(t *testing.T) {
+	for name, opt := range map[string]ClientOption{
+		"WithX509FromCallback":           WithX509FromCallback("dev", "test.azure-devices.net", nil),
+		"WithTLSConfig":                  WithTLSConfig(nil),
+		"WithMethodResponseErrorHandler": WithMethodResponseErrorHandler(nil),
+		"WithMethodContext":              WithMethodContext(nil),
+		"WithSubscriptionObserver":       WithSubscriptionObserver(nil),
+		"WithSendInterceptor":            WithSendInterceptor(nil),
+		"WithOversizedPayloadHandler":    WithOversizedPayloadHandler(nil),
+		"WithMetricsObserver":            WithMetricsObserver(nil),
+		"WithConnectionStateHandler":     WithConnectionStateHandler(nil),
+	} {
+		if _, err := New(WithTransport(&fakeTransport{}), WithConnectionString(testConnectionString), opt); err == nil {
+			t.Errorf("%s(nil): expected an error", name)
+		}
+	}
+}
+
+func TestWithSendTTL(t *testing.T) {
+	var msg *common.Message
+	c := newTestClient(t, &fakeTransport{}, WithSendInterceptor(func(m *common.Message) error {
+		msg = m
+		return nil
+	}))
+	defer c.Close()
+
+	now := time.Now().Add(-time.Hour)
+	c.clock = clock.NewFake(now)
+	if err := c.SendEvent(context.Background(), []byte("hello"), WithSendTTL(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if want := now.Add(time.Minute); msg.ExpiryTime == nil || !msg.ExpiryTime.Equal(want) {
+		t.Fatalf("ExpiryTime = %v, want %v", msg.ExpiryTime, want)
+	}
+	if _, ok := msg.TransportOptions[ttlOption]; ok {
+		t.Fatal("ttl is left in TransportOptions")
+	}
+}
+
+func TestWithSendSecurityMessage(t *testing.T) {
+	msg := &common.Message{}
+	if err := WithSendSecurityMessage()(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg.InterfaceID != SecurityInterfaceID {
+		t.Errorf("InterfaceID = %q, want %q", msg.InterfaceID, SecurityInterfaceID)
+	}
+	if msg.ContentType != "application/json" {
+		t.Errorf("ContentType = %q, want %q", msg.ContentType, "application/json")
+	}
+}
+
+func TestWithDefaultProperties(t *testing.T) {
+	defaults := map[string]string{"fw": "1.0", "site": "a"}
+	c := newTestClient(t, &fakeTransport{}, WithDefaultProperties(defaults))
+	defer c.Close()
+
+	msg, err := c.sendEvent(context.Background(), []byte("hello"), []SendOption{
+		WithSendProperty("site", "b"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"fw": "1.0", "site": "b"}
+	if !reflect.DeepEqual(msg.Properties, want) {
+		t.Fatalf("Properties = %v, want %v", msg.Properties, want)
+	}
+	if defaults["site"] != "a" || c.props["site"] != "a" {
+		t.Fatal("default properties are mutated")
+	}
+}
+
+func TestWithSendInterceptor(t *testing.T) {
+	errInvalid := errors.New("invalid")
+	c := newTestClient(t, &fakeTransport{},
+		WithSendInterceptor(func(msg *common.Message) error {
+			if len(msg.Payload) == 0 {
+				return errInvalid
+			}
+			msg.Properties["stamp"] = msg.Properties["site"] + "-1"
+			return nil
+		}),
+		WithSendInterceptor(func(msg *common.Message) error {
+			msg.Properties["stamp"] += "-2"
+			return nil
+		}),
+	)
+	defer c.Close()
+
+	msg, err := c.sendEvent(context.Background(), []byte("hello"), []SendOption{
+		WithSendProperty("site", "a"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := msg.Properties["stamp"]; v != "a-1-2" {
+		t.Fatalf("stamp = %q, want %q", v, "a-1-2")
+	}
+	if err = c.SendEvent(context.Background(), []byte{}); err != errInvalid {
+		t.Fatalf("SendEvent = %v, want %v", err, errInvalid)
+	}
+	if n := c.Stats().MessagesSent; n != 1 {
+		t.Fatalf("MessagesSent = %d, want %d", n, 1)
+	}
+}
+
+// patchTransport records the last twin update payload.
+type patchTransport struct {
+	fakeTransport
+	patch []byte
+}
+
+func (tr *patchTransport) UpdateTwinProperties(ctx context.Context, payload []byte) (int, error) {
+	tr.patch = payload
+	return tr.fakeTransport.UpdateTwinProperties(ctx, payload)
+}
+
+func TestUpdateTwinStateFrom(t *testing.T) {
+	tr := &patchTransport{}
+	c := newTestClient(t, tr)
+	defer c.Close()
+
+	type config struct {
+		Mode    string  `json:"mode"`
+		Comment string  `json:"comment,omitempty"`
+		Removed *string `json:"removed"`
+	}
+	ver, err := c.UpdateTwinStateFrom(context.Background(), &config{Mode: "eco"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver != 4 {
+		t.Errorf("version = %d, want %d", ver, 4)
+	}
+	if want := `{"mode":"eco","removed":null}`; string(tr.patch) != want {
+		t.Errorf("patch = %s, want %s", tr.patch, want)
+	}
+	if _, err = c.UpdateTwinStateFrom(context.Background(), []int{1}); err == nil {
+		t.Fatal("expected an error on a non-object value")
+	}
+}
+
+func TestCheckAndUpdateTwinState(t *testing.T) {
+	c := newTestClient(t, &fakeTransport{})
+	defer c.Close()
+
+	_, err := c.CheckAndUpdateTwinState(context.Background(), 2, TwinState{"a": 1})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("CheckAndUpdateTwinState() = %v, want %v", err, ErrPreconditionFailed)
+	}
+	ver, err := c.CheckAndUpdateTwinState(context.Background(), 3, TwinState{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ver != 4 {
+		t.Fatalf("version = %d, want %d", ver, 4)
+	}
+}
+
+func TestRetrieveTwinStateInto(t *testing.T) {
+	c := newTestClient(t, &fakeTransport{
+		twin: `{"desired":{"interval":5,"$version":2,"$metadata":{}},"reported":{"fw":"1.0","$version":3}}`,
+	})
+	defer c.Close()
+
+	var desired struct {
+		Interval int               `json:"interval"`
+		Extra    map[string]string `json:"$metadata"`
+	}
+	var reported struct {
+		FW string `json:"fw"`
+	}
+	if err := c.RetrieveTwinStateInto(context.Background(), &desired, &reported); err != nil {
+		t.Fatal(err)
+	}
+	if desired.Interval != 5 || desired.Extra != nil || reported.FW != "1.0" {
+		t.Fatalf("desired = %+v, reported = %+v", desired, reported)
+	}
+}
+
+func TestTwinStateMetadata(t *testing.T) {
+	var s TwinState
+	if err := json.Unmarshal([]byte(`{
+		"mode": "eco",
+		"$version": 5,
+		"$metadata": {
+			"$lastUpdated": "2021-03-01T10:00:00.5Z",
+			"mode": {
+				"$lastUpdated": "2021-03-01T09:30:00.1234567Z",
+				"$lastUpdatedVersion": 4
+			}
+		}
+	}`), &s); err != nil {
+		t.Fatal(err)
+	}
+	md, ok := s.Metadata("mode")
+	if !ok {
+		t.Fatal("metadata of mode is missing")
+	}
+	want := time.Date(2021, 3, 1, 9, 30, 0, 123456700, time.UTC)
+	if !md.LastUpdated.Equal(want) || md.LastUpdatedVersion != 4 {
+		t.Fatalf("Metadata(mode) = %+v, want %s and version 4", md, want)
+	}
+	if _, ok = s.Metadata("missing"); ok {
+		t.Fatal("metadata of a missing property is found")
+	}
+}
+
+func TestSASResourceURI(t *testing.T) {
+	creds, err := NewSASCredentials(testConnectionString,
+		WithSASResourceURI("test.azure-devices.net/devices/dev/modules/mod"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := creds.Token(context.Background(), "test.azure-devices.net/devices/dev", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "sr=test.azure-devices.net%2Fdevices%2Fdev%2Fmodules%2Fmod&"; !strings.Contains(token, want) {
+		t.Fatalf("token %q doesn't contain %q", token, want)
+	}
+}
+
+func TestModuleIdentity(t *testing.T) {
+	c, err := New(
+		WithTransport(&fakeTransport{}),
+		WithConnectionString("HostName=test.azure-devices.net;DeviceId=dev;ModuleId=mod;SharedAccessKey=c2VjcmV0"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DeviceID() != "dev" || c.ModuleID() != "mod" {
+		t.Fatalf("identity = %s/%s, want dev/mod", c.DeviceID(), c.ModuleID())
+	}
+
+	creds, err := NewX509ModuleCredentials("dev", "mod", "test.azure-devices.net", &tls.Certificate{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mid := transport.ModuleID(creds); mid != "mod" {
+		t.Fatalf("ModuleID() = %q, want %q", mid, "mod")
+	}
+}
+
+func TestWithTLSConfig(t *testing.T) {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, len(r.TLS.PeerCertificates))
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	s.StartTLS()
+	defer s.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	// the test server's certificate is valid for example.com
+	c, err := New(
+		WithTransport(&fakeTransport{}),
+		WithTLSConfig(&tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}),
+		WithX509FromCert("dev", "example.com", &s.TLS.Certificates[0]),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := c.creds.TLSConfig()
+	if tc.ServerName != "example.com" || tc.MinVersion != tls.VersionTLS12 {
+		t.Fatalf("ServerName = %q, MinVersion = %d", tc.ServerName, tc.MinVersion)
+	}
+
+	hc := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+	res, err := hc.Get(s.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "1" {
+		t.Fatalf("peer certificates = %s, want 1", b)
+	}
+}
+
+func TestSASCredentialsFromKey(t *testing.T) {
+	key := []byte("abc")
+	creds, err := NewSASCredentialsFromKey("test.azure-devices.net", "dev", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key[0] = 'x'
+	if k := creds.(*sasCreds).key; string(k) != "abc" {
+		t.Fatalf("key = %q, want it copied", k)
+	}
+
+	parsed, err := NewSASCredentials(testConnectionString)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if creds.Hostname() != parsed.Hostname() || creds.DeviceID() != parsed.DeviceID() {
+		t.Fatalf("identity = %s/%s, want %s/%s",
+			creds.Hostname(), creds.DeviceID(), parsed.Hostname(), parsed.DeviceID())
+	}
+	uri := "test.azure-devices.net/devices/dev"
+	if _, err = creds.Token(context.Background(), uri, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewSASCredentialsFromKey("test.azure-devices.net", "dev", nil); err == nil {
+		t.Fatal("expected an error on an empty key")
+	}
+}
+
+func BenchmarkNewSASCredentialsFromKey(b *testing.B) {
+	key := []byte("abc")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		creds, err := NewSASCredentialsFromKey("test.azure-devices.net", "dev", key)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err = creds.Token(context.Background(), "test.azure-devices.net/devices/dev", time.Hour); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestX509FromCallback(t *testing.T) {
+	crt := &tls.Certificate{}
+	creds, err := NewX509CredentialsFromCallback("dev", "test.azure-devices.net",
+		func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return crt, nil
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := creds.TLSConfig()
+	if len(cfg.Certificates) != 0 {
+		t.Fatal("certificates are fixed")
+	}
+	got, err := cfg.GetClientCertificate(&tls.CertificateRequestInfo{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != crt {
+		t.Fatal("GetClientCertificate returned a different certificate")
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	c := &Client{ready: make(chan struct{}), done: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := c.WaitReady(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("WaitReady = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	c.setReady(true)
+	if err := c.WaitReady(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	close(c.done)
+	c.setReady(false)
+	if err := c.WaitReady(context.Background()); err != ErrClosed {
+		t.Fatalf("WaitReady = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestIsConnected(t *testing.T) {
+	tr := &lossTransport{}
+	c := newTestClient(t, tr)
+	if !c.IsConnected() {
+		t.Fatal("IsConnected = false after connecting")
+	}
+	if err := c.LastError(); err != nil {
+		t.Fatalf("LastError = %v, want nil", err)
+	}
+
+	eof := errors.New("eof")
+	tr.lost(eof)
+	if c.IsConnected() {
+		t.Fatal("IsConnected = true while reconnecting")
+	}
+	if err := c.LastError(); err != eof {
+		t.Fatalf("LastError = %v, want %v", err, eof)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if c.IsConnected() {
+		t.Fatal("IsConnected = true after closing")
+	}
+}
+
+func TestConnected(t *testing.T) {
+	c := &Client{ready: make(chan struct{}), done: make(chan struct{})}
+	if c.Connected() {
+		t.Fatal("Connected = true before connecting")
+	}
+	c.connected = 1
+	c.setReady(true)
+	if !c.Connected() {
+		t.Fatal("Connected = false after connecting")
+	}
+	close(c.done)
+	if c.Connected() {
+		t.Fatal("Connected = true after closing")
+	}
+}
+
+func TestState(t *testing.T) {
+	tr := &lossTransport{}
+	c := newTestClient(t, tr)
+	if ok, err := c.State(); !ok || err != nil {
+		t.Fatalf("State() = %t, %v after connecting, want true, nil", ok, err)
+	}
+
+	eof := errors.New("eof")
+	tr.lost(eof)
+	if ok, err := c.State(); ok || err != eof {
+		t.Fatalf("State() = %t, %v while reconnecting, want false, %v", ok, err, eof)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.State(); ok || err != nil {
+		t.Fatalf("State() = %t, %v after closing, want false, nil", ok, err)
+	}
+}
+
+func TestSubscribeEventsContextCancel(t *testing.T) {
+	c := &Client{evMux: newEventsMux()}
+	sub := c.evMux.sub()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.unsubOnDone(ctx, sub)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	if _, ok := <-sub.C(); ok {
+		t.Fatal("C is not closed after cancelling ctx")
+	}
+	if err := sub.Err(); err != context.Canceled {
+		t.Fatalf("Err() = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestStats(t *testing.T) {
+	tr := &fakeTransport{dropped: 3}
+	c := newTestClient(t, tr)
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := c.SendEvent(context.Background(), []byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr.sendErr = errors.New("send error")
+	if err := c.SendEvent(context.Background(), []byte("hello")); err == nil {
+		t.Fatal("expected an error")
+	}
+	c.evMux.Dispatch(&common.Message{})
+
+	s := c.Stats()
+	if s.MessagesSent != 2 || s.SendErrors != 1 || s.MessagesReceived != 1 || s.MessagesDropped != 3 {
+		t.Fatalf("Stats() = %#v", s)
+	}
+}
+
+func BenchmarkSendEventParallel(b *testing.B) {
+	c := newTestClient(b, &fakeTransport{})
+	defer c.Close()
+
+	payload := []byte("hello")
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := c.SendEvent(context.Background(), payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestTwinTimeout(t *testing.T) {
+	c := newTestClient(t, &fakeTransport{twinHang: true},
+		WithTwinTimeout(10*time.Millisecond),
+	)
+	defer c.Close()
+
+	if _, _, err := c.RetrieveTwinState(context.Background()); err != ErrTwinTimeout {
+		t.Fatalf("RetrieveTwinState = %v, want %v", err, ErrTwinTimeout)
+	}
+
+	// the caller's context errors are returned as is
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := c.RetrieveTwinState(ctx); err != context.Canceled {
+		t.Fatalf("RetrieveTwinState = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestTwinOnConnect(t *testing.T) {
+	c := newTestClient(t, &fakeTransport{}, WithTwinOnConnect())
+	defer c.Close()
+
+	if v := c.TwinVersion(); v != 3 {
+		t.Fatalf("TwinVersion() = %d, want %d", v, 3)
+	}
+	if _, err := c.UpdateTwinState(context.Background(), TwinState{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if v := c.TwinVersion(); v != 4 {
+		t.Fatalf("TwinVersion() = %d, want %d", v, 4)
+	}
+}
+
+// recordingObserver records subscriptions lifecycle events as strings.
+type recordingObserver struct {
+	events []string
+}
+
+func (o *recordingObserver) OnSubscribe(kind SubscriptionKind, name string) {
+	o.events = append(o.events, fmt.Sprintf("subscribe %s %s", kind, name))
+}
+
+func (o *recordingObserver) OnSubscribeError(kind SubscriptionKind, name string, err error) {
+	o.events = append(o.events, fmt.Sprintf("error %s %s: %s", kind, name, err))
+}
+
+func (o *recordingObserver) OnResubscribe(kind SubscriptionKind, name string, err error) {
+	o.events = append(o.events, fmt.Sprintf("resubscribe %s %s", kind, name))
+}
+
+func (o *recordingObserver) OnUnsubscribe(kind SubscriptionKind, name string) {
+	o.events = append(o.events, fmt.Sprintf("unsubscribe %s %s", kind, name))
+}
+
+func TestSubscriptionObserver(t *testing.T) {
+	o := &recordingObserver{}
+	c := newTestClient(t, &fakeTransport{}, WithSubscriptionObserver(o))
+	defer c.Close()
+
+	sub, err := c.SubscribeEvents(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.UnsubscribeEvents(sub)
+	c.UnsubscribeEvents(sub)
+
+	fn := func(context.Context, map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	}
+	for i := 0; i < 2; i++ {
+		_ = c.RegisterMethod(context.Background(), "reboot", fn)
+	}
+	c.UnregisterMethod("reboot")
+
+	want := []string{
+		"subscribe events ",
+		"unsubscribe events ",
+		"subscribe method reboot",
+		`error method reboot: method "reboot" is already registered`,
+		"unsubscribe method reboot",
+	}
+	if !reflect.DeepEqual(o.events, want) {
+		t.Fatalf("events = %q, want %q", o.events, want)
+	}
+}
+
+func TestStateConnectionChecker(t *testing.T) {
+	tr := &fakeTransport{}
+	c, err := New(WithTransport(tr), WithConnectionString(testConnectionString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.State(); ok || err != nil {
+		t.Fatalf("State() = %t, %v before connecting, want false, nil", ok, err)
+	}
+	if err = c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.State(); !ok {
+		t.Fatal("State() = false after connecting")
+	}
+
+	// the transport reconnecting on its own
+	tr.offline = true
+	if ok, _ := c.State(); ok {
+		t.Fatal("State() = true while the transport is offline")
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadyHealthy(t *testing.T) {
+	tr := &fakeTransport{}
+	c, err := New(WithTransport(tr), WithConnectionString(testConnectionString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Ready(); err != ErrNotConnected {
+		t.Fatalf("Ready() = %v, want %v", err, ErrNotConnected)
+	}
+	if err = c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Ready(); err != nil {
+		t.Fatalf("Ready() = %v, want nil", err)
+	}
+	if err = c.Healthy(); err != nil {
+		t.Fatalf("Healthy() = %v, want nil", err)
+	}
+
+	// reconnecting clients are ready but not healthy
+	tr.offline = true
+	if err = c.Ready(); err != nil {
+		t.Fatalf("Ready() = %v, want nil", err)
+	}
+	if err = c.Healthy(); err != ErrNotConnected {
+		t.Fatalf("Healthy() = %v, want %v", err, ErrNotConnected)
+	}
+
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Ready(); err != ErrClosed {
+		t.Fatalf("Ready() = %v, want %v", err, ErrClosed)
+	}
+}
+
+// plainTransport hides optional interfaces implemented by the wrapped transport.
+type plainTransport struct {
+	transport.Transport
+}
+
+func TestStateWithoutConnectionChecker(t *testing.T) {
+	c := newTestClient(t, plainTransport{&fakeTransport{offline: true}})
+	defer c.Close()
+	if ok, err := c.State(); !ok || err != nil {
+		t.Fatalf("State() = %t, %v, want true, nil", ok, err)
+	}
+}
@@ -3,6 +3,7 @@ package iotdevice
 import (
 	"context"
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"time"
 
@@ -11,26 +12,84 @@ import (
 	"github.com/amenzhinsky/iothub/iotdevice/transport"
 )
 
-func NewSASCredentials(cs string) (transport.Credentials, error) {
+// SASOption is a SAS credentials option.
+type SASOption func(c *sasCreds)
+
+// WithSASResourceURI overrides the resource uri tokens are signed for,
+// by default transports derive it from the hostname and the identity,
+// e.g. `{hostname}/devices/{deviceId}`.
+//
+// It's meant for non-standard topologies and debugging authentication errors.
+func WithSASResourceURI(uri string) SASOption {
+	if uri == "" {
+		panic("uri is empty")
+	}
+	return func(c *sasCreds) {
+		c.uri = uri
+	}
+}
+
+func NewSASCredentials(cs string, opts ...SASOption) (transport.Credentials, error) {
 	creds, err := credentials.ParseConnectionString(cs)
 	if err != nil {
 		return nil, err
 	}
-	return &sasCreds{creds: creds}, nil
+	key, err := base64.StdEncoding.DecodeString(creds.SharedAccessKey)
+	if err != nil {
+		return nil, err
+	}
+	return newSASCreds(creds, key, opts), nil
+}
+
+// NewSASCredentialsFromKey is NewSASCredentials that takes already validated
+// components and the decoded device key, it skips parsing the connection
+// string and decoding the key for every token, so creating many clients,
+// e.g. in a device simulator, costs only token signing.
+//
+// The key is copied so it can be shared between calls.
+func NewSASCredentialsFromKey(hostname, deviceID string, key []byte, opts ...SASOption) (transport.Credentials, error) {
+	if hostname == "" || deviceID == "" {
+		return nil, errors.New("hostname and device id are required")
+	}
+	if len(key) == 0 {
+		return nil, errors.New("key is empty")
+	}
+	return newSASCreds(&credentials.Credentials{
+		HostName: hostname,
+		DeviceID: deviceID,
+	}, append([]byte(nil), key...), opts), nil
+}
+
+func newSASCreds(creds *credentials.Credentials, key []byte, opts []SASOption) *sasCreds {
+	c := &sasCreds{creds: creds, key: key}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
 }
 
 type sasCreds struct {
 	creds *credentials.Credentials
+	key   []byte // decoded shared access key
+	uri   string // overrides the resource uri when set
 }
 
 func (c *sasCreds) DeviceID() string {
 	return c.creds.DeviceID
 }
 
+func (c *sasCreds) ModuleID() string {
+	return c.creds.ModuleID
+}
+
 func (c *sasCreds) Hostname() string {
 	return c.creds.HostName
 }
 
+func (c *sasCreds) GatewayHostname() string {
+	return ""
+}
+
 func (c *sasCreds) IsSAS() bool {
 	return true
 }
@@ -43,7 +102,12 @@ func (c *sasCreds) TLSConfig() *tls.Config {
 }
 
 func (c *sasCreds) Token(ctx context.Context, uri string, d time.Duration) (string, error) {
-	return c.creds.GenerateToken(uri, credentials.WithDuration(d))
+	if c.uri != "" {
+		uri = c.uri
+	}
+	return credentials.GenerateTokenFromKey(c.key, c.creds.SharedAccessKeyName, uri,
+		credentials.WithDuration(d),
+	)
 }
 
 func NewX509Credentials(deviceID, hostname string, crt *tls.Certificate) (transport.Credentials, error) {
@@ -54,25 +118,72 @@ func NewX509Credentials(deviceID, hostname string, crt *tls.Certificate) (transp
 	}, nil
 }
 
+// NewX509ModuleCredentials is NewX509Credentials of a module identity.
+func NewX509ModuleCredentials(deviceID, moduleID, hostname string, crt *tls.Certificate) (transport.Credentials, error) {
+	if moduleID == "" {
+		return nil, errors.New("module id is empty")
+	}
+	return &x509Creds{
+		deviceID:    deviceID,
+		moduleID:    moduleID,
+		hostname:    hostname,
+		certificate: crt,
+	}, nil
+}
+
+// NewX509CredentialsFromCallback is same as NewX509Credentials but the client
+// certificate is requested from fn at every TLS handshake including
+// reconnects, so certificates can be rotated without recreating the client.
+func NewX509CredentialsFromCallback(
+	deviceID, hostname string,
+	fn func(*tls.CertificateRequestInfo) (*tls.Certificate, error),
+) (transport.Credentials, error) {
+	if fn == nil {
+		return nil, errors.New("fn is nil")
+	}
+	return &x509Creds{
+		deviceID: deviceID,
+		hostname: hostname,
+		getCert:  fn,
+	}, nil
+}
+
 type x509Creds struct {
 	deviceID    string
+	moduleID    string // empty for devices
 	hostname    string
 	certificate *tls.Certificate
+	getCert     func(*tls.CertificateRequestInfo) (*tls.Certificate, error)
 }
 
 func (c *x509Creds) DeviceID() string {
 	return c.deviceID
 }
 
+func (c *x509Creds) ModuleID() string {
+	return c.moduleID
+}
+
 func (c *x509Creds) Hostname() string {
 	return c.hostname
 }
 
+func (c *x509Creds) GatewayHostname() string {
+	return ""
+}
+
 func (c *x509Creds) IsSAS() bool {
 	return false
 }
 
 func (c *x509Creds) TLSConfig() *tls.Config {
+	if c.getCert != nil {
+		return &tls.Config{
+			ServerName:           c.hostname,
+			GetClientCertificate: c.getCert,
+			RootCAs:              common.RootCAs(),
+		}
+	}
 	return &tls.Config{
 		ServerName:   c.hostname,
 		Certificates: []tls.Certificate{*c.certificate},
@@ -83,3 +194,25 @@ func (c *x509Creds) TLSConfig() *tls.Config {
 func (c *x509Creds) Token(ctx context.Context, uri string, d time.Duration) (string, error) {
 	return "", errors.New("not supported")
 }
+
+// tlsCreds overrides the TLS config of the underlying credentials.
+type tlsCreds struct {
+	transport.Credentials
+	tls *tls.Config
+}
+
+func (c *tlsCreds) TLSConfig() *tls.Config {
+	base := c.Credentials.TLSConfig()
+	tc := c.tls.Clone()
+	if tc.ServerName == "" {
+		tc.ServerName = base.ServerName
+	}
+	if tc.RootCAs == nil {
+		tc.RootCAs = base.RootCAs
+	}
+	if len(tc.Certificates) == 0 && tc.GetClientCertificate == nil {
+		tc.Certificates = base.Certificates
+		tc.GetClientCertificate = base.GetClientCertificate
+	}
+	return tc
+}
@@ -0,0 +1,236 @@
+package iotdevice
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/amenzhinsky/iothub/internal/clock"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+// defaultEdgeAPIVersion is used when $IOTEDGE_APIVERSION is not set.
+const defaultEdgeAPIVersion = "2018-06-28"
+
+// workloadTimeout limits workload API requests, tokens are signed
+// by it on every connection attempt that must not hang.
+const workloadTimeout = 30 * time.Second
+
+// WithEdgeModuleFromEnvironment configures the client as an IoT Edge module
+// using the environment provided by the IoT Edge runtime, see NewEdgeCredentialsFromEnvironment.
+func WithEdgeModuleFromEnvironment() ClientOption {
+	return func(c *Client) error {
+		creds, err := NewEdgeCredentialsFromEnvironment()
+		if err != nil {
+			return err
+		}
+		creds.(*edgeCreds).clock = c.clock
+		c.creds = creds
+		return nil
+	}
+}
+
+// NewEdgeCredentialsFromEnvironment creates credentials of an IoT Edge module
+// from the IOTEDGE_* environment variables set by the IoT Edge runtime.
+//
+// Tokens are signed by the workload API so the module key never leaves
+// the security daemon, and connections go through the local Edge Hub
+// that's trusted using the runtime's trust bundle.
+func NewEdgeCredentialsFromEnvironment() (transport.Credentials, error) {
+	c := &edgeCreds{clock: clock.Real}
+	for _, v := range []struct {
+		dst *string
+		env string
+	}{
+		{&c.hostname, "IOTEDGE_IOTHUBHOSTNAME"},
+		{&c.gateway, "IOTEDGE_GATEWAYHOSTNAME"},
+		{&c.deviceID, "IOTEDGE_DEVICEID"},
+		{&c.moduleID, "IOTEDGE_MODULEID"},
+		{&c.generationID, "IOTEDGE_MODULEGENERATIONID"},
+	} {
+		if *v.dst = os.Getenv(v.env); *v.dst == "" {
+			return nil, fmt.Errorf("$%s is empty", v.env)
+		}
+	}
+	if scheme := os.Getenv("IOTEDGE_AUTHSCHEME"); scheme != "" && scheme != "sasToken" {
+		return nil, fmt.Errorf("unsupported auth scheme %q", scheme)
+	}
+	if c.apiVersion = os.Getenv("IOTEDGE_APIVERSION"); c.apiVersion == "" {
+		c.apiVersion = defaultEdgeAPIVersion
+	}
+
+	u, err := url.Parse(os.Getenv("IOTEDGE_WORKLOADURI"))
+	if err != nil {
+		return nil, err
+	}
+	c.workload, c.http, err = newWorkloadClient(u)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.roots, err = c.trustBundle(context.Background()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newWorkloadClient returns the base url and an http client
+// for the given workload API uri, it's usually a unix socket.
+func newWorkloadClient(u *url.URL) (string, *http.Client, error) {
+	switch u.Scheme {
+	case "unix":
+		path := u.Path
+		return "http://iotedge", &http.Client{
+			Timeout: workloadTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", path)
+				},
+			},
+		}, nil
+	case "http", "https":
+		return u.Scheme + "://" + u.Host, &http.Client{Timeout: workloadTimeout}, nil
+	case "":
+		return "", nil, errors.New("$IOTEDGE_WORKLOADURI is empty")
+	default:
+		return "", nil, fmt.Errorf("unsupported workload uri scheme %q", u.Scheme)
+	}
+}
+
+type edgeCreds struct {
+	hostname     string
+	gateway      string
+	deviceID     string
+	moduleID     string
+	generationID string
+	apiVersion   string
+
+	workload string
+	http     *http.Client
+	roots    *x509.CertPool
+	clock    clock.Clock // token expiration times source
+}
+
+func (c *edgeCreds) DeviceID() string {
+	return c.deviceID
+}
+
+func (c *edgeCreds) ModuleID() string {
+	return c.moduleID
+}
+
+func (c *edgeCreds) Hostname() string {
+	return c.hostname
+}
+
+func (c *edgeCreds) GatewayHostname() string {
+	return c.gateway
+}
+
+func (c *edgeCreds) IsSAS() bool {
+	return true
+}
+
+func (c *edgeCreds) TLSConfig() *tls.Config {
+	return &tls.Config{
+		ServerName: c.gateway,
+		RootCAs:    c.roots,
+	}
+}
+
+func (c *edgeCreds) Token(ctx context.Context, uri string, d time.Duration) (string, error) {
+	sr := url.QueryEscape(uri)
+	se := strconv.FormatInt(c.clock.Now().Add(d).Unix(), 10)
+	sig, err := c.sign(ctx, sr+"\n"+se)
+	if err != nil {
+		return "", err
+	}
+	return "SharedAccessSignature " +
+		"sr=" + sr +
+		"&sig=" + url.QueryEscape(sig) +
+		"&se=" + se, nil
+}
+
+// sign signs data with the module key using the workload API.
+func (c *edgeCreds) sign(ctx context.Context, data string) (string, error) {
+	var res struct {
+		Digest string `json:"digest"`
+	}
+	if err := c.call(ctx, http.MethodPost,
+		"/modules/"+url.PathEscape(c.moduleID)+
+			"/genid/"+url.PathEscape(c.generationID)+"/sign",
+		map[string]string{
+			"keyId": "primary",
+			"algo":  "HMACSHA256",
+			"data":  base64.StdEncoding.EncodeToString([]byte(data)),
+		}, &res,
+	); err != nil {
+		return "", err
+	}
+	return res.Digest, nil
+}
+
+// trustBundle requests the certificates needed for trusting the Edge Hub.
+func (c *edgeCreds) trustBundle(ctx context.Context) (*x509.CertPool, error) {
+	var res struct {
+		Certificate string `json:"certificate"`
+	}
+	if err := c.call(ctx, http.MethodGet, "/trust-bundle", nil, &res); err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(res.Certificate)) {
+		return nil, errors.New("no certificates in the trust bundle")
+	}
+	return pool, nil
+}
+
+func (c *edgeCreds) call(ctx context.Context, method, path string, in, out interface{}) error {
+	ctx, cancel := context.WithTimeout(ctx, workloadTimeout)
+	defer cancel()
+
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method,
+		c.workload+path+"?api-version="+url.QueryEscape(c.apiVersion),
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.http.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("workload api %s %s: code = %d, body = %q", method, path, res.StatusCode, b)
+	}
+	return json.Unmarshal(b, out)
+}
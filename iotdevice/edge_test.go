@@ -0,0 +1,90 @@
+package iotdevice
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/internal/clock"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+func TestEdgeCredentials(t *testing.T) {
+	gw := httptest.NewTLSServer(http.NotFoundHandler())
+	defer gw.Close()
+
+	workload := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v interface{}
+		switch r.URL.Path {
+		case "/trust-bundle":
+			v = map[string]string{"certificate": string(pem.EncodeToMemory(&pem.Block{
+				Type:  "CERTIFICATE",
+				Bytes: gw.Certificate().Raw,
+			}))}
+		case "/modules/mod/genid/gen/sign":
+			v = map[string]string{"digest": "c2ln"}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			t.Fatal(err)
+		}
+	}))
+	defer workload.Close()
+
+	for k, v := range map[string]string{
+		"IOTEDGE_IOTHUBHOSTNAME":     "test.azure-devices.net",
+		"IOTEDGE_GATEWAYHOSTNAME":    "edgehub",
+		"IOTEDGE_DEVICEID":           "dev",
+		"IOTEDGE_MODULEID":           "mod",
+		"IOTEDGE_MODULEGENERATIONID": "gen",
+		"IOTEDGE_WORKLOADURI":        workload.URL,
+	} {
+		t.Setenv(k, v)
+	}
+
+	creds, err := NewEdgeCredentialsFromEnvironment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mid, host := transport.ModuleID(creds), transport.GatewayHostname(creds)
+	if mid != "mod" || host != "edgehub" {
+		t.Fatalf("module = %q, gateway = %q", mid, host)
+	}
+	now := time.Unix(1600000000, 0)
+	creds.(*edgeCreds).clock = clock.NewFake(now)
+	token, err := creds.Token(context.Background(), "test.azure-devices.net/devices/dev/modules/mod", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(token, "&sig=c2ln&") {
+		t.Fatalf("token = %q, want it to contain the workload signature", token)
+	}
+	if se := "&se=" + strconv.FormatInt(now.Add(time.Hour).Unix(), 10); !strings.HasSuffix(token, se) {
+		t.Fatalf("token = %q, want it to expire at %s", token, se)
+	}
+}
+
+func TestWorkloadClientTimeout(t *testing.T) {
+	for _, s := range []string{"unix:///var/run/iotedge/workload.sock", "http://127.0.0.1:15581"} {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, c, err := newWorkloadClient(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Timeout != workloadTimeout {
+			t.Errorf("%s: timeout = %s, want %s", s, c.Timeout, workloadTimeout)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package iotdevice
+
+import (
+	"errors"
+	"time"
+)
+
+// MetricsObserver is notified about client operations to collect metrics,
+// e.g. with Prometheus. Methods are called synchronously so they must not block.
+type MetricsObserver interface {
+	// SendStarted is called when a device-to-cloud message is being sent,
+	// it's called for every message of batches.
+	SendStarted()
+
+	// SendCompleted is called when a send finishes, err is nil on success.
+	SendCompleted(err error, d time.Duration)
+
+	// Reconnected is called when the client restores a lost connection.
+	Reconnected()
+
+	// MethodInvoked is called when a direct method invocation finishes,
+	// status is zero when nothing is responded, e.g. on timeouts.
+	MethodInvoked(name string, d time.Duration, status int)
+
+	// TwinUpdated is called when a desired state update is received.
+	TwinUpdated()
+}
+
+// WithMetricsObserver makes o notified about sends,
+// reconnects, direct methods and twin updates.
+func WithMetricsObserver(o MetricsObserver) ClientOption {
+	return func(c *Client) error {
+		if o == nil {
+			return errors.New("o is nil")
+		}
+		c.metrics = o
+		return nil
+	}
+}
@@ -0,0 +1,85 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+// recordingMetrics records observed metrics as strings.
+type recordingMetrics struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (m *recordingMetrics) record(format string, v ...interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, fmt.Sprintf(format, v...))
+}
+
+func (m *recordingMetrics) SendStarted() {
+	m.record("send started")
+}
+
+func (m *recordingMetrics) SendCompleted(err error, d time.Duration) {
+	m.record("send completed %v", err)
+}
+
+func (m *recordingMetrics) Reconnected() {
+	m.record("reconnected")
+}
+
+func (m *recordingMetrics) MethodInvoked(name string, d time.Duration, status int) {
+	m.record("method %s %d", name, status)
+}
+
+func (m *recordingMetrics) TwinUpdated() {
+	m.record("twin updated")
+}
+
+func TestMetricsObserver(t *testing.T) {
+	m := &recordingMetrics{}
+	tr := &fakeTransport{}
+	c := newTestClient(t, tr, WithMetricsObserver(m))
+	defer c.Close()
+
+	if err := c.SendEvent(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	tr.sendErr = errors.New("send error")
+	if err := c.SendEvent(context.Background(), []byte("hello")); err == nil {
+		t.Fatal("expected an error")
+	}
+	if err := c.RegisterMethod(context.Background(), "reboot",
+		func(ctx context.Context, p map[string]interface{}) (map[string]interface{}, error) {
+			return nil, nil
+		},
+	); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.dmMux.Dispatch(&transport.MethodRequest{Name: "reboot", RequestID: "1", Payload: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	c.dmMux.Dispatch(&transport.MethodRequest{Name: "missing", RequestID: "2", Payload: []byte(`{}`)})
+	c.tsMux.Dispatch([]byte(`{"$version":2}`))
+
+	want := []string{
+		"send started",
+		"send completed <nil>",
+		"send started",
+		"send completed send error",
+		"method reboot 200",
+		"method missing 0",
+		"twin updated",
+	}
+	if !reflect.DeepEqual(m.events, want) {
+		t.Fatalf("metrics = %q, want %q", m.events, want)
+	}
+}
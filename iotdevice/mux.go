@@ -1,12 +1,18 @@
 package iotdevice
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
 )
 
 // once wraps a function that can return an error and
@@ -24,10 +30,16 @@ func newEventsMux() *eventsMux {
 }
 
 type eventsMux struct {
+	received uint64 // atomic counters, 64-bit aligned as the first fields
+	dropped  uint64
+
 	on   sync.Once
 	mu   sync.RWMutex
 	subs []*EventSub
 	done chan struct{}
+
+	max    int                         // payload size limit, zero is unlimited
+	reject func(err *PayloadSizeError) // called with oversized payloads
 }
 
 func (m *eventsMux) once(fn func() error) error {
@@ -35,8 +47,19 @@ func (m *eventsMux) once(fn func() error) error {
 }
 
 func (m *eventsMux) Dispatch(msg *common.Message) {
+	if m.max != 0 && len(msg.Payload) > m.max {
+		m.reject(&PayloadSizeError{Size: len(msg.Payload), Limit: m.max})
+		return
+	}
+	atomic.AddUint64(&m.received, 1)
 	m.mu.RLock()
 	for _, s := range m.subs {
+		if s.drop {
+			if s.deliverDropping(msg) {
+				atomic.AddUint64(&m.dropped, 1)
+			}
+			continue
+		}
 		//go func() {
 		select {
 		case <-s.done:
@@ -48,24 +71,30 @@ func (m *eventsMux) Dispatch(msg *common.Message) {
 	m.mu.RUnlock()
 }
 
-func (m *eventsMux) sub() *EventSub {
+func (m *eventsMux) sub(opts ...SubscribeOption) *EventSub {
 	s := newEventSub()
+	for _, opt := range opts {
+		opt(s)
+	}
 	m.mu.Lock()
 	m.subs = append(m.subs, s)
 	m.mu.Unlock()
 	return s
 }
 
-func (m *eventsMux) unsub(s *EventSub) {
+// unsub closes the given subscription with err and removes it from the list,
+// it reports whether the subscription was active.
+func (m *eventsMux) unsub(s *EventSub, err error) bool {
 	m.mu.Lock()
+	defer m.mu.Unlock()
 	for i, ss := range m.subs {
 		if ss == s {
-			s.close(nil)
+			s.close(err)
 			m.subs = append(m.subs[:i], m.subs[i+1:]...)
-			break
+			return true
 		}
 	}
-	m.mu.Unlock()
+	return false
 }
 
 func (m *eventsMux) close(err error) {
@@ -90,20 +119,85 @@ func newEventSub() *EventSub {
 	}
 }
 
+// SubscribeOption is an events subscription option.
+type SubscribeOption func(s *EventSub)
+
+// WithSubscribeDropOldest makes the subscription drop the oldest buffered
+// message when its buffer is full instead of blocking the delivery of
+// messages until it's read, so a slow reader cannot stall the connection.
+// Dropped messages are counted in Stats.
+//
+// It's meant for real-time workloads preferring recent
+// messages over complete ones, messages are acknowledged
+// to the hub regardless of being dropped.
+//
+// There's no such policy for direct methods: invocations aren't
+// buffered but handled as they arrive, and every one of them has
+// a caller waiting for its response, so a dropped invocation would
+// only fail later with a timeout on the service side. Slow method
+// handlers are bounded by WithMethodResponseTimeout instead.
+func WithSubscribeDropOldest() SubscribeOption {
+	return func(s *EventSub) {
+		s.drop = true
+	}
+}
+
+// EventSub is a cloud-to-device messages subscription.
 type EventSub struct {
 	ch   chan *common.Message
 	err  error
 	done chan struct{}
+	drop bool // drop the oldest message instead of blocking
+}
+
+// deliverDropping puts msg into the buffer dropping the oldest
+// message when it's full and reports whether one is dropped.
+func (s *EventSub) deliverDropping(msg *common.Message) bool {
+	var dropped bool
+	for {
+		select {
+		case s.ch <- msg:
+			return dropped
+		default:
+		}
+		select {
+		case <-s.ch:
+			dropped = true
+		default:
+		}
+	}
 }
 
+// C returns the messages channel, it's closed when the subscription is closed.
 func (s *EventSub) C() <-chan *common.Message {
 	return s.ch
 }
 
+// Err returns the error the subscription is closed with,
+// it's nil when the subscription is closed by unsubscribing.
 func (s *EventSub) Err() error {
 	return s.err
 }
 
+// Next blocks until the next message is received or the context is done.
+//
+// When the subscription is closed it returns the subscription error
+// or ErrClosed if it was closed by unsubscribing.
+func (s *EventSub) Next(ctx context.Context) (*common.Message, error) {
+	select {
+	case msg, ok := <-s.ch:
+		if !ok {
+			if s.err != nil {
+				return nil, s.err
+			}
+			return nil, ErrClosed
+		}
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
 func (s *EventSub) close(err error) {
 	s.err = err
 	close(s.done)
@@ -115,10 +209,18 @@ func newTwinStateMux() *twinStateMux {
 }
 
 type twinStateMux struct {
+	dropped uint64 // atomic counter, 64-bit aligned as the first field
+
 	on   sync.Once
 	mu   sync.RWMutex
+	ver  int // last dispatched desired state version
 	subs []*TwinStateSub
 	done chan struct{}
+
+	max    int                         // document size limit, zero is unlimited
+	reject func(err *PayloadSizeError) // called with oversized documents
+
+	updated func() // called with received updates, can be nil
 }
 
 func (m *twinStateMux) once(fn func() error) error {
@@ -126,54 +228,80 @@ func (m *twinStateMux) once(fn func() error) error {
 }
 
 func (m *twinStateMux) Dispatch(b []byte) {
+	if m.max != 0 && len(b) > m.max {
+		m.reject(&PayloadSizeError{Size: len(b), Limit: m.max})
+		return
+	}
 	var v TwinState
 	if err := json.Unmarshal(b, &v); err != nil {
 		log.Printf("unmarshal error: %s", err) // TODO
 		return
 	}
+	if m.updated != nil {
+		m.updated()
+	}
+	m.dispatch(v, false)
+}
 
-	m.mu.RLock()
-	select {
-	case <-m.done:
-		panic("already closed")
-	default:
+// dispatch delivers the given state to all subscribers,
+// when newer is true it's delivered only when its version
+// is greater than the last dispatched one.
+func (m *twinStateMux) dispatch(v TwinState, newer bool) bool {
+	m.mu.Lock()
+	if newer && v.Version() <= m.ver {
+		m.mu.Unlock()
+		return false
 	}
-	close(m.done)
-	for _, sub := range m.subs {
-		go func(sub *TwinStateSub) {
-			select {
-			case sub.ch <- v:
-			case <-m.done:
-			}
-		}(sub)
+	if v.Version() > m.ver {
+		m.ver = v.Version()
+	}
+	m.mu.Unlock()
+
+	// never blocks, so neither the transport nor ResyncTwin
+	// are stalled by subscribers that fall behind
+	m.mu.RLock()
+	for _, s := range m.subs {
+		if s.deliverDropping(v) {
+			atomic.AddUint64(&m.dropped, 1)
+		}
 	}
 	m.mu.RUnlock()
+	return true
 }
 
 func (m *twinStateMux) sub() *TwinStateSub {
-	s := &TwinStateSub{ch: make(chan TwinState, 10)}
+	s := &TwinStateSub{
+		ch: make(chan TwinState, 10),
+	}
 	m.mu.Lock()
 	m.subs = append(m.subs, s)
 	m.mu.Unlock()
 	return s
 }
 
-func (m *twinStateMux) unsub(s *TwinStateSub) {
+func (m *twinStateMux) unsub(s *TwinStateSub) bool {
 	m.mu.Lock()
+	defer m.mu.Unlock()
 	for i, ss := range m.subs {
 		if ss == s {
+			s.close(nil)
 			m.subs = append(m.subs[:i], m.subs[i+1:]...)
-			break
+			return true
 		}
 	}
-	m.mu.Unlock()
+	return false
 }
 
 func (m *twinStateMux) close(err error) {
 	m.mu.Lock()
+	select {
+	case <-m.done:
+		panic("already closed")
+	default:
+	}
+	close(m.done)
 	for _, s := range m.subs {
-		s.err = ErrClosed
-		close(s.ch)
+		s.close(err)
 	}
 	m.subs = m.subs[0:0]
 	m.mu.Unlock()
@@ -184,6 +312,24 @@ type TwinStateSub struct {
 	err error
 }
 
+// deliverDropping puts v into the buffer dropping the oldest
+// update when it's full and reports whether one is dropped.
+func (s *TwinStateSub) deliverDropping(v TwinState) bool {
+	var dropped bool
+	for {
+		select {
+		case s.ch <- v:
+			return dropped
+		default:
+		}
+		select {
+		case <-s.ch:
+			dropped = true
+		default:
+		}
+	}
+}
+
 func (s *TwinStateSub) C() <-chan TwinState {
 	return s.ch
 }
@@ -192,15 +338,54 @@ func (s *TwinStateSub) Err() error {
 	return s.err
 }
 
-func newMethodMux() *methodMux {
-	return &methodMux{}
+func (s *TwinStateSub) close(err error) {
+	s.err = err
+	close(s.ch)
+}
+
+// newMethodMux returns a dispatcher which handlers contexts derive from ctx.
+func newMethodMux(ctx context.Context) *methodMux {
+	return &methodMux{
+		ctx:     ctx,
+		timeout: DefaultMethodResponseTimeout,
+	}
 }
 
 // methodMux is direct-methods dispatcher.
 type methodMux struct {
-	on sync.Once
-	mu sync.RWMutex
-	m  map[string]DirectMethodHandler
+	invoked uint64 // atomic counter, 64-bit aligned as the first field
+
+	on   sync.Once
+	mu   sync.RWMutex
+	m    map[string]TypedMethodHandler
+	p    map[string]TypedMethodHandler // handlers by method name prefix
+	ctx  context.Context               // handlers contexts derive from it, background when nil
+	runs sendTracker                   // running handlers and unsent responses, drained on close
+
+	max     int           // request size limit, MaxMethodPayloadSize when zero
+	timeout time.Duration // response timeout, none when zero
+	respErr func(methodName, rid string, err error)
+	wrapCtx func(ctx context.Context, r *MethodRequest) context.Context
+
+	observe func(method string, start time.Time, rc int) // can be nil
+	now     func() time.Time
+}
+
+// StartResponse implements transport.MethodResponseTracker.
+func (m *methodMux) StartResponse() error {
+	return m.runs.add()
+}
+
+// DoneResponse implements transport.MethodResponseTracker.
+func (m *methodMux) DoneResponse() {
+	m.runs.done()
+}
+
+// HandleResponseError implements transport.MethodResponseErrorHandler.
+func (m *methodMux) HandleResponseError(methodName, rid string, err error) {
+	if m.respErr != nil {
+		m.respErr(methodName, rid, err)
+	}
 }
 
 func (m *methodMux) once(fn func() error) error {
@@ -210,11 +395,19 @@ func (m *methodMux) once(fn func() error) error {
 // handle registers the given direct-method handler.
 func (m *methodMux) handle(method string, fn DirectMethodHandler) error {
 	if fn == nil {
-		panic("fn is nil")
+		return fmt.Errorf("method %q handler is nil", method)
+	}
+	return m.handleTyped(method, typedHandler(fn))
+}
+
+// handleTyped registers the given typed direct-method handler.
+func (m *methodMux) handleTyped(method string, fn TypedMethodHandler) error {
+	if fn == nil {
+		return fmt.Errorf("method %q handler is nil", method)
 	}
 	m.mu.Lock()
 	if m.m == nil {
-		m.m = map[string]DirectMethodHandler{}
+		m.m = map[string]TypedMethodHandler{}
 	}
 	if _, ok := m.m[method]; ok {
 		m.mu.Unlock()
@@ -225,31 +418,218 @@ func (m *methodMux) handle(method string, fn DirectMethodHandler) error {
 	return nil
 }
 
-// remove deregisters the named method.
-func (m *methodMux) remove(method string) {
+// handlePrefix registers fn for all methods starting with prefix.
+func (m *methodMux) handlePrefix(prefix string, fn DirectMethodHandler) error {
+	if fn == nil {
+		return fmt.Errorf("prefix %q handler is nil", prefix)
+	}
 	m.mu.Lock()
-	if m.m != nil {
-		delete(m.m, method)
+	defer m.mu.Unlock()
+	if m.p == nil {
+		m.p = map[string]TypedMethodHandler{}
 	}
-	m.mu.Unlock()
+	if _, ok := m.p[prefix]; ok {
+		return fmt.Errorf("prefix %q is already registered", prefix)
+	}
+	m.p[prefix] = typedHandler(fn)
+	return nil
+}
+
+// removePrefix deregisters the given prefix,
+// it reports whether the prefix was registered.
+func (m *methodMux) removePrefix(prefix string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.p[prefix]; !ok {
+		return false
+	}
+	delete(m.p, prefix)
+	return true
+}
+
+// lookup returns the handler of the named method, exact registrations
+// take precedence over prefixes and the longest matching prefix wins.
+func (m *methodMux) lookup(method string) (TypedMethodHandler, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if f, ok := m.m[method]; ok {
+		return f, true
+	}
+	var f TypedMethodHandler
+	n := -1
+	for prefix, pf := range m.p {
+		if len(prefix) > n && strings.HasPrefix(method, prefix) {
+			f, n = pf, len(prefix)
+		}
+	}
+	return f, f != nil
+}
+
+// remove deregisters the named method,
+// it reports whether the method was registered.
+func (m *methodMux) remove(method string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.m[method]; !ok {
+		return false
+	}
+	delete(m.m, method)
+	return true
 }
 
-// Dispatch dispatches the named method, error is not nil only when dispatching fails.
-func (m *methodMux) Dispatch(method string, b []byte) (int, []byte, error) {
+// names returns sorted names of registered methods.
+func (m *methodMux) names() []string {
 	m.mu.RLock()
-	f, ok := m.m[method]
+	s := make([]string, 0, len(m.m))
+	for name := range m.m {
+		s = append(s, name)
+	}
 	m.mu.RUnlock()
+	sort.Strings(s)
+	return s
+}
+
+// MethodRequest is metadata of a direct method invocation.
+type MethodRequest struct {
+	// Name is the method name exactly as it's sent by the service,
+	// IoT Plug and Play and IoT Central prefix commands of
+	// components with the component name: `{component}*{command}`.
+	Name string
+
+	// RequestID is the id the method response is correlated by.
+	RequestID string
+
+	// Properties are extra invocation properties provided by the service,
+	// e.g. W3C trace context, nil when there are none.
+	Properties map[string]string
+}
+
+// TraceParent returns the W3C traceparent header value
+// of the invocation when the service provides it.
+func (r *MethodRequest) TraceParent() string {
+	return r.Properties["traceparent"]
+}
+
+// Component returns the component name the command is addressed to,
+// it's empty for methods of the default component.
+func (r *MethodRequest) Component() string {
+	if i := strings.IndexByte(r.Name, '*'); i != -1 {
+		return r.Name[:i]
+	}
+	return ""
+}
+
+// Command returns the method name without the component prefix.
+func (r *MethodRequest) Command() string {
+	if i := strings.IndexByte(r.Name, '*'); i != -1 {
+		return r.Name[i+1:]
+	}
+	return r.Name
+}
+
+type methodRequestKey struct{}
+
+// MethodRequestFromContext returns metadata of the method invocation
+// from the context passed to a DirectMethodHandler.
+func MethodRequestFromContext(ctx context.Context) (*MethodRequest, bool) {
+	r, ok := ctx.Value(methodRequestKey{}).(*MethodRequest)
+	return r, ok
+}
+
+// MaxMethodPayloadSize is the maximum size of direct method request
+// and response payloads in bytes, IoT Hub rejects larger ones.
+//
+// Payloads are delivered in a single transport packet so they cannot be
+// streamed and both request and response are always fully buffered.
+const MaxMethodPayloadSize = 128 << 10
+
+// PayloadSizeError is returned when a payload exceeds its size limit.
+type PayloadSizeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *PayloadSizeError) Error() string {
+	return fmt.Sprintf("payload size %d exceeds the limit of %d bytes", e.Size, e.Limit)
+}
+
+// Is makes errors.Is match ErrMessageTooLarge.
+func (e *PayloadSizeError) Is(target error) bool {
+	return target == ErrMessageTooLarge
+}
+
+// Dispatch dispatches the named method, error is not nil only when dispatching
+// fails or the response timeout elapses, then nothing has to be responded.
+//
+// Requests larger than MaxMethodPayloadSize or the configured limit are
+// rejected with the 413 code without invoking the handler,
+// too large responses are replaced with an error.
+func (m *methodMux) Dispatch(req *transport.MethodRequest) (int, []byte, error) {
+	if m.observe == nil {
+		return m.dispatch(req)
+	}
+	start := m.now()
+	rc, b, err := m.dispatch(req)
+	m.observe(req.Name, start, rc)
+	return rc, b, err
+}
+
+func (m *methodMux) dispatch(req *transport.MethodRequest) (int, []byte, error) {
+	atomic.AddUint64(&m.invoked, 1)
+	method, b := req.Name, req.Payload
+	f, ok := m.lookup(method)
 	if !ok {
 		return 0, nil, fmt.Errorf("method %q is not registered", method)
 	}
+	limit := MaxMethodPayloadSize
+	if m.max != 0 && m.max < limit {
+		limit = m.max
+	}
+	if len(b) > limit {
+		return 413, errorBody(&PayloadSizeError{
+			Size:  len(b),
+			Limit: limit,
+		}), nil
+	}
 
-	var v map[string]interface{}
-	if err := json.Unmarshal(b, &v); err != nil {
-		return jsonErr(err)
+	r := &MethodRequest{
+		Name:       method,
+		RequestID:  req.RequestID,
+		Properties: req.Properties,
+	}
+	ctx := m.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx = context.WithValue(ctx, methodRequestKey{}, r)
+	if m.wrapCtx != nil {
+		ctx = m.wrapCtx(ctx, r)
+	}
+	if m.timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.timeout)
+		defer cancel()
+	}
+	if err := m.runs.add(); err != nil {
+		return 0, nil, err
+	}
+	defer m.runs.done()
+
+	// invocations aren't dropped when handlers fall behind like
+	// events may be, the caller waits for every response,
+	// so handlers are expected to return once ctx is done
+	rc, v, err := f(ctx, b)
+	if m.timeout != 0 && ctx.Err() == context.DeadlineExceeded {
+		return 0, nil, fmt.Errorf("method %q response timed out after %s, discarding it", method, m.timeout)
 	}
-	v, err := f(v)
 	if err != nil {
-		return jsonErr(err)
+		if rc == 0 {
+			rc = 500
+		}
+		return rc, errorBody(err), nil
+	}
+	if rc == 0 {
+		rc = 200
 	}
 	if v == nil {
 		v = map[string]interface{}{}
@@ -258,9 +638,35 @@ func (m *methodMux) Dispatch(method string, b []byte) (int, []byte, error) {
 	if err != nil {
 		return jsonErr(err)
 	}
-	return 200, b, nil
+	if len(b) > MaxMethodPayloadSize {
+		return jsonErr(&PayloadSizeError{
+			Size:  len(b),
+			Limit: MaxMethodPayloadSize,
+		})
+	}
+	return rc, b, nil
+}
+
+// typedHandler adapts fn to TypedMethodHandler, the payload is decoded into
+// a map and successful invocations are responded with the 200 code.
+func typedHandler(fn DirectMethodHandler) TypedMethodHandler {
+	return func(ctx context.Context, payload json.RawMessage) (int, interface{}, error) {
+		var v map[string]interface{}
+		if err := json.Unmarshal(payload, &v); err != nil {
+			return 0, nil, err
+		}
+		v, err := fn(ctx, v)
+		if err != nil {
+			return 0, nil, err
+		}
+		return 200, v, nil
+	}
 }
 
 func jsonErr(err error) (int, []byte, error) {
-	return 500, []byte(fmt.Sprintf(`{"error":%q}`, err.Error())), nil
+	return 500, errorBody(err), nil
+}
+
+func errorBody(err error) []byte {
+	return []byte(fmt.Sprintf(`{"error":%q}`, err.Error()))
 }
@@ -2,9 +2,17 @@ package iotdevice
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
 )
 
 func TestEventsMuxSub(t *testing.T) {
@@ -17,7 +25,7 @@ func TestEventsMuxSub(t *testing.T) {
 	if !bytes.Equal(msg.Payload, []byte("hello")) {
 		t.Fatalf("invalid payload = %v, want %v", msg.Payload, []byte("hello"))
 	}
-	mux.unsub(sub)
+	mux.unsub(sub, nil)
 	mux.Dispatch(&common.Message{
 		Payload: []byte("hello"),
 	})
@@ -47,9 +55,104 @@ func TestEventsMuxClose(t *testing.T) {
 	}
 }
 
+func TestEventSubNext(t *testing.T) {
+	mux := newEventsMux()
+	sub := mux.sub()
+	mux.Dispatch(&common.Message{Payload: []byte("hello")})
+
+	msg, err := sub.Next(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.Payload, []byte("hello")) {
+		t.Fatalf("invalid payload = %v, want %v", msg.Payload, []byte("hello"))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = sub.Next(ctx); err != context.Canceled {
+		t.Fatalf("Next err = %v, want %v", err, context.Canceled)
+	}
+
+	mux.close(ErrClosed)
+	if _, err = sub.Next(context.Background()); err != ErrClosed {
+		t.Fatalf("Next err = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestTwinStateMuxDispatch(t *testing.T) {
+	mux := newTwinStateMux()
+	sub := mux.sub()
+	mux.Dispatch([]byte(`{"a":1,"$version":2}`))
+	mux.Dispatch([]byte(`{"b":1,"$version":3}`))
+	for _, w := range []int{2, 3} {
+		if v := (<-sub.C()).Version(); v != w {
+			t.Fatalf("version = %d, want %d", v, w)
+		}
+	}
+
+	// resync delivers only states that are newer than the last dispatched
+	if mux.dispatch(TwinState{"$version": float64(3)}, true) {
+		t.Fatal("stale state dispatched")
+	}
+	if !mux.dispatch(TwinState{"$version": float64(4)}, true) {
+		t.Fatal("newer state not dispatched")
+	}
+	if v := (<-sub.C()).Version(); v != 4 {
+		t.Fatalf("version = %d, want %d", v, 4)
+	}
+
+	mux.close(ErrClosed)
+	if err := sub.Err(); err != ErrClosed {
+		t.Fatalf("closed mux sub err = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestTwinStateMuxDropOldest(t *testing.T) {
+	mux := newTwinStateMux()
+	sub := mux.sub()
+
+	// nobody reads the subscription, so dispatching must not block
+	n := cap(sub.ch) + 2
+	for i := 1; i <= n; i++ {
+		mux.dispatch(TwinState{"$version": float64(i)}, false)
+	}
+	if d := atomic.LoadUint64(&mux.dropped); d != 2 {
+		t.Fatalf("dropped = %d, want %d", d, 2)
+	}
+	for want := 3; want <= n; want++ {
+		if v := (<-sub.C()).Version(); v != want {
+			t.Fatalf("version = %d, want %d", v, want)
+		}
+	}
+}
+
+func TestTwinStateMuxRemoved(t *testing.T) {
+	mux := newTwinStateMux()
+	sub := mux.sub()
+	mux.Dispatch([]byte(`{"a":null,"b":{"c":null,"d":1,"e":{"f":null}},"g":2,"$version":5}`))
+	s := <-sub.C()
+	if v := s.Version(); v != 5 {
+		t.Fatalf("version = %d, want %d", v, 5)
+	}
+	want := []string{"a", "b.c", "b.e.f"}
+	if r := s.Removed(); !reflect.DeepEqual(r, want) {
+		t.Fatalf("Removed() = %v, want %v", r, want)
+	}
+	if _, ok := s["g"]; !ok {
+		t.Fatal("set property is missing")
+	}
+	if _, ok := s["h"]; ok {
+		t.Fatal("absent property is present")
+	}
+	if r := (TwinState{"a": 1, "$version": 6}).Removed(); len(r) != 0 {
+		t.Fatalf("Removed() = %v, want none", r)
+	}
+}
+
 func TestMethodMux(t *testing.T) {
 	m := methodMux{}
-	if err := m.handle("add", func(v map[string]interface{}) (map[string]interface{}, error) {
+	if err := m.handle("add", func(_ context.Context, v map[string]interface{}) (map[string]interface{}, error) {
 		v["b"] = 2
 		return v, nil
 	}); err != nil {
@@ -57,7 +160,7 @@ func TestMethodMux(t *testing.T) {
 	}
 	defer m.remove("add")
 
-	rc, data, err := m.Dispatch("add", []byte(`{"a":1}`))
+	rc, data, err := m.Dispatch(&transport.MethodRequest{Name: "add", RequestID: "1", Payload: []byte(`{"a":1}`)})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -69,3 +172,279 @@ func TestMethodMux(t *testing.T) {
 		t.Errorf("data = %q, want %q", data, w)
 	}
 }
+
+func TestMethodMuxTyped(t *testing.T) {
+	m := newMethodMux(context.Background())
+	m.timeout = time.Minute
+	type req struct {
+		Level int `json:"level"`
+	}
+	if err := m.handleTyped("set", func(ctx context.Context, p json.RawMessage) (int, interface{}, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			return 500, nil, errors.New("no deadline")
+		}
+		var r req
+		if err := json.Unmarshal(p, &r); err != nil {
+			return 400, nil, err
+		}
+		if r.Level > 10 {
+			return 400, nil, errors.New("level is out of range")
+		}
+		return 202, &r, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, v := range []struct {
+		payload string
+		rc      int
+		body    string
+	}{
+		{`{"level":5}`, 202, `{"level":5}`},
+		{`{"level":11}`, 400, `{"error":"level is out of range"}`},
+	} {
+		rc, b, err := m.Dispatch(&transport.MethodRequest{Name: "set", RequestID: "1", Payload: []byte(v.payload)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rc != v.rc || string(b) != v.body {
+			t.Errorf("Dispatch(%s) = %d, %s, want %d, %s", v.payload, rc, b, v.rc, v.body)
+		}
+	}
+}
+
+func TestMethodMuxResponseTimeout(t *testing.T) {
+	m := newMethodMux(context.Background())
+	m.timeout = 10 * time.Millisecond
+	if err := m.handle("wait", func(ctx context.Context, v map[string]interface{}) (map[string]interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handle("slow", func(ctx context.Context, v map[string]interface{}) (map[string]interface{}, error) {
+		time.Sleep(20 * time.Millisecond)
+		return v, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"wait", "slow"} {
+		if _, b, err := m.Dispatch(&transport.MethodRequest{Name: name, RequestID: "1", Payload: []byte(`{}`)}); err == nil {
+			t.Errorf("%s responded with %s after the timeout", name, b)
+		}
+	}
+}
+
+func TestMethodMuxNames(t *testing.T) {
+	m := newMethodMux(context.Background())
+	if names := m.names(); len(names) != 0 {
+		t.Fatalf("names() = %v, want none", names)
+	}
+	fn := func(context.Context, map[string]interface{}) (map[string]interface{}, error) {
+		return nil, nil
+	}
+	for _, name := range []string{"reboot", "ping", "update"} {
+		if err := m.handle(name, fn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.remove("update")
+	if names := m.names(); !reflect.DeepEqual(names, []string{"ping", "reboot"}) {
+		t.Fatalf("names() = %v, want %v", names, []string{"ping", "reboot"})
+	}
+}
+
+func TestMethodMuxNilHandler(t *testing.T) {
+	m := methodMux{}
+	if err := m.handle("add", nil); err == nil {
+		t.Fatal("nil handler registered without an error")
+	}
+	if _, _, err := m.Dispatch(&transport.MethodRequest{Name: "add", RequestID: "1", Payload: []byte(`{}`)}); err == nil {
+		t.Fatal("dispatched not registered method")
+	}
+}
+
+func TestMethodMuxPayloadSize(t *testing.T) {
+	m := methodMux{}
+	if err := m.handle("echo", func(_ context.Context, v map[string]interface{}) (map[string]interface{}, error) {
+		return v, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	b := []byte(`{"a":"` + strings.Repeat("a", MaxMethodPayloadSize) + `"}`)
+	rc, _, err := m.Dispatch(&transport.MethodRequest{Name: "echo", RequestID: "1", Payload: b})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rc != 413 {
+		t.Errorf("rc = %d, want %d", rc, 413)
+	}
+}
+
+func TestMethodMuxClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := newMethodMux(ctx)
+	if err := m.handle("wait", func(ctx context.Context, v map[string]interface{}) (map[string]interface{}, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, _, err := m.Dispatch(&transport.MethodRequest{Name: "wait", RequestID: "1", Payload: []byte(`{}`)}); err != nil {
+			t.Error(err)
+		}
+	}()
+	cancel()
+	<-done
+}
+
+func TestMethodRequestFromContext(t *testing.T) {
+	m := newMethodMux(context.Background())
+	var req *MethodRequest
+	if err := m.handle("thermostat*reboot", func(
+		ctx context.Context, p map[string]interface{},
+	) (map[string]interface{}, error) {
+		req, _ = MethodRequestFromContext(ctx)
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.Dispatch(&transport.MethodRequest{Name: "thermostat*reboot", RequestID: "7", Payload: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	if req == nil {
+		t.Fatal("method request is not in the context")
+	}
+	if req.RequestID != "7" || req.Component() != "thermostat" || req.Command() != "reboot" {
+		t.Fatalf("request = %#v, component = %q, command = %q",
+			req, req.Component(), req.Command())
+	}
+}
+
+type ctxKey struct{}
+
+func TestMethodMuxContext(t *testing.T) {
+	m := newMethodMux(context.Background())
+	m.wrapCtx = func(ctx context.Context, r *MethodRequest) context.Context {
+		return context.WithValue(ctx, ctxKey{}, r.RequestID+" "+r.TraceParent())
+	}
+	var tag interface{}
+	if err := m.handle("ping", func(
+		ctx context.Context, p map[string]interface{},
+	) (map[string]interface{}, error) {
+		tag = ctx.Value(ctxKey{})
+		return nil, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.Dispatch(&transport.MethodRequest{
+		Name:      "ping",
+		RequestID: "3",
+		Properties: map[string]string{
+			"traceparent": "00-abc-def-01",
+		},
+		Payload: []byte(`{}`),
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := "3 00-abc-def-01"; tag != want {
+		t.Fatalf("tag = %v, want %q", tag, want)
+	}
+}
+
+func TestMethodMuxPrefix(t *testing.T) {
+	m := newMethodMux(context.Background())
+	handler := func(tag string) DirectMethodHandler {
+		return func(ctx context.Context, _ map[string]interface{}) (map[string]interface{}, error) {
+			r, _ := MethodRequestFromContext(ctx)
+			return map[string]interface{}{"tag": tag, "name": r.Name}, nil
+		}
+	}
+	if err := m.handlePrefix("sensor/", handler("sensor")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handlePrefix("sensor/temp/", handler("temp")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handle("sensor/temp/reset", handler("reset")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.handlePrefix("sensor/", handler("sensor")); err == nil {
+		t.Fatal("duplicate prefix registered without an error")
+	}
+
+	for name, want := range map[string]string{
+		"sensor/humidity/read": `{"name":"sensor/humidity/read","tag":"sensor"}`,
+		"sensor/temp/read":     `{"name":"sensor/temp/read","tag":"temp"}`,
+		"sensor/temp/reset":    `{"name":"sensor/temp/reset","tag":"reset"}`,
+	} {
+		_, b, err := m.Dispatch(&transport.MethodRequest{Name: name, RequestID: "1", Payload: []byte(`{}`)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("%s = %s, want %s", name, b, want)
+		}
+	}
+
+	m.removePrefix("sensor/")
+	if _, _, err := m.Dispatch(&transport.MethodRequest{Name: "sensor/humidity/read", RequestID: "1", Payload: []byte(`{}`)}); err == nil {
+		t.Fatal("dispatched method of removed prefix")
+	}
+}
+
+func TestMuxSizeLimits(t *testing.T) {
+	var rejected []*PayloadSizeError
+	reject := func(err *PayloadSizeError) {
+		rejected = append(rejected, err)
+	}
+
+	ev := newEventsMux()
+	ev.max, ev.reject = 4, reject
+	sub := ev.sub()
+	ev.Dispatch(&common.Message{Payload: []byte("hello")})
+	ev.Dispatch(&common.Message{Payload: []byte("hi")})
+	if msg := <-sub.C(); string(msg.Payload) != "hi" {
+		t.Fatalf("payload = %q, want %q", msg.Payload, "hi")
+	}
+
+	ts := newTwinStateMux()
+	ts.max, ts.reject = 16, reject
+	ts.Dispatch([]byte(`{"a":"aaaaaaaaaaaaaaaa"}`))
+
+	want := []*PayloadSizeError{{Size: 5, Limit: 4}, {Size: 24, Limit: 16}}
+	if !reflect.DeepEqual(rejected, want) {
+		t.Fatalf("rejected = %v, want %v", rejected, want)
+	}
+
+	m := newMethodMux(context.Background())
+	m.max = 8
+	if err := m.handle("echo", func(_ context.Context, v map[string]interface{}) (map[string]interface{}, error) {
+		return v, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if rc, _, err := m.Dispatch(&transport.MethodRequest{Name: "echo", RequestID: "1", Payload: []byte(`{"a":"bbbb"}`)}); err != nil || rc != 413 {
+		t.Fatalf("rc = %d, err = %v, want 413", rc, err)
+	}
+}
+
+func TestEventsMuxDropOldest(t *testing.T) {
+	mux := newEventsMux()
+	sub := mux.sub(WithSubscribeDropOldest())
+	n := cap(sub.ch) + 2
+	for i := 0; i < n; i++ {
+		mux.Dispatch(&common.Message{Payload: []byte{byte(i)}})
+	}
+	if d := atomic.LoadUint64(&mux.dropped); d != 2 {
+		t.Fatalf("dropped = %d, want %d", d, 2)
+	}
+	if msg := <-sub.C(); msg.Payload[0] != 2 {
+		t.Fatalf("oldest message = %d, want %d", msg.Payload[0], 2)
+	}
+}
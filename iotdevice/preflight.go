@@ -0,0 +1,94 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// PreflightStep is a capability checked by Preflight.
+type PreflightStep string
+
+const (
+	PreflightConnect       PreflightStep = "connect"
+	PreflightTwinSubscribe PreflightStep = "twin subscribe"
+	PreflightMethods       PreflightStep = "methods subscribe"
+	PreflightTwinRetrieve  PreflightStep = "twin retrieve"
+)
+
+// PreflightReason is a failure class of a preflight step.
+type PreflightReason string
+
+const (
+	PreflightAuth       PreflightReason = "auth"       // invalid credentials or disabled device
+	PreflightNetwork    PreflightReason = "network"    // the hub is unreachable or doesn't respond
+	PreflightPermission PreflightReason = "permission" // the operation is denied
+)
+
+// PreflightError is returned by Preflight, it tells
+// the failed step, its failure class and the cause.
+type PreflightError struct {
+	Step   PreflightStep
+	Reason PreflightReason
+	Err    error
+}
+
+func (e *PreflightError) Error() string {
+	return fmt.Sprintf("preflight %s failed (%s): %s", e.Step, e.Reason, e.Err)
+}
+
+func (e *PreflightError) Unwrap() error {
+	return e.Err
+}
+
+// Preflight checks that the device can connect, subscribe to twin updates
+// and direct methods and retrieve its twin, connecting first unless the
+// client is connected, and returns *PreflightError at the first failure.
+//
+// It's meant to be called once on startup to diagnose misconfigured devices
+// right away instead of when a feature is used for the first time.
+// Subscriptions it makes are kept like the ones made by the client methods.
+func (c *Client) Preflight(ctx context.Context) error {
+	if ctx == nil {
+		return errNilContext
+	}
+	if !c.Connected() {
+		if err := c.Connect(ctx); err != nil {
+			return preflightError(PreflightConnect, err)
+		}
+	}
+	sub, err := c.SubscribeTwinUpdates(ctx)
+	if err != nil {
+		return preflightError(PreflightTwinSubscribe, err)
+	}
+	c.UnsubscribeTwinUpdates(sub)
+	if err = c.dmMux.once(func() error {
+		return c.tr.RegisterDirectMethods(ctx, c.dmMux)
+	}); err != nil {
+		return preflightError(PreflightMethods, err)
+	}
+	if _, _, err = c.RetrieveTwinState(ctx); err != nil {
+		return preflightError(PreflightTwinRetrieve, err)
+	}
+	return nil
+}
+
+// preflightError classifies err of the given step, connection
+// refusals are auth failures, timeouts and network errors are network
+// failures and other errors of operations are considered denials.
+func preflightError(step PreflightStep, err error) *PreflightError {
+	reason := PreflightPermission
+	var cerr *ConnectError
+	var nerr net.Error
+	switch {
+	case errors.As(err, &cerr) && !cerr.Temporary():
+		reason = PreflightAuth
+	case errors.As(err, &cerr), errors.As(err, &nerr),
+		errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrTwinTimeout):
+		reason = PreflightNetwork
+	case step == PreflightConnect:
+		reason = PreflightNetwork
+	}
+	return &PreflightError{Step: step, Reason: reason, Err: err}
+}
@@ -0,0 +1,66 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+// preflightTransport fails connecting with connErr and twin retrievals with twinErr.
+type preflightTransport struct {
+	fakeTransport
+	connErr error
+	twinErr error
+}
+
+func (tr *preflightTransport) Connect(ctx context.Context, creds transport.Credentials) error {
+	return tr.connErr
+}
+
+func (tr *preflightTransport) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
+	if tr.twinErr != nil {
+		return nil, tr.twinErr
+	}
+	return tr.fakeTransport.RetrieveTwinProperties(ctx)
+}
+
+func TestPreflight(t *testing.T) {
+	for _, v := range []struct {
+		tr     *preflightTransport
+		step   PreflightStep
+		reason PreflightReason
+	}{
+		{&preflightTransport{}, "", ""},
+		{
+			&preflightTransport{connErr: &ConnectError{Code: 4, Err: ErrUnauthorized}},
+			PreflightConnect, PreflightAuth,
+		},
+		{
+			&preflightTransport{connErr: errors.New("dial tcp: i/o timeout")},
+			PreflightConnect, PreflightNetwork,
+		},
+		{
+			&preflightTransport{twinErr: errors.New("forbidden")},
+			PreflightTwinRetrieve, PreflightPermission,
+		},
+	} {
+		c, err := New(WithTransport(v.tr), WithConnectionString(testConnectionString))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.Preflight(context.Background())
+		c.Close()
+		if v.step == "" {
+			if err != nil {
+				t.Errorf("Preflight = %v, want nil", err)
+			}
+			continue
+		}
+		var perr *PreflightError
+		if !errors.As(err, &perr) || perr.Step != v.step || perr.Reason != v.reason {
+			t.Errorf("Preflight = %v, want %s step failed with %s", err, v.step, v.reason)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package iotdevice
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/iothub/internal/clock"
+)
+
+// rateLimiter is a token bucket which rate is tuned
+// additively up on successful sends and multiplicatively
+// down on throttling, converging to the hub's quota.
+type rateLimiter struct {
+	mu     sync.Mutex
+	clk    clock.Clock
+	min    float64
+	max    float64
+	rate   float64 // messages per second
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(clk clock.Clock, min, max float64) *rateLimiter {
+	return &rateLimiter{
+		clk:    clk,
+		min:    min,
+		max:    max,
+		rate:   max,
+		tokens: 1,
+		last:   clk.Now(),
+	}
+}
+
+// wait blocks until a message can be sent or ctx is done.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		l.refill()
+		if l.tokens >= 1 {
+			l.tokens--
+			l.mu.Unlock()
+			return nil
+		}
+		d := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		l.mu.Unlock()
+
+		select {
+		case <-l.clk.After(d):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// refill adds tokens accumulated since the last call,
+// bursts are limited to one second worth of messages.
+func (l *rateLimiter) refill() {
+	now := l.clk.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	burst := l.rate
+	if burst < 1 {
+		burst = 1
+	}
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+}
+
+// throttled halves the rate down to the minimum.
+func (l *rateLimiter) throttled() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if l.rate /= 2; l.rate < l.min {
+		l.rate = l.min
+	}
+}
+
+// succeeded ramps the rate up by a hundredth of the maximum.
+func (l *rateLimiter) succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill()
+	if l.rate += l.max / 100; l.rate > l.max {
+		l.rate = l.max
+	}
+}
+
+// current returns the currently allowed rate.
+func (l *rateLimiter) current() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
@@ -0,0 +1,57 @@
+package iotdevice
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/internal/clock"
+)
+
+func TestRateLimiter(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	l := newRateLimiter(clk, 1, 10)
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the bucket is empty so the next send has to wait
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx); err != context.Canceled {
+		t.Fatalf("wait = %v, want %v", err, context.Canceled)
+	}
+
+	l.throttled()
+	l.throttled()
+	if r := l.current(); r != 2.5 {
+		t.Fatalf("rate = %v, want %v", r, 2.5)
+	}
+	for i := 0; i < 10; i++ {
+		l.throttled()
+	}
+	if r := l.current(); r != 1 {
+		t.Fatalf("rate = %v, want the minimum %v", r, 1)
+	}
+	l.succeeded()
+	if r := l.current(); r != 1.1 {
+		t.Fatalf("rate = %v, want %v", r, 1.1)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- l.wait(context.Background())
+	}()
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clk.Advance(time.Second)
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait is not released")
+	}
+}
@@ -0,0 +1,313 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Default reconnect backoff bounds, see WithReconnectBackoff.
+const (
+	DefaultReconnectMinBackoff = time.Second
+	DefaultReconnectMaxBackoff = 30 * time.Second
+)
+
+var (
+	// ErrReconnectTimeout is the client's terminal error when
+	// it fails to reconnect within the reconnect timeout.
+	ErrReconnectTimeout = errors.New("reconnect timed out")
+
+	// ErrReconnectAttempts is the client's terminal error when
+	// it exhausts the maximum number of reconnect attempts.
+	ErrReconnectAttempts = errors.New("reconnect attempts exhausted")
+
+	// ErrReconnecting is wrapped by errors of sends failed
+	// because the connection is lost while they're in flight,
+	// sends made while the client is reconnecting wait for it.
+	ErrReconnecting = errors.New("reconnecting")
+)
+
+// RetryPolicy configures reconnects, zero fields take default values.
+type RetryPolicy struct {
+	// InitialInterval is the delay ceiling of the first attempt,
+	// defaults to DefaultReconnectMinBackoff.
+	InitialInterval time.Duration
+
+	// MaxInterval caps the delay ceiling,
+	// defaults to DefaultReconnectMaxBackoff.
+	MaxInterval time.Duration
+
+	// Multiplier the delay ceiling is multiplied by
+	// after every failed attempt, defaults to 2.
+	Multiplier float64
+
+	// MaxAttempts limits the number of attempts, when they're exhausted
+	// the client is closed with ErrReconnectAttempts, zero is unlimited.
+	MaxAttempts int
+}
+
+// WithAutoReconnect sets the policy of reconnecting after connection losses,
+// delays are picked randomly up to the current ceiling (full jitter).
+//
+// Transports that let the client reconnect are always reconnected with
+// the default policy unless this option is given, once the connection is
+// restored event and twin subscriptions and direct methods are resubscribed
+// by the transport and operations waiting for the connection proceed.
+//
+// It cannot be combined with WithReconnectBackoff.
+func WithAutoReconnect(p RetryPolicy) ClientOption {
+	return func(c *Client) error {
+		if c.backoff.set {
+			return errors.New("reconnect policy is already set")
+		}
+		c.backoff.set = true
+		if p.InitialInterval < 0 || p.MaxInterval < 0 || p.Multiplier < 0 || p.MaxAttempts < 0 {
+			return errors.New("retry policy values must not be negative")
+		}
+		if p.InitialInterval != 0 {
+			c.backoff.min = p.InitialInterval
+		}
+		if p.MaxInterval != 0 {
+			c.backoff.max = p.MaxInterval
+		}
+		if c.backoff.max < c.backoff.min {
+			return errors.New("max interval must not be less than initial interval")
+		}
+		if p.Multiplier != 0 {
+			if p.Multiplier < 1 {
+				return errors.New("multiplier must not be less than one")
+			}
+			c.backoff.mult = p.Multiplier
+		}
+		c.backoff.maxAttempts = p.MaxAttempts
+		return nil
+	}
+}
+
+// WithReconnectBackoff sets bounds of the delay between reconnect attempts,
+// it's WithAutoReconnect with only the intervals set and it cannot be
+// combined with it, use RetryPolicy to change other parameters too.
+//
+// The delay ceiling doubles every attempt starting from min up to max and
+// the actual delay is picked randomly between zero and the ceiling (full
+// jitter), so fleets of devices disconnected at once don't reconnect in sync.
+// It starts over from min once the connection is confirmed healthy by
+// a successful send or twin operation, until then a flapping connection
+// keeps backing off across reconnects.
+//
+// It has effect only with transports that let the client
+// reconnect, others keep reconnecting on their own.
+func WithReconnectBackoff(min, max time.Duration) ClientOption {
+	return func(c *Client) error {
+		if min <= 0 || max < min {
+			return errors.New("backoff bounds must be positive and min must not exceed max")
+		}
+		return WithAutoReconnect(RetryPolicy{
+			InitialInterval: min,
+			MaxInterval:     max,
+		})(c)
+	}
+}
+
+// WithReconnectTimeout limits the total time spent reconnecting after
+// a connection loss, when it's exceeded the client is closed and Err
+// returns ErrReconnectTimeout, an attempt in progress is cut off
+// when the timeout is reached. Refusals that cannot be fixed by
+// retrying close the client immediately, see ConnectError.
+//
+// By default the client keeps reconnecting until it's closed.
+func WithReconnectTimeout(d time.Duration) ClientOption {
+	return func(c *Client) error {
+		if d <= 0 {
+			return errors.New("reconnect timeout must be positive")
+		}
+		c.backoff.timeout = d
+		return nil
+	}
+}
+
+// backoff is exponential backoff with full jitter tracking the state of
+// reconnects, attempts are accumulated until the connection is confirmed
+// healthy by a successful operation, so flapping connections keep
+// backing off and the first blip after recovering is retried quickly.
+type backoff struct {
+	dirty int32 // atomic, 1 when attempts need to be reset
+
+	set         bool // the policy is set by an option, it's given once
+	min         time.Duration
+	max         time.Duration
+	mult        float64
+	maxAttempts int           // zero is unlimited
+	timeout     time.Duration // total reconnect time limit, zero is unlimited
+	jitter      func(d time.Duration) time.Duration
+
+	mu       sync.Mutex
+	active   bool          // a reconnect loop is running
+	attempts int           // attempts since the connection was last healthy
+	delay    time.Duration // the current delay
+}
+
+func newBackoff() *backoff {
+	return &backoff{
+		min:    DefaultReconnectMinBackoff,
+		max:    DefaultReconnectMaxBackoff,
+		mult:   2,
+		jitter: fullJitter,
+	}
+}
+
+func fullJitter(d time.Duration) time.Duration {
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// start marks the beginning of a reconnect loop,
+// it reports false when one is already running.
+func (b *backoff) start() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.active {
+		return false
+	}
+	b.active = true
+	return true
+}
+
+// next returns the delay before the next attempt,
+// ok is false when attempts are exhausted.
+func (b *backoff) next() (d time.Duration, ok bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.maxAttempts != 0 && b.attempts >= b.maxAttempts {
+		return 0, false
+	}
+	ceil := float64(b.min) * math.Pow(b.mult, float64(b.attempts))
+	if ceil > float64(b.max) {
+		ceil = float64(b.max)
+	}
+	b.attempts++
+	atomic.StoreInt32(&b.dirty, 1)
+	b.delay = b.jitter(time.Duration(ceil))
+	return b.delay, true
+}
+
+// reconnecting reports whether a reconnect loop is running.
+func (b *backoff) reconnecting() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active
+}
+
+// stop marks the end of the reconnect loop.
+func (b *backoff) stop() {
+	b.mu.Lock()
+	b.active = false
+	b.delay = 0
+	b.mu.Unlock()
+}
+
+// reset forgets attempts when no reconnect loop is running, it's called
+// after successful operations and it's cheap when there's nothing to reset.
+func (b *backoff) reset() {
+	if atomic.LoadInt32(&b.dirty) == 0 {
+		return
+	}
+	b.mu.Lock()
+	if !b.active {
+		b.attempts = 0
+		atomic.StoreInt32(&b.dirty, 0)
+	}
+	b.mu.Unlock()
+}
+
+func (b *backoff) state() (active bool, attempts int, delay time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.active, b.attempts, b.delay
+}
+
+// connectionLost is called by the transport when the connection drops.
+func (c *Client) connectionLost(err error) {
+	c.logger.Warnf("connection lost: %s", err)
+	c.setLastError(err)
+	if !c.backoff.start() {
+		return
+	}
+	c.setReady(false)
+	c.state.notify(false, err, false)
+	go c.reconnect()
+}
+
+// reconnect connects the transport again until it succeeds, the client
+// is closed, a permanent refusal is received or the timeout is exceeded.
+func (c *Client) reconnect() {
+	defer c.backoff.stop()
+	start := c.clock.Now()
+	for {
+		d, ok := c.backoff.next()
+		if !ok {
+			c.logger.Errorf("giving up reconnecting after %d attempts", c.backoff.maxAttempts)
+			c.close(ErrReconnectAttempts)
+			return
+		}
+		if c.backoff.timeout != 0 && c.clock.Now().Add(d).Sub(start) > c.backoff.timeout {
+			c.logger.Errorf("giving up reconnecting after %s", c.clock.Now().Sub(start))
+			c.close(ErrReconnectTimeout)
+			return
+		}
+		select {
+		case <-c.clock.After(d):
+		case <-c.done:
+			return
+		}
+
+		ctx, cancel := c.attemptContext(start)
+		err := c.tr.Connect(ctx, c.creds)
+		cancel()
+		select {
+		case <-c.done:
+			return
+		default:
+		}
+		if err == nil {
+			c.logger.Infof("reconnected")
+			if c.metrics != nil {
+				c.metrics.Reconnected()
+			}
+			c.setReady(true)
+			c.state.notify(true, nil, false)
+			return
+		}
+		var cerr *ConnectError
+		if errors.As(err, &cerr) && !cerr.Temporary() {
+			c.logger.Errorf("reconnect refused: %s", err)
+			c.close(err)
+			return
+		}
+		c.setLastError(err)
+		c.logger.Warnf("reconnect error: %s", err)
+	}
+}
+
+// attemptContext returns the context of a reconnect attempt, it's
+// done when the rest of the reconnect timeout passes or on close.
+func (c *Client) attemptContext(start time.Time) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if c.backoff.timeout != 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), c.backoff.timeout-c.clock.Now().Sub(start))
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+	go func() {
+		select {
+		case <-c.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -0,0 +1,281 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/internal/clock"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+func TestBackoff(t *testing.T) {
+	b := newBackoff()
+	b.min, b.max = time.Second, 4*time.Second
+	b.jitter = func(d time.Duration) time.Duration { return d }
+	for i, w := range []time.Duration{
+		time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second,
+	} {
+		if d, _ := b.next(); d != w {
+			t.Fatalf("attempt %d delay = %s, want %s", i+1, d, w)
+		}
+	}
+
+	b = newBackoff()
+	b.min, b.max, b.mult, b.maxAttempts = time.Second, 10*time.Second, 3, 3
+	b.jitter = func(d time.Duration) time.Duration { return d }
+	for i, w := range []time.Duration{
+		time.Second, 3 * time.Second, 9 * time.Second,
+	} {
+		if d, ok := b.next(); !ok || d != w {
+			t.Fatalf("attempt %d delay = %s, %t, want %s", i+1, d, ok, w)
+		}
+	}
+	if _, ok := b.next(); ok {
+		t.Fatal("attempts are not exhausted")
+	}
+
+	for i := 0; i < 100; i++ {
+		if d := fullJitter(time.Second); d < 0 || d > time.Second {
+			t.Fatalf("jitter = %s, want within [0, %s]", d, time.Second)
+		}
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	b := newBackoff()
+	b.jitter = func(d time.Duration) time.Duration { return d }
+
+	// a reconnect that succeeds doesn't reset the backoff by itself
+	for i := 0; i < 2; i++ {
+		b.start()
+		b.next()
+		b.stop()
+	}
+	b.start()
+	if d, _ := b.next(); d != 4*time.Second {
+		t.Fatalf("delay = %s, want %s", d, 4*time.Second)
+	}
+	b.reset() // ignored while reconnecting
+	b.stop()
+
+	b.reset()
+	b.start()
+	if d, _ := b.next(); d != time.Second {
+		t.Fatalf("delay after reset = %s, want %s", d, time.Second)
+	}
+}
+
+// lossTransport is a fakeTransport that lets the client reconnect,
+// reconnects fail with errs in order and then with last if it's set.
+type lossTransport struct {
+	fakeTransport
+	lost     func(err error)
+	connects int32
+	errs     []error
+	last     error
+}
+
+func (tr *lossTransport) SetConnectionLostHandler(fn func(err error)) {
+	tr.lost = fn
+}
+
+func (tr *lossTransport) Connect(ctx context.Context, creds transport.Credentials) error {
+	n := int(atomic.AddInt32(&tr.connects, 1))
+	if n == 1 {
+		return nil
+	}
+	if n-2 < len(tr.errs) {
+		return tr.errs[n-2]
+	}
+	return tr.last
+}
+
+// advanceUntil advances clk by step whenever there's a pending timer until fn is true.
+func advanceUntil(t *testing.T, clk *clock.Fake, step time.Duration, fn func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		if clk.Waiters() != 0 {
+			clk.Advance(step)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	tr := &lossTransport{errs: []error{errors.New("network error")}}
+	c := newTestClient(t, tr)
+	defer c.Close()
+	clk := clock.NewFake(time.Now())
+	c.clock = clk
+	c.backoff.jitter = func(d time.Duration) time.Duration { return d }
+
+	tr.lost(errors.New("eof"))
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s := c.Stats()
+	if !s.Reconnecting || s.ReconnectAttempts != 1 || s.ReconnectBackoff != time.Second {
+		t.Fatalf("Stats() = %#v", s)
+	}
+	ready := make(chan error, 1)
+	go func() {
+		ready <- c.WaitReady(context.Background())
+	}()
+	select {
+	case err := <-ready:
+		t.Fatalf("WaitReady() = %v while reconnecting", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	advanceUntil(t, clk, time.Second, func() bool {
+		return !c.Stats().Reconnecting
+	})
+	if n := atomic.LoadInt32(&tr.connects); n != 1+2 {
+		t.Fatalf("connects = %d, want %d", n, 1+2)
+	}
+	if err := <-ready; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReconnectTimeout(t *testing.T) {
+	tr := &lossTransport{last: errors.New("network error")}
+	c := newTestClient(t, tr,
+		WithReconnectBackoff(time.Second, 4*time.Second),
+		WithReconnectTimeout(10*time.Second),
+	)
+	defer c.Close()
+	clk := clock.NewFake(time.Now())
+	c.clock = clk
+	c.backoff.jitter = func(d time.Duration) time.Duration { return d }
+
+	// delays are 1s, 2s, 4s and the next 4s exceeds the timeout
+	tr.lost(errors.New("eof"))
+	advanceUntil(t, clk, time.Second, func() bool {
+		return c.Err() != nil
+	})
+	if err := c.Err(); err != ErrReconnectTimeout {
+		t.Fatalf("Err() = %v, want %v", err, ErrReconnectTimeout)
+	}
+	if n := atomic.LoadInt32(&tr.connects); n != 1+3 {
+		t.Fatalf("connects = %d, want %d", n, 1+3)
+	}
+	if ok, err := c.State(); ok || err != ErrReconnectTimeout {
+		t.Fatalf("State() = %t, %v, want false, %v", ok, err, ErrReconnectTimeout)
+	}
+}
+
+func TestReconnectRefused(t *testing.T) {
+	tr := &lossTransport{last: &ConnectError{Code: 5, Err: ErrDeviceDisabled}}
+	c := newTestClient(t, tr)
+	defer c.Close()
+	clk := clock.NewFake(time.Now())
+	c.clock = clk
+
+	tr.lost(errors.New("eof"))
+	advanceUntil(t, clk, DefaultReconnectMaxBackoff, func() bool {
+		return c.Err() != nil
+	})
+	if err := c.Err(); !errors.Is(err, ErrDeviceDisabled) {
+		t.Fatalf("Err() = %v, want %v", err, ErrDeviceDisabled)
+	}
+}
+
+func TestReconnectAttempts(t *testing.T) {
+	tr := &lossTransport{last: errors.New("network error")}
+	c := newTestClient(t, tr, WithAutoReconnect(RetryPolicy{
+		InitialInterval: time.Second,
+		MaxInterval:     time.Second,
+		MaxAttempts:     3,
+	}))
+	defer c.Close()
+	clk := clock.NewFake(time.Now())
+	c.clock = clk
+
+	tr.lost(errors.New("eof"))
+	advanceUntil(t, clk, time.Second, func() bool {
+		return c.Err() != nil
+	})
+	if err := c.Err(); err != ErrReconnectAttempts {
+		t.Fatalf("Err() = %v, want %v", err, ErrReconnectAttempts)
+	}
+	if n := atomic.LoadInt32(&tr.connects); n != 1+3 {
+		t.Fatalf("connects = %d, want %d", n, 1+3)
+	}
+}
+
+func TestReconnectPolicyConflict(t *testing.T) {
+	for _, opts := range [][]ClientOption{
+		{WithReconnectBackoff(time.Second, 2*time.Second), WithAutoReconnect(RetryPolicy{MaxAttempts: 3})},
+		{WithAutoReconnect(RetryPolicy{MaxAttempts: 3}), WithReconnectBackoff(time.Second, 2*time.Second)},
+	} {
+		if _, err := New(append(opts, WithTransport(&fakeTransport{}))...); err == nil {
+			t.Fatal("combining reconnect policies is accepted")
+		}
+	}
+}
+
+// hangTransport is a lossTransport which reconnect attempts
+// hang until their contexts are done.
+type hangTransport struct {
+	lossTransport
+	errc chan error // errors of returned attempts
+}
+
+func (tr *hangTransport) Connect(ctx context.Context, creds transport.Credentials) error {
+	if atomic.AddInt32(&tr.connects, 1) == 1 {
+		return nil
+	}
+	<-ctx.Done()
+	tr.errc <- ctx.Err()
+	return ctx.Err()
+}
+
+func TestReconnectAttemptTimeout(t *testing.T) {
+	tr := &hangTransport{errc: make(chan error, 1)}
+	c := newTestClient(t, tr,
+		WithReconnectBackoff(time.Millisecond, time.Millisecond),
+		WithReconnectTimeout(50*time.Millisecond),
+	)
+	defer c.Close()
+
+	tr.lost(errors.New("eof"))
+	select {
+	case err := <-tr.errc:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("attempt error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("attempt isn't bounded by the reconnect timeout")
+	}
+	<-c.done
+	if err := c.Err(); err != ErrReconnectTimeout {
+		t.Fatalf("Err() = %v, want %v", err, ErrReconnectTimeout)
+	}
+}
+
+func TestReconnectAttemptClose(t *testing.T) {
+	tr := &hangTransport{errc: make(chan error, 1)}
+	c := newTestClient(t, tr, WithReconnectBackoff(time.Millisecond, time.Millisecond))
+
+	tr.lost(errors.New("eof"))
+	for atomic.LoadInt32(&tr.connects) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-tr.errc:
+		if err != context.Canceled {
+			t.Fatalf("attempt error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("attempt isn't cancelled by Close")
+	}
+}
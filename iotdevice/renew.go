@@ -0,0 +1,86 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+// DefaultTokenRenewalMargin is how long before expiry tokens are renewed by default.
+const DefaultTokenRenewalMargin = 10 * time.Minute
+
+// tokenRenewalTimeout limits a single renewal attempt.
+const tokenRenewalTimeout = 30 * time.Second
+
+// WithTokenRenewalMargin sets how long before the SAS token a connection is
+// authenticated with expires it's renewed, defaults to DefaultTokenRenewalMargin.
+//
+// Renewal is done by transports that keep the token for the whole connection,
+// e.g. MQTT that reconnects for that, when it fails the connection is
+// considered lost with the renewal error, that is reported to the connection
+// state handler, and the client reconnects authenticating with a fresh token.
+//
+// Margins that aren't smaller than half of the token's lifetime are reduced
+// to it, otherwise tokens would be renewed all the time, e.g. MQTT tokens
+// are valid for an hour so the margin is at most 30 minutes there.
+func WithTokenRenewalMargin(d time.Duration) ClientOption {
+	return func(c *Client) error {
+		if d <= 0 {
+			return errors.New("token renewal margin must be positive")
+		}
+		c.renewMargin = d
+		return nil
+	}
+}
+
+// renewTokens renews the connection's token when it's about to expire
+// until the client is closed, it's started once the client is connected.
+func (c *Client) renewTokens(r transport.TokenRenewer) {
+	var last time.Time // expiry of the token margin is computed for
+	var margin time.Duration
+	for {
+		exp := r.TokenExpiry()
+		if exp.IsZero() {
+			return // the token has no known expiry
+		}
+		if !exp.Equal(last) {
+			last, margin = exp, c.tokenMargin(exp)
+		}
+		d := exp.Sub(c.clock.Now()) - margin
+		if d < time.Second {
+			d = time.Second
+		}
+		select {
+		case <-c.clock.After(d):
+		case <-c.done:
+			return
+		}
+
+		// reconnects authenticate with a fresh token too
+		if err := c.checkConnection(context.Background()); err != nil {
+			return
+		}
+		if r.TokenExpiry().Sub(c.clock.Now()) > margin {
+			continue
+		}
+		c.logger.Debugf("renewing token")
+		ctx, cancel := context.WithTimeout(context.Background(), tokenRenewalTimeout)
+		err := r.RenewToken(ctx)
+		cancel()
+		if err != nil {
+			c.connectionLost(fmt.Errorf("token renewal: %w", err))
+		}
+	}
+}
+
+// tokenMargin returns the renewal margin of a token expiring at exp
+// that's limited to half of the token's remaining lifetime.
+func (c *Client) tokenMargin(exp time.Time) time.Duration {
+	if half := exp.Sub(c.clock.Now()) / 2; c.renewMargin > half {
+		return half
+	}
+	return c.renewMargin
+}
@@ -0,0 +1,131 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/internal/clock"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+// renewTransport is a lossTransport authenticated with hour-long tokens,
+// renewals fail with renewErr when it's set.
+type renewTransport struct {
+	lossTransport
+	clk      *clock.Fake
+	renews   int32
+	renewErr error
+
+	mu     sync.Mutex
+	expiry time.Time
+}
+
+func (tr *renewTransport) Connect(ctx context.Context, creds transport.Credentials) error {
+	if err := tr.lossTransport.Connect(ctx, creds); err != nil {
+		return err
+	}
+	tr.mu.Lock()
+	tr.expiry = tr.clk.Now().Add(time.Hour)
+	tr.mu.Unlock()
+	return nil
+}
+
+func (tr *renewTransport) TokenExpiry() time.Time {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.expiry
+}
+
+func (tr *renewTransport) RenewToken(ctx context.Context) error {
+	atomic.AddInt32(&tr.renews, 1)
+	if tr.renewErr != nil {
+		return tr.renewErr
+	}
+	tr.mu.Lock()
+	tr.expiry = tr.clk.Now().Add(time.Hour)
+	tr.mu.Unlock()
+	return nil
+}
+
+func newRenewClient(t *testing.T, tr *renewTransport, opts ...ClientOption) *Client {
+	c, err := New(append([]ClientOption{
+		WithTransport(tr),
+		WithConnectionString(testConnectionString),
+	}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.clock = tr.clk
+	if err = c.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRenewTokens(t *testing.T) {
+	tr := &renewTransport{clk: clock.NewFake(time.Now())}
+	c := newRenewClient(t, tr)
+	defer c.Close()
+
+	// the token is renewed 10 minutes before it expires
+	advanceUntil(t, tr.clk, 10*time.Minute, func() bool {
+		return atomic.LoadInt32(&tr.renews) == 1
+	})
+	if d := tr.TokenExpiry().Sub(tr.clk.Now()); d != time.Hour {
+		t.Fatalf("token expires in %s, want %s", d, time.Hour)
+	}
+	if n := atomic.LoadInt32(&tr.connects); n != 1 {
+		t.Fatalf("connects = %d, want %d", n, 1)
+	}
+}
+
+func TestRenewTokensLongMargin(t *testing.T) {
+	tr := &renewTransport{clk: clock.NewFake(time.Now())}
+	c := newRenewClient(t, tr, WithTokenRenewalMargin(2*time.Hour))
+	defer c.Close()
+
+	// the margin is reduced to half of the token lifetime,
+	// so the token isn't renewed every second
+	advanceUntil(t, tr.clk, time.Second, func() bool {
+		return tr.clk.Waiters() != 0
+	})
+	tr.clk.Advance(29 * time.Minute)
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(&tr.renews); n != 0 {
+		t.Fatalf("renews = %d before half of the lifetime, want %d", n, 0)
+	}
+	advanceUntil(t, tr.clk, time.Minute, func() bool {
+		return atomic.LoadInt32(&tr.renews) == 1
+	})
+	if d := tr.TokenExpiry().Sub(tr.clk.Now()); d != time.Hour {
+		t.Fatalf("token expires in %s, want %s", d, time.Hour)
+	}
+}
+
+func TestRenewTokensError(t *testing.T) {
+	renewErr := errors.New("renewal failed")
+	tr := &renewTransport{clk: clock.NewFake(time.Now()), renewErr: renewErr}
+	changes := make(chan stateChange, 10)
+	c := newRenewClient(t, tr, WithConnectionStateHandler(func(connected bool, err error) {
+		changes <- stateChange{connected: connected, err: err}
+	}))
+	defer c.Close()
+	if s := <-changes; !s.connected {
+		t.Fatalf("state = %v, want connected", s)
+	}
+
+	// a failed renewal is a connection loss the client reconnects after
+	advanceUntil(t, tr.clk, 10*time.Minute, func() bool {
+		return atomic.LoadInt32(&tr.connects) == 2
+	})
+	if s := <-changes; s.connected || !errors.Is(s.err, renewErr) {
+		t.Fatalf("state = %v, want disconnected with %v", s, renewErr)
+	}
+	if s := <-changes; !s.connected {
+		t.Fatalf("state = %v, want connected", s)
+	}
+}
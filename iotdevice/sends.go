@@ -0,0 +1,94 @@
+package iotdevice
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// SendAbandonedError is returned by sends cancelled by CloseContext
+// when its context is done before they're acknowledged.
+type SendAbandonedError struct {
+	MessageID string // empty unless set with WithSendMessageID
+}
+
+func (e *SendAbandonedError) Error() string {
+	if e.MessageID == "" {
+		return "send abandoned on close"
+	}
+	return fmt.Sprintf("send of message %q abandoned on close", e.MessageID)
+}
+
+// Unwrap makes abandoned sends match ErrClosed.
+func (e *SendAbandonedError) Unwrap() error {
+	return ErrClosed
+}
+
+// sendTracker counts in-flight sends and method handlers so closing can
+// wait for them, it's lock-free to keep the send path cheap.
+type sendTracker struct {
+	n         int64 // in-flight operations, atomic
+	closing   int32 // set by drain, new operations are refused
+	abandoned int32 // set by abandon
+
+	mu      sync.Mutex
+	drained chan struct{} // closed when the last operation is done while draining
+}
+
+// add registers an operation, it fails when the client is being closed.
+func (t *sendTracker) add() error {
+	atomic.AddInt64(&t.n, 1)
+	if atomic.LoadInt32(&t.closing) == 1 {
+		t.done()
+		return ErrClosed
+	}
+	return nil
+}
+
+// done unregisters an operation and reports whether
+// operations in flight were abandoned by closing.
+func (t *sendTracker) done() bool {
+	if atomic.AddInt64(&t.n, -1) == 0 && atomic.LoadInt32(&t.closing) == 1 {
+		t.mu.Lock()
+		if t.drained != nil {
+			select {
+			case <-t.drained:
+			default:
+				close(t.drained)
+			}
+		}
+		t.mu.Unlock()
+	}
+	return atomic.LoadInt32(&t.abandoned) == 1
+}
+
+func (t *sendTracker) len() int {
+	return int(atomic.LoadInt64(&t.n))
+}
+
+// drain refuses new operations and waits for pending ones until ctx is done.
+func (t *sendTracker) drain(ctx context.Context) error {
+	atomic.StoreInt32(&t.closing, 1)
+	t.mu.Lock()
+	if t.drained == nil {
+		t.drained = make(chan struct{})
+	}
+	drained := t.drained
+	t.mu.Unlock()
+
+	for atomic.LoadInt64(&t.n) != 0 {
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// abandon marks operations still in flight as abandoned,
+// they're cancelled by closing the transport and method mux.
+func (t *sendTracker) abandon() {
+	atomic.StoreInt32(&t.abandoned, 1)
+}
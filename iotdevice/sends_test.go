@@ -0,0 +1,123 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+func TestCloseContextAbandonsPendingSends(t *testing.T) {
+	c := newTestClient(t, &fakeTransport{sendHang: true})
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.SendEvent(context.Background(), []byte("hello"), WithSendMessageID("m1"))
+	}()
+	for c.PendingSends() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.CloseContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	err := <-errc
+	var aerr *SendAbandonedError
+	if !errors.As(err, &aerr) || aerr.MessageID != "m1" {
+		t.Fatalf("SendEvent error = %v, want an abandoned send of %q", err, "m1")
+	}
+	if !errors.Is(err, ErrClosed) {
+		t.Fatalf("SendEvent error = %v doesn't match %v", err, ErrClosed)
+	}
+	if n := c.PendingSends(); n != 0 {
+		t.Fatalf("PendingSends() = %d, want %d", n, 0)
+	}
+}
+
+func TestCloseContextWaitsForSends(t *testing.T) {
+	c := newTestClient(t, &fakeTransport{})
+	if err := c.SendEvent(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendEvent(context.Background(), []byte("hello")); err != ErrClosed {
+		t.Fatalf("SendEvent after close = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestCloseContextWaitsForMethods(t *testing.T) {
+	tr := &fakeTransport{}
+	c := newTestClient(t, tr)
+	started, release := make(chan struct{}), make(chan struct{})
+	if err := c.dmMux.handle("reboot", func(ctx context.Context, p map[string]interface{}) (map[string]interface{}, error) {
+		close(started)
+		<-release
+		return map[string]interface{}{"ok": ctx.Err() == nil}, nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	type result struct {
+		rc  int
+		b   []byte
+		err error
+	}
+	// it's called the way transports do, the response
+	// is published after Dispatch returns
+	resc, publish := make(chan result, 1), make(chan struct{})
+	go func() {
+		if err := c.dmMux.StartResponse(); err != nil {
+			resc <- result{err: err}
+			return
+		}
+		defer c.dmMux.DoneResponse()
+		rc, b, err := c.dmMux.Dispatch(&transport.MethodRequest{Name: "reboot", RequestID: "1", Payload: []byte(`{}`)})
+		<-publish
+		select {
+		case <-tr.closing():
+			err = errors.New("response published after the transport is closed")
+		default:
+		}
+		resc <- result{rc, b, err}
+	}()
+	<-started
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.CloseContext(context.Background())
+	}()
+	select {
+	case err := <-closed:
+		t.Fatalf("CloseContext returned %v while a method is running", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, _, err := c.dmMux.Dispatch(&transport.MethodRequest{Name: "reboot", RequestID: "2", Payload: []byte(`{}`)}); err != ErrClosed {
+		t.Fatalf("Dispatch while closing = %v, want %v", err, ErrClosed)
+	}
+
+	if err := c.dmMux.StartResponse(); err != ErrClosed {
+		t.Fatalf("StartResponse while closing = %v, want %v", err, ErrClosed)
+	}
+
+	close(release)
+	select {
+	case err := <-closed:
+		t.Fatalf("CloseContext returned %v before the response is published", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(publish)
+	res := <-resc
+	if res.err != nil || res.rc != 200 || string(res.b) != `{"ok":true}` {
+		t.Fatalf("Dispatch = %d, %s, %v, want 200, {\"ok\":true}, nil", res.rc, res.b, res.err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("second Close = %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+// CompleteEvent reports that the cloud-to-device message msg received
+// from an event subscription is processed, the hub removes it from the
+// device queue and generates positive feedback when it's requested.
+//
+// It's a no-op with transports that settle messages on their own,
+// e.g. MQTT completes them on delivery, see SubscribeEvents.
+func (c *Client) CompleteEvent(ctx context.Context, msg *common.Message) error {
+	return c.settle(ctx, msg, transport.Complete)
+}
+
+// AbandonEvent puts msg back to the device queue, so it's redelivered
+// until the maximum delivery count is reached.
+//
+// Transports that settle messages on their own have already completed msg,
+// so it's a no-op unless msg requests feedback, see ErrFeedbackUnsupported.
+func (c *Client) AbandonEvent(ctx context.Context, msg *common.Message) error {
+	return c.settle(ctx, msg, transport.Abandon)
+}
+
+// RejectEvent dead-letters msg without redelivering it,
+// the hub generates negative feedback when it's requested.
+//
+// Transports that settle messages on their own have already completed msg,
+// so it's a no-op unless msg requests feedback, see ErrFeedbackUnsupported.
+func (c *Client) RejectEvent(ctx context.Context, msg *common.Message) error {
+	return c.settle(ctx, msg, transport.Reject)
+}
+
+// ErrFeedbackUnsupported is returned when abandoning or rejecting a message
+// that requests feedback (iothub-ack is positive, negative or full)
+// but it's already completed by the transport, e.g. MQTT, so the service
+// gets positive feedback or none instead of the negative one.
+var ErrFeedbackUnsupported = errors.New("message is completed on delivery, feedback cannot be changed")
+
+func (c *Client) settle(ctx context.Context, msg *common.Message, d transport.Disposition) error {
+	if ctx == nil {
+		return errNilContext
+	}
+	if msg == nil {
+		panic("msg is nil")
+	}
+	s, ok := c.tr.(transport.MessageSettler)
+	if !ok {
+		return checkCompleted(msg, d)
+	}
+	if err := c.checkConnection(ctx); err != nil {
+		return err
+	}
+	if err := s.Settle(ctx, msg, d); err != nil {
+		return err
+	}
+	c.logger.Debugf("cloud-to-device: %s %q", d, msg.MessageID)
+	return nil
+}
+
+// checkCompleted checks that settling msg completed on delivery with d
+// doesn't conflict with the feedback the service expects.
+func checkCompleted(msg *common.Message, d transport.Disposition) error {
+	if d == transport.Complete {
+		return nil
+	}
+	switch msg.Properties["iothub-ack"] {
+	case "", "none":
+		return nil
+	default:
+		return ErrFeedbackUnsupported
+	}
+}
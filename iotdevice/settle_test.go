@@ -0,0 +1,130 @@
+package iotdevice
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+// settleTransport is a fakeTransport delivering messages unsettled
+// with a lock token, abandoned messages are redelivered.
+type settleTransport struct {
+	fakeTransport
+
+	mu      sync.Mutex
+	mux     transport.MessageDispatcher
+	settled []string
+}
+
+func (tr *settleTransport) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
+	tr.mu.Lock()
+	tr.mux = mux
+	tr.mu.Unlock()
+	return nil
+}
+
+func (tr *settleTransport) deliver(mid string, count int) {
+	tr.mu.Lock()
+	mux := tr.mux
+	tr.mu.Unlock()
+	mux.Dispatch(&common.Message{
+		MessageID: mid,
+		Payload:   []byte(mid),
+		TransportOptions: map[string]interface{}{
+			"lockToken":     mid,
+			"deliveryCount": count,
+		},
+	})
+}
+
+func (tr *settleTransport) Settle(ctx context.Context, msg *common.Message, d transport.Disposition) error {
+	tr.mu.Lock()
+	tr.settled = append(tr.settled, d.String()+" "+msg.TransportOptions["lockToken"].(string))
+	tr.mu.Unlock()
+	if d == transport.Abandon {
+		go tr.deliver(msg.MessageID, msg.TransportOptions["deliveryCount"].(int)+1)
+	}
+	return nil
+}
+
+func TestAbandonEventRedelivers(t *testing.T) {
+	tr := &settleTransport{}
+	c := newTestClient(t, tr)
+	defer c.Close()
+	sub, err := c.SubscribeEvents(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tr.deliver("m1", 1)
+
+	recv := func() *common.Message {
+		t.Helper()
+		select {
+		case msg := <-sub.C():
+			return msg
+		case <-time.After(time.Second):
+			t.Fatal("no message delivered")
+			return nil
+		}
+	}
+	msg := recv()
+	if err = c.AbandonEvent(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	msg = recv()
+	if n := msg.TransportOptions["deliveryCount"]; n != 2 {
+		t.Fatalf("deliveryCount = %v, want 2", n)
+	}
+	if err = c.RejectEvent(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg = <-sub.C():
+		t.Fatalf("rejected message %q redelivered", msg.MessageID)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	go tr.deliver("m2", 1)
+	if err = c.CompleteEvent(context.Background(), recv()); err != nil {
+		t.Fatal(err)
+	}
+
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	want := []string{"abandon m1", "reject m1", "complete m2"}
+	if !reflect.DeepEqual(tr.settled, want) {
+		t.Fatalf("settled = %v, want %v", tr.settled, want)
+	}
+}
+
+func TestSettleCompleted(t *testing.T) {
+	c := newTestClient(t, &fakeTransport{})
+	defer c.Close()
+	for _, s := range []struct {
+		ack     string
+		settle  func(context.Context, *common.Message) error
+		name    string
+		wantErr error
+	}{
+		{"", c.AbandonEvent, "abandon", nil},
+		{"none", c.RejectEvent, "reject", nil},
+		{"positive", c.CompleteEvent, "complete", nil},
+		{"full", c.CompleteEvent, "complete", nil},
+		{"positive", c.RejectEvent, "reject", ErrFeedbackUnsupported},
+		{"negative", c.RejectEvent, "reject", ErrFeedbackUnsupported},
+		{"full", c.AbandonEvent, "abandon", ErrFeedbackUnsupported},
+	} {
+		msg := &common.Message{Properties: map[string]string{}}
+		if s.ack != "" {
+			msg.Properties["iothub-ack"] = s.ack
+		}
+		if err := s.settle(context.Background(), msg); err != s.wantErr {
+			t.Errorf("%s with ack = %q: error = %v, want %v", s.name, s.ack, err, s.wantErr)
+		}
+	}
+}
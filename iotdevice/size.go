@@ -0,0 +1,77 @@
+package iotdevice
+
+import (
+	"errors"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+// MaxMessageSize is the hub's size limit of device-to-cloud messages in bytes.
+const MaxMessageSize = 256 << 10
+
+// ErrMessageTooLarge is matched by errors.Is with *PayloadSizeError
+// returned by sends of messages exceeding the size limit.
+var ErrMessageTooLarge = errors.New("message is too large")
+
+// WithMaxSendSize overrides the size limit of device-to-cloud messages,
+// MaxMessageSize by default, sends of larger messages fail with
+// *PayloadSizeError before anything is sent to the hub.
+func WithMaxSendSize(n int) ClientOption {
+	return func(c *Client) error {
+		if n <= 0 {
+			return errors.New("max send size must be positive")
+		}
+		c.maxSend = n
+		return nil
+	}
+}
+
+// sendLimit returns the size limit of device-to-cloud messages.
+func (c *Client) sendLimit() int {
+	if c.maxSend != 0 {
+		return c.maxSend
+	}
+	return MaxMessageSize
+}
+
+// checkSize fails when msg exceeds the size limit.
+func (c *Client) checkSize(msg *common.Message) error {
+	if n, limit := messageSize(msg), c.sendLimit(); n > limit {
+		return &PayloadSizeError{Size: n, Limit: limit}
+	}
+	return nil
+}
+
+// messageSize returns the size of msg the way the hub computes it,
+// that's the payload and names and values of all set properties.
+func messageSize(msg *common.Message) int {
+	n := len(msg.Payload)
+	for k, v := range msg.Properties {
+		n += len(k) + len(v)
+	}
+	for _, p := range [...]struct{ k, v string }{
+		{"message-id", msg.MessageID},
+		{"correlation-id", msg.CorrelationID},
+		{"user-id", msg.UserID},
+		{"to", msg.To},
+		{"content-type", msg.ContentType},
+		{"content-encoding", msg.ContentEncoding},
+		{"dt-dataschema", msg.InterfaceID},
+		{"absolute-expiry-time", formatTime(msg.ExpiryTime)},
+		{"creation-time", formatTime(msg.CreationTime)},
+	} {
+		if p.v != "" {
+			n += len(p.k) + len(p.v)
+		}
+	}
+	return n
+}
+
+// formatTime formats t for size calculation, it's empty when t isn't set.
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
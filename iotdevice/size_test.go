@@ -0,0 +1,44 @@
+package iotdevice
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSendEventSizeLimit(t *testing.T) {
+	c := newTestClient(t, &fakeTransport{})
+	defer c.Close()
+
+	// properties count towards the limit
+	err := c.SendEvent(context.Background(), make([]byte, MaxMessageSize-4),
+		WithSendProperty("ab", "cd"),
+		WithSendMessageID("1"),
+	)
+	if !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("SendEvent() = %v, want ErrMessageTooLarge", err)
+	}
+	var perr *PayloadSizeError
+	want := MaxMessageSize + len("ab") + len("cd") + len("message-id") + len("1") - 4
+	if !errors.As(err, &perr) || perr.Size != want || perr.Limit != MaxMessageSize {
+		t.Fatalf("SendEvent() = %v, want size %d", err, want)
+	}
+	if err = c.SendEvent(context.Background(), make([]byte, MaxMessageSize)); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.Stats(); s.MessagesSent != 1 || s.SendErrors != 0 {
+		t.Fatalf("sent = %d, errors = %d, want 1 and 0", s.MessagesSent, s.SendErrors)
+	}
+}
+
+func TestWithMaxSendSize(t *testing.T) {
+	c := newTestClient(t, &fakeTransport{}, WithMaxSendSize(4))
+	defer c.Close()
+
+	if err := c.SendEvent(context.Background(), []byte("hello")); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("SendEvent() = %v, want ErrMessageTooLarge", err)
+	}
+	if err := c.SendEvent(context.Background(), []byte("hey")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,77 @@
+package iotdevice
+
+import (
+	"errors"
+	"sync"
+)
+
+// WithConnectionStateHandler registers fn to be notified of connection
+// state changes: connected is true after Connect succeeds and after every
+// reconnect, it's false with the cause when the connection drops and
+// when the client is closed, err is nil then on Close and the terminal
+// error otherwise, see Err.
+//
+// fn is called from a single goroutine in the order the changes happen,
+// so a loss is always reported before the reconnect that follows it
+// and no calls are made after the one reporting the close. Losses are
+// reported only by transports that let the client reconnect.
+func WithConnectionStateHandler(fn func(connected bool, err error)) ClientOption {
+	return func(c *Client) error {
+		if fn == nil {
+			return errors.New("fn is nil")
+		}
+		c.state = &stateNotifier{fn: fn}
+		return nil
+	}
+}
+
+type stateChange struct {
+	connected bool
+	err       error
+}
+
+// stateNotifier queues connection state changes and calls the
+// handler with them from its own goroutine, so the transport
+// and the reconnect loop are never blocked by the handler.
+type stateNotifier struct {
+	fn func(connected bool, err error)
+
+	mu      sync.Mutex
+	queue   []stateChange
+	running bool // the delivering goroutine is running
+	closed  bool // the final change is queued
+}
+
+// notify queues a change, closing is true for the final one.
+func (n *stateNotifier) notify(connected bool, err error, closing bool) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return
+	}
+	n.closed = closing
+	n.queue = append(n.queue, stateChange{connected: connected, err: err})
+	if !n.running {
+		n.running = true
+		go n.run()
+	}
+}
+
+// run delivers queued changes and exits when the queue is drained.
+func (n *stateNotifier) run() {
+	for {
+		n.mu.Lock()
+		if len(n.queue) == 0 {
+			n.running = false
+			n.mu.Unlock()
+			return
+		}
+		s := n.queue[0]
+		n.queue = n.queue[1:]
+		n.mu.Unlock()
+		n.fn(s.connected, s.err)
+	}
+}
@@ -0,0 +1,43 @@
+package iotdevice
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/internal/clock"
+)
+
+func TestConnectionStateHandler(t *testing.T) {
+	changes := make(chan stateChange, 10)
+	tr := &lossTransport{}
+	c := newTestClient(t, tr, WithConnectionStateHandler(func(connected bool, err error) {
+		changes <- stateChange{connected: connected, err: err}
+	}))
+	clk := clock.NewFake(time.Now())
+	c.clock = clk
+
+	eof := errors.New("eof")
+	tr.lost(eof)
+	advanceUntil(t, clk, time.Second, func() bool {
+		return !c.Stats().Reconnecting
+	})
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []stateChange{{true, nil}, {false, eof}, {true, nil}, {false, nil}}
+	var got []stateChange
+	for range want {
+		select {
+		case s := <-changes:
+			got = append(got, s)
+		case <-time.After(time.Second):
+			t.Fatalf("changes = %v, want %v", got, want)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("changes = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,222 @@
+// Package http implements the HTTPS device transport suitable for devices
+// that send telemetry occasionally and don't keep a connection open.
+//
+// Only sending device-to-cloud messages is supported.
+package http
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+// DefaultIdleTimeout is the default time an idle connection is kept open.
+const DefaultIdleTimeout = 30 * time.Second
+
+// ErrNotSupported is returned by operations unavailable over HTTPS.
+var ErrNotSupported = errors.New("http: not supported")
+
+// TransportOption is a transport configuration option.
+type TransportOption func(tr *Transport)
+
+// WithLogger sets logger for errors and warnings
+// plus debug messages when it's enabled.
+func WithLogger(l common.Logger) TransportOption {
+	return func(tr *Transport) {
+		tr.logger = l
+	}
+}
+
+// WithIdleTimeout sets how long a connection is kept open after the last
+// request, defaults to DefaultIdleTimeout.
+//
+// Requests made within the timeout reuse the connection, bursts of messages
+// pay for the TLS handshake only once, when it's expired the next connection
+// resumes the TLS session when the hub permits that. Shorter timeouts
+// save power on constrained devices at the cost of more handshakes.
+func WithIdleTimeout(d time.Duration) TransportOption {
+	if d <= 0 {
+		panic("idle timeout must be positive")
+	}
+	return func(tr *Transport) {
+		tr.idle = d
+	}
+}
+
+// New returns new HTTPS transport.
+// See more: https://docs.microsoft.com/en-us/rest/api/iothub/device
+func New(opts ...TransportOption) transport.Transport {
+	tr := &Transport{idle: DefaultIdleTimeout}
+	for _, opt := range opts {
+		opt(tr)
+	}
+	return tr
+}
+
+type Transport struct {
+	mu     sync.RWMutex
+	creds  transport.Credentials
+	client *http.Client
+
+	logger common.Logger
+	idle   time.Duration
+}
+
+func (tr *Transport) SetLogger(logger common.Logger) {
+	tr.logger = logger
+}
+
+// Connect only prepares the http client, connections
+// are established on demand and reused between requests.
+func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.client != nil {
+		return errors.New("already connected")
+	}
+
+	cfg := creds.TLSConfig()
+	if cfg.ClientSessionCache == nil {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+	}
+	tr.creds = creds
+	tr.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			TLSClientConfig:     cfg,
+			TLSHandshakeTimeout: 30 * time.Second,
+			IdleConnTimeout:     tr.idle,
+			MaxIdleConnsPerHost: 1,
+		},
+	}
+	return nil
+}
+
+func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
+	tr.mu.RLock()
+	client, creds := tr.client, tr.creds
+	tr.mu.RUnlock()
+	if client == nil {
+		return errors.New("not connected")
+	}
+
+	host := transport.GatewayHostname(creds)
+	if host == "" {
+		host = creds.Hostname()
+	}
+	path := "/devices/" + url.PathEscape(creds.DeviceID())
+	if mid := transport.ModuleID(creds); mid != "" {
+		path += "/modules/" + url.PathEscape(mid)
+	}
+	req, err := http.NewRequest(http.MethodPost,
+		"https://"+host+path+"/messages/events?api-version="+common.APIVersion,
+		bytes.NewReader(msg.Payload),
+	)
+	if err != nil {
+		return err
+	}
+	if creds.IsSAS() {
+		uri := creds.Hostname() + path
+		token, err := creds.Token(ctx, uri, time.Hour)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", token)
+	}
+	setHeaders(req.Header, msg)
+
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// the body has to be read to the end to reuse the connection
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("send: code = %d, body = %q", res.StatusCode, b)
+	}
+	return nil
+}
+
+// creationTimeProperty is the application property of message creation times.
+const creationTimeProperty = "iothub-creation-time-utc"
+
+// setHeaders maps message attributes to request headers,
+// application properties are prefixed with `iothub-app-`.
+func setHeaders(h http.Header, msg *common.Message) {
+	for k, v := range map[string]string{
+		"iothub-messageid":       msg.MessageID,
+		"iothub-correlationid":   msg.CorrelationID,
+		"iothub-userid":          msg.UserID,
+		"iothub-to":              msg.To,
+		"iothub-contenttype":     msg.ContentType,
+		"iothub-contentencoding": msg.ContentEncoding,
+		"iothub-interface-id":    msg.InterfaceID,
+	} {
+		if v != "" {
+			h.Set(k, v)
+		}
+	}
+	if msg.ExpiryTime != nil && !msg.ExpiryTime.IsZero() {
+		h.Set("iothub-expiry", msg.ExpiryTime.UTC().Format(time.RFC3339))
+	}
+	// there's no system header for it, the hub passes it as is
+	if msg.CreationTime != nil && !msg.CreationTime.IsZero() {
+		h.Set("iothub-app-"+creationTimeProperty, msg.CreationTime.UTC().Format(time.RFC3339Nano))
+	}
+	for k, v := range msg.Properties {
+		h.Set("iothub-app-"+k, v)
+	}
+}
+
+func (tr *Transport) RegisterDirectMethods(ctx context.Context, mux transport.MethodDispatcher) error {
+	return ErrNotSupported
+}
+
+func (tr *Transport) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
+	return ErrNotSupported
+}
+
+func (tr *Transport) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
+	return ErrNotSupported
+}
+
+func (tr *Transport) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
+	return nil, ErrNotSupported
+}
+
+func (tr *Transport) UpdateTwinProperties(ctx context.Context, payload []byte) (int, error) {
+	return 0, ErrNotSupported
+}
+
+// IsConnected is true between Connect and Close,
+// since connections are established on demand.
+func (tr *Transport) IsConnected() bool {
+	tr.mu.RLock()
+	defer tr.mu.RUnlock()
+	return tr.client != nil
+}
+
+func (tr *Transport) Close() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.client != nil {
+		tr.client.CloseIdleConnections()
+		tr.client = nil
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package http
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+)
+
+type testCreds struct {
+	host  string
+	roots *x509.CertPool
+}
+
+func (c *testCreds) DeviceID() string        { return "dev" }
+func (c *testCreds) ModuleID() string        { return "" }
+func (c *testCreds) Hostname() string        { return c.host }
+func (c *testCreds) GatewayHostname() string { return "" }
+func (c *testCreds) IsSAS() bool             { return true }
+
+func (c *testCreds) TLSConfig() *tls.Config {
+	return &tls.Config{RootCAs: c.roots}
+}
+
+func (c *testCreds) Token(ctx context.Context, uri string, d time.Duration) (string, error) {
+	return "SharedAccessSignature sr=" + uri, nil
+}
+
+// testServer is a hub stub counting new connections and resumed TLS sessions.
+type testServer struct {
+	*httptest.Server
+	conns   int32
+	resumed int32
+}
+
+func newTestServer(tb testing.TB) *testServer {
+	s := &testServer{}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/devices/dev/messages/events" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.TLS.DidResume {
+			atomic.AddInt32(&s.resumed, 1)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&s.conns, 1)
+		}
+	}
+	s.StartTLS()
+	tb.Cleanup(s.Close)
+	return s
+}
+
+func newTestTransport(tb testing.TB, s *testServer, opts ...TransportOption) *Transport {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.Certificate())
+	tr := New(opts...).(*Transport)
+	if err := tr.Connect(context.Background(), &testCreds{
+		host:  s.Listener.Addr().String(),
+		roots: roots,
+	}); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { tr.Close() })
+	return tr
+}
+
+func TestSendReusesConnection(t *testing.T) {
+	s := newTestServer(t)
+	tr := newTestTransport(t, s)
+	for i := 0; i < 50; i++ {
+		if err := tr.Send(context.Background(), &common.Message{
+			Payload: []byte("hello"),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&s.conns); n != 1 {
+		t.Fatalf("connections = %d, want %d", n, 1)
+	}
+}
+
+func TestSendIdleTimeout(t *testing.T) {
+	s := newTestServer(t)
+	tr := newTestTransport(t, s, WithIdleTimeout(20*time.Millisecond))
+	for i := 0; i < 2; i++ {
+		if err := tr.Send(context.Background(), &common.Message{
+			Payload: []byte("hello"),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&s.conns); n != 2 {
+		t.Fatalf("connections = %d, want %d", n, 2)
+	}
+	if n := atomic.LoadInt32(&s.resumed); n != 1 {
+		t.Fatalf("resumed sessions = %d, want %d", n, 1)
+	}
+}
+
+func TestSetHeaders(t *testing.T) {
+	h := http.Header{}
+	setHeaders(h, &common.Message{
+		MessageID:  "mid",
+		Properties: map[string]string{"a": "b"},
+	})
+	if v := h.Get("iothub-messageid"); v != "mid" {
+		t.Errorf("iothub-messageid = %q, want %q", v, "mid")
+	}
+	if v := h.Get("iothub-app-a"); v != "b" {
+		t.Errorf("iothub-app-a = %q, want %q", v, "b")
+	}
+	if v := h.Get("iothub-correlationid"); v != "" {
+		t.Errorf("iothub-correlationid = %q, want it unset", v)
+	}
+	if v := h.Get("iothub-app-iothub-creation-time-utc"); v != "" {
+		t.Errorf("creation time = %q, want it unset", v)
+	}
+
+	ct := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("", 3600))
+	setHeaders(h, &common.Message{CreationTime: &ct})
+	if v, want := h.Get("iothub-app-iothub-creation-time-utc"), "2020-01-02T02:04:05Z"; v != want {
+		t.Errorf("creation time = %q, want %q", v, want)
+	}
+}
+
+func BenchmarkSendBurst(b *testing.B) {
+	s := newTestServer(b)
+	tr := newTestTransport(b, s)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 50; j++ {
+			if err := tr.Send(context.Background(), &common.Message{
+				Payload: []byte("hello"),
+			}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt32(&s.conns))/float64(b.N), "handshakes/op")
+}
+
+func TestSendIgnoresRetain(t *testing.T) {
+	s := newTestServer(t)
+	tr := newTestTransport(t, s)
+	if err := tr.Send(context.Background(), &common.Message{
+		Payload:          []byte("on"),
+		TransportOptions: map[string]interface{}{"retain": true},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
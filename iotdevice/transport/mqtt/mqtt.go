@@ -1,9 +1,14 @@
 package mqtt
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/url"
 	"strconv"
 	"strings"
@@ -12,13 +17,22 @@ import (
 	"time"
 
 	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/credentials"
+	"github.com/amenzhinsky/iothub/internal/proxy"
 	"github.com/amenzhinsky/iothub/iotdevice/transport"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
 // DefaultQoS is the default quality of service value.
 const DefaultQoS = 1
 
+const (
+	directMethodsTopic = "$iothub/methods/POST/#"
+	twinUpdatesTopic   = "$iothub/twin/PATCH/properties/desired/#"
+	twinResponsesTopic = "$iothub/twin/res/#"
+)
+
 // TransportOption is a transport configuration option.
 type TransportOption func(tr *Transport)
 
@@ -44,11 +58,96 @@ func WithClientOptionsConfig(fn func(opts *mqtt.ClientOptions)) TransportOption
 	}
 }
 
+// WithEventsQoS sets the quality of service of the cloud-to-device messages subscription.
+// Only 0 and 1 values are supported, defaults to DefaultQoS.
+//
+// With QoS 1 messages that were delivered but not acknowledged before a disconnect
+// are redelivered, but to receive messages enqueued while the device was offline
+// the session has to be persistent, that means the clean session flag has to be
+// disabled with WithClientOptionsConfig, otherwise the broker discards
+// the session state including subscriptions on every disconnect.
+func WithEventsQoS(qos int) TransportOption {
+	checkQoS(qos)
+	return func(tr *Transport) {
+		tr.eqos = qos
+	}
+}
+
+// WithTwinQoS sets the quality of service of twin updates and responses subscriptions.
+// Only 0 and 1 values are supported, defaults to DefaultQoS.
+func WithTwinQoS(qos int) TransportOption {
+	checkQoS(qos)
+	return func(tr *Transport) {
+		tr.tqos = qos
+	}
+}
+
+// WithMethodsQoS sets the quality of service of the direct methods subscription.
+// Only 0 and 1 values are supported, defaults to DefaultQoS.
+func WithMethodsQoS(qos int) TransportOption {
+	checkQoS(qos)
+	return func(tr *Transport) {
+		tr.mqos = qos
+	}
+}
+
+// WithTwinGzip enables transparent decompression of gzip-encoded twin
+// documents, that's useful behind a gateway compressing them on metered links.
+//
+// IoT Hub itself never compresses twins, so compression is detected by
+// the gzip magic number that cannot be the first byte of a JSON document,
+// and plain responses are still accepted.
+func WithTwinGzip() TransportOption {
+	return func(tr *Transport) {
+		tr.gzip = true
+	}
+}
+
+// WithPersistentSession makes the hub keep the session while the device
+// is disconnected, i.e. its subscriptions and undelivered QoS 1
+// cloud-to-device messages, queued messages are delivered
+// in order right after the device reconnects.
+//
+// Messages arriving before SubscribeEvents is called are acknowledged on
+// receipt, up to MaxPendingEvents of them are held until it's called and
+// later ones are dropped, so such messages are delivered at most once,
+// they're lost when the client never subscribes or is closed first.
+func WithPersistentSession() TransportOption {
+	return func(tr *Transport) {
+		tr.persistent = true
+	}
+}
+
+// WithWebSocket tunnels MQTT through a secure WebSocket on port 443 with
+// the mqtt subprotocol instead of connecting to port 8883, that's often
+// the only port open on corporate networks. TLS, credentials
+// and reconnects work the same way as with plain MQTT.
+//
+// It can be combined with WithProxy for networks
+// allowing outbound HTTPS only through a proxy.
+func WithWebSocket() TransportOption {
+	return func(tr *Transport) {
+		tr.ws = true
+	}
+}
+
+func checkQoS(qos int) {
+	if qos != 0 && qos != 1 {
+		panic(fmt.Sprintf("invalid QoS value: %d", qos))
+	}
+}
+
 // NewLogger returns new Transport transport.
 // See more: https://docs.microsoft.com/en-us/azure/iot-hub/iot-hub-mqtt-support
 func New(opts ...TransportOption) transport.Transport {
+	ctx, cancel := context.WithCancel(context.Background())
 	tr := &Transport{
-		done: make(chan struct{}),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+		cancel: cancel,
+		eqos:   DefaultQoS,
+		tqos:   DefaultQoS,
+		mqos:   DefaultQoS,
 	}
 	for _, opt := range opts {
 		opt(tr)
@@ -56,21 +155,71 @@ func New(opts ...TransportOption) transport.Transport {
 	return tr
 }
 
+// MaxPendingEvents is the maximum number of cloud-to-device messages
+// held until SubscribeEvents is called, see WithPersistentSession.
+const MaxPendingEvents = 64
+
 type Transport struct {
+	// expiry is the current SAS token expiration unix time,
+	// it goes first to be 64-bit aligned on 32-bit platforms.
+	expiry int64
+
+	// dropped counts messages dropped because pending is full.
+	dropped uint64
+
+	// online is 1 while the connection is up, the library's
+	// IsConnected is true even during reconnects so it's tracked
+	// by the connect and connection lost handlers.
+	online int32
+
 	mu   sync.RWMutex
 	conn mqtt.Client
 
 	did string // device id
+	mid string // module id, empty for devices
 	rid uint32 // request id, incremented each request
 
-	subm sync.RWMutex // cannot use mu for protecting subs
-	subs []subFunc    // on-connect mqtt subscriptions
+	subm sync.RWMutex       // cannot use mu for protecting subs
+	subs map[string]subFunc // on-connect mqtt subscriptions by topic filter
 
 	done chan struct{}         // closed when the transport is closed
 	resp map[uint32]chan *resp // responses from iothub
 
-	logger common.Logger
-	cocfg  func(opts *mqtt.ClientOptions)
+	// ctx lives as long as the transport, it's used for resubscribing
+	// and publishing method responses that outlive callers' contexts
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// SAS tokens are minted before connecting so failures are returned
+	// by Connect, mint is nil for x509 authentication, fresh is set
+	// until the token is used by the credentials provider
+	tokm  sync.Mutex
+	mint  func(ctx context.Context) (string, error)
+	token string
+	fresh bool
+
+	logger   common.Logger
+	observer transport.SubscriptionObserver
+	lost     func(err error) // replaces the library's reconnects when set
+	cocfg    func(opts *mqtt.ClientOptions)
+
+	eqos int // events subscription qos
+	tqos int // twin subscriptions qos
+	mqos int // direct methods subscription qos
+
+	gzip  bool     // decompress gzipped twin documents
+	ws    bool     // tunnel through websockets
+	proxy *url.URL // explicit proxy, environment is used when nil
+	relay *relay   // proxy relay, nil when connected directly
+
+	// cloud-to-device messages received before SubscribeEvents
+	// are held in pending, that's possible with persistent sessions,
+	// flushing is set while they're being dispatched
+	persistent bool
+	evm        sync.Mutex
+	evMux      transport.MessageDispatcher
+	pending    []*common.Message
+	flushing   bool
 }
 
 type resp struct {
@@ -84,108 +233,434 @@ func (tr *Transport) SetLogger(logger common.Logger) {
 	tr.logger = logger
 }
 
+// SetSubscriptionObserver implements transport.ObservableTransport.
+func (tr *Transport) SetSubscriptionObserver(o transport.SubscriptionObserver) {
+	tr.observer = o
+}
+
+// SetConnectionLostHandler implements transport.ConnectionLossNotifier.
+func (tr *Transport) SetConnectionLostHandler(fn func(err error)) {
+	tr.lost = fn
+}
+
 func (tr *Transport) Connect(ctx context.Context, creds transport.Credentials) error {
 	tr.mu.Lock()
 	defer tr.mu.Unlock()
+	select {
+	case <-tr.done:
+		return errors.New("closed")
+	default:
+	}
 	if tr.conn != nil {
-		return errors.New("already connected")
+		// with a connection lost handler the caller reconnects
+		// the same client, subscriptions are restored on connect
+		if tr.lost == nil || tr.conn.IsConnected() {
+			return errors.New("already connected")
+		}
+		if err := tr.mintToken(ctx); err != nil {
+			return err
+		}
+		t := tr.conn.Connect()
+		if err := contextToken(ctx, t); err != nil {
+			return connectError(t.(*mqtt.ConnectToken).ReturnCode(), err)
+		}
+		return nil
 	}
 
-	username := creds.Hostname() + "/" + creds.DeviceID() + "/api-version=" + common.APIVersion
+	// modules are identified by both device and module ids
+	cid := creds.DeviceID()
+	uri := creds.Hostname()
+	if mid := transport.ModuleID(creds); mid != "" {
+		cid += "/" + mid
+		uri += "/devices/" + creds.DeviceID() + "/modules/" + mid
+	}
+	broker := transport.GatewayHostname(creds)
+	if broker == "" {
+		broker = creds.Hostname()
+	}
+
+	username := creds.Hostname() + "/" + cid + "/api-version=" + common.APIVersion
+	if creds.IsSAS() {
+		tr.mint = func(ctx context.Context) (string, error) {
+			return creds.Token(ctx, uri, tokenLifetime)
+		}
+		if err := tr.mintToken(ctx); err != nil {
+			return err
+		}
+	}
 	o := mqtt.NewClientOptions()
-	o.SetTLSConfig(creds.TLSConfig())
-	o.AddBroker("tls://" + creds.Hostname() + ":8883")
-	o.SetClientID(creds.DeviceID())
+	tc := creds.TLSConfig()
+	if err := tr.setBroker(o, broker, tc, creds.IsSAS()); err != nil {
+		return err
+	}
+	o.SetClientID(cid)
 	o.SetCredentialsProvider(func() (string, string) {
 		if !creds.IsSAS() {
 			return username, ""
 		}
-		// TODO: renew token only when it expires in case an external token provider is used
-		// TODO: this can slow down the reconnect feature, so need to figure out max token lifetime
-		password, err := creds.Token(ctx, creds.Hostname(), time.Hour)
-		if err != nil {
-			panic(err)
-		}
-		return username, password
+		return username, tr.password()
 	})
+	if tr.persistent {
+		o.SetCleanSession(false)
+		o.SetDefaultPublishHandler(tr.handleUnrouted)
+	}
 	o.SetWriteTimeout(30 * time.Second)
 	o.SetMaxReconnectInterval(30 * time.Second) // default is 15min, way to long
 	o.SetOnConnectHandler(func(c mqtt.Client) {
 		tr.logger.Debugf("connection established")
-		tr.subm.RLock()
-		for _, sub := range tr.subs {
-			if err := sub(); err != nil {
-				tr.logger.Debugf("on-connect error: %s", err)
-			}
-		}
-		tr.subm.RUnlock()
+		atomic.StoreInt32(&tr.online, 1)
+		tr.resubscribe()
 	})
 	o.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
 		tr.logger.Debugf("connection lost: %v", err)
+		atomic.StoreInt32(&tr.online, 0)
+		if tr.lost != nil {
+			tr.lost(err)
+		}
 	})
+	if tr.lost != nil {
+		o.SetAutoReconnect(false)
+	}
 
 	if tr.cocfg != nil {
 		tr.cocfg(o)
 	}
 
+	// set before connecting, messages of a persistent
+	// session may arrive even before Connect returns
+	tr.did = creds.DeviceID()
+	tr.mid = transport.ModuleID(creds)
+
 	c := mqtt.NewClient(o)
-	if err := contextToken(ctx, c.Connect()); err != nil {
+	t := c.Connect()
+	if err := contextToken(ctx, t); err != nil {
+		if tr.relay != nil {
+			tr.relay.Close()
+			tr.relay = nil
+		}
+		return connectError(t.(*mqtt.ConnectToken).ReturnCode(), err)
+	}
+	tr.conn = c
+	return nil
+}
+
+// setBroker configures the broker address and TLS, connections
+// go through a loopback relay when a proxy is used.
+func (tr *Transport) setBroker(o *mqtt.ClientOptions, host string, tc *tls.Config, sas bool) error {
+	addr := net.JoinHostPort(host, "8883")
+	if tr.ws {
+		addr = net.JoinHostPort(host, "443")
+	}
+	u := tr.proxy
+	if u == nil {
+		var err error
+		if u, err = proxy.FromEnvironment(addr); err != nil {
+			return err
+		}
+	}
+	if u == nil {
+		o.SetTLSConfig(tc)
+		o.AddBroker(tr.brokerURL(host))
+		return nil
+	}
+	if !sas {
+		return errProxyX509
+	}
+
+	var err error
+	if tr.relay, err = startRelay(u, addr, tr.ws, tc); err != nil {
 		return err
 	}
+	if !tr.ws {
+		o.SetTLSConfig(tr.relay.TLSConfig())
+	}
+	o.AddBroker(tr.relay.URL())
+	return nil
+}
 
-	tr.did = creds.DeviceID()
-	tr.conn = c
+// brokerURL returns the url of the given broker host.
+func (tr *Transport) brokerURL(host string) string {
+	if tr.ws {
+		return "wss://" + host + ":443/$iothub/websocket"
+	}
+	return "tls://" + host + ":8883"
+}
+
+// tokenLifetime is the lifetime of SAS tokens connections are authenticated with.
+const tokenLifetime = time.Hour
+
+// tokenTimeout limits minting tokens when the library reconnects on its own.
+const tokenTimeout = 30 * time.Second
+
+// mintToken mints a token for the next connection attempt.
+func (tr *Transport) mintToken(ctx context.Context) error {
+	if tr.mint == nil {
+		return nil
+	}
+	token, err := tr.mint(ctx)
+	if err != nil {
+		return err
+	}
+	tr.tokm.Lock()
+	tr.token, tr.fresh = token, true
+	tr.tokm.Unlock()
+	if exp, err := credentials.TokenExpiry(token); err == nil {
+		atomic.StoreInt64(&tr.expiry, exp.Unix())
+	}
+	return nil
+}
+
+// password returns the token minted for the current connection attempt,
+// attempts made by the library's reconnects mint a new one, falling back
+// to the previous token when that fails, the connection is refused then
+// only if it's expired and the library keeps reconnecting.
+func (tr *Transport) password() string {
+	tr.tokm.Lock()
+	fresh := tr.fresh
+	tr.tokm.Unlock()
+	if !fresh {
+		ctx, cancel := context.WithTimeout(context.Background(), tokenTimeout)
+		if err := tr.mintToken(ctx); err != nil {
+			tr.logger.Errorf("token error: %s", err)
+		}
+		cancel()
+	}
+	tr.tokm.Lock()
+	defer tr.tokm.Unlock()
+	tr.fresh = false
+	return tr.token
+}
+
+// TokenExpiry implements transport.TokenRenewer.
+func (tr *Transport) TokenExpiry() time.Time {
+	if se := atomic.LoadInt64(&tr.expiry); se != 0 {
+		return time.Unix(se, 0)
+	}
+	return time.Time{}
+}
+
+// RenewToken implements transport.TokenRenewer, MQTT cannot re-authenticate
+// a live connection so it reconnects with a fresh token, subscriptions are
+// restored on connect the same way they are after connection losses.
+func (tr *Transport) RenewToken(ctx context.Context) error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	select {
+	case <-tr.done:
+		return errors.New("closed")
+	default:
+	}
+	if tr.conn == nil {
+		return errors.New("not connected")
+	}
+	if err := tr.mintToken(ctx); err != nil {
+		return err
+	}
+	atomic.StoreInt32(&tr.online, 0)
+	tr.conn.Disconnect(disconnectQuiesce)
+	t := tr.conn.Connect()
+	if err := contextToken(ctx, t); err != nil {
+		return connectError(t.(*mqtt.ConnectToken).ReturnCode(), err)
+	}
 	return nil
 }
 
-type subFunc func() error
+// connectError classifies CONNACK return codes the same way
+// the official SDKs do, IoT Hub refuses disabled devices with
+// the not authorized code and invalid credentials with the rest,
+// other errors such as network failures are returned as is.
+func connectError(rc byte, err error) error {
+	var cerr error
+	switch rc {
+	case packets.ErrRefusedNotAuthorised:
+		cerr = transport.ErrDeviceDisabled
+	case packets.ErrRefusedBadUsernameOrPassword, packets.ErrRefusedIDRejected:
+		cerr = transport.ErrUnauthorized
+	case packets.ErrRefusedServerUnavailable:
+		cerr = transport.ErrServerUnavailable
+	case packets.ErrRefusedBadProtocolVersion:
+		cerr = transport.ErrBadProtocolVersion
+	default:
+		return err
+	}
+	return &transport.ConnectError{Code: rc, Err: cerr}
+}
+
+type subFunc func(ctx context.Context) error
 
-// sub invokes the given sub function and if it passes with no error,
-// pushes it to the on-re-connect subscriptions list, because the client
-// has to resubscribe every reconnect.
-func (tr *Transport) sub(sub subFunc) error {
-	if err := sub(); err != nil {
+// sub invokes the given sub function with ctx and if it passes with no
+// error, saves it to the on-re-connect subscriptions, because the client
+// has to resubscribe every reconnect, that's done with tr.ctx since
+// the caller's context may be long gone by then.
+//
+// Subscriptions are keyed by topic filter so subscribing to the same
+// topic again, e.g. when registrations are replayed after a reconnect,
+// replaces the previous one instead of piling up duplicates.
+func (tr *Transport) sub(ctx context.Context, topic string, sub subFunc) error {
+	if err := sub(ctx); err != nil {
 		return err
 	}
 	tr.subm.Lock()
-	tr.subs = append(tr.subs, sub)
+	if tr.subs == nil {
+		tr.subs = map[string]subFunc{}
+	}
+	tr.subs[topic] = sub
 	tr.subm.Unlock()
 	return nil
 }
 
+// resubscribe restores all subscriptions on a new connection.
+func (tr *Transport) resubscribe() {
+	tr.subm.RLock()
+	defer tr.subm.RUnlock()
+	for topic, sub := range tr.subs {
+		err := sub(tr.ctx)
+		if err != nil {
+			tr.logger.Debugf("on-connect error: %s", err)
+		}
+		if kind, ok := tr.subscriptionKind(topic); ok && tr.observer != nil {
+			tr.observer.OnResubscribe(kind, "", err)
+		}
+	}
+}
+
+// subscriptionKind returns the kind of the named topic filter
+// subscription, internal subscriptions have no kind.
+func (tr *Transport) subscriptionKind(topic string) (transport.SubscriptionKind, bool) {
+	switch topic {
+	case tr.eventsTopic():
+		return transport.SubscriptionEvents, true
+	case twinUpdatesTopic:
+		return transport.SubscriptionTwin, true
+	case directMethodsTopic:
+		return transport.SubscriptionMethod, true
+	default:
+		return "", false
+	}
+}
+
 func (tr *Transport) SubscribeEvents(ctx context.Context, mux transport.MessageDispatcher) error {
-	return tr.sub(tr.subEvents(ctx, mux))
+	tr.evm.Lock()
+	tr.evMux = mux
+	if len(tr.pending) != 0 && !tr.flushing {
+		// it cannot be done synchronously because the dispatcher
+		// may block until the caller starts reading messages
+		tr.flushing = true
+		go tr.flushPending(mux)
+	}
+	tr.evm.Unlock()
+	return tr.sub(ctx, tr.eventsTopic(), tr.subEvents())
+}
+
+// flushPending dispatches held messages in order, including ones
+// that arrive while it's running, and then clears tr.flushing.
+func (tr *Transport) flushPending(mux transport.MessageDispatcher) {
+	for {
+		tr.evm.Lock()
+		pending := tr.pending
+		tr.pending = nil
+		if len(pending) == 0 {
+			tr.flushing = false
+			tr.evm.Unlock()
+			return
+		}
+		tr.evm.Unlock()
+		for _, msg := range pending {
+			mux.Dispatch(msg)
+		}
+	}
 }
 
-func (tr *Transport) subEvents(ctx context.Context, mux transport.MessageDispatcher) subFunc {
-	return func() error {
+func (tr *Transport) subEvents() subFunc {
+	return func(ctx context.Context) error {
 		return contextToken(ctx, tr.conn.Subscribe(
-			"devices/"+tr.did+"/messages/devicebound/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
-				msg, err := parseEventMessage(m)
-				if err != nil {
-					tr.logger.Errorf("message parse error: %s", err)
-					return
-				}
-				mux.Dispatch(msg)
+			tr.eventsTopic(), byte(tr.eqos), func(_ mqtt.Client, m mqtt.Message) {
+				tr.handleEvent(m)
 			},
 		))
 	}
 }
 
+// handleUnrouted handles messages of a persistent session
+// delivered before the corresponding subscription is made.
+func (tr *Transport) handleUnrouted(_ mqtt.Client, m mqtt.Message) {
+	if !strings.HasPrefix(m.Topic(), strings.TrimSuffix(tr.eventsTopic(), "#")) {
+		tr.logger.Warnf("unexpected message on %q", m.Topic())
+		return
+	}
+	tr.handleEvent(m)
+}
+
+// handleEvent dispatches a cloud-to-device message,
+// or holds it until SubscribeEvents is called.
+func (tr *Transport) handleEvent(m mqtt.Message) {
+	msg, err := parseEventMessage(m)
+	if err != nil {
+		tr.logger.Errorf("message parse error: %s", err)
+		return
+	}
+	// MQTT has no way to reject or abandon a message,
+	// it's completed as soon as the hub sends it with QoS 0
+	// or as soon as the library acknowledges it with QoS 1.
+	if ack := msg.Properties["iothub-ack"]; m.Qos() == 0 &&
+		(ack == "positive" || ack == "full") {
+		tr.logger.Warnf("message %q requests %s feedback but it's completed on send with QoS 0",
+			msg.MessageID, ack)
+	}
+
+	tr.evm.Lock()
+	mux := tr.evMux
+	if mux == nil || tr.flushing {
+		if len(tr.pending) < MaxPendingEvents {
+			tr.pending = append(tr.pending, msg)
+		} else {
+			atomic.AddUint64(&tr.dropped, 1)
+			tr.logger.Warnf("message %q dropped, %d messages are already held until subscribing",
+				msg.MessageID, MaxPendingEvents)
+		}
+		tr.evm.Unlock()
+		return
+	}
+	tr.evm.Unlock()
+	mux.Dispatch(msg)
+}
+
+// DroppedMessages implements transport.DropReporter.
+func (tr *Transport) DroppedMessages() uint64 {
+	return atomic.LoadUint64(&tr.dropped)
+}
+
 func (tr *Transport) SubscribeTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) error {
-	return tr.sub(tr.subTwinUpdates(ctx, mux))
+	return tr.sub(ctx, twinUpdatesTopic, tr.subTwinUpdates(mux))
 }
 
-func (tr *Transport) subTwinUpdates(ctx context.Context, mux transport.TwinStateDispatcher) subFunc {
-	return func() error {
+func (tr *Transport) subTwinUpdates(mux transport.TwinStateDispatcher) subFunc {
+	return func(ctx context.Context) error {
 		return contextToken(ctx, tr.conn.Subscribe(
-			"$iothub/twin/PATCH/properties/desired/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
+			twinUpdatesTopic, byte(tr.tqos), func(_ mqtt.Client, m mqtt.Message) {
 				mux.Dispatch(m.Payload())
 			},
 		))
 	}
 }
 
+// eventsTopic returns the cloud-to-device messages topic filter,
+// modules receive messages routed to their inputs instead.
+func (tr *Transport) eventsTopic() string {
+	if tr.mid != "" {
+		return "devices/" + tr.did + "/modules/" + tr.mid + "/inputs/#"
+	}
+	return "devices/" + tr.did + "/messages/devicebound/#"
+}
+
+// telemetryTopic returns the device-to-cloud messages topic prefix.
+func (tr *Transport) telemetryTopic() string {
+	if tr.mid != "" {
+		return "devices/" + tr.did + "/modules/" + tr.mid + "/messages/events/"
+	}
+	return "devices/" + tr.did + "/messages/events/"
+}
+
 func parseEventMessage(m mqtt.Message) (*common.Message, error) {
 	p, err := parseCloudToDeviceTopic(m.Topic())
 	if err != nil {
@@ -205,12 +680,24 @@ func parseEventMessage(m mqtt.Message) (*common.Message, error) {
 			e.UserID = v
 		case "$.to":
 			e.To = v
+		case "$.ct":
+			e.ContentType = v
+		case "$.ce":
+			e.ContentEncoding = v
+		case "$.ifid":
+			e.InterfaceID = v
 		case "$.exp":
 			t, err := time.Parse(time.RFC3339, v)
 			if err != nil {
 				return nil, err
 			}
 			e.ExpiryTime = &t
+		case "$.ctime":
+			t, err := time.Parse(time.RFC3339Nano, v)
+			if err != nil {
+				return nil, err
+			}
+			e.CreationTime = &t
 		default:
 			e.Properties[k] = v
 		}
@@ -247,26 +734,43 @@ func parseCloudToDeviceTopic(s string) (map[string]string, error) {
 }
 
 func (tr *Transport) RegisterDirectMethods(ctx context.Context, mux transport.MethodDispatcher) error {
-	return tr.sub(tr.subDirectMethods(ctx, mux))
+	return tr.sub(ctx, directMethodsTopic, tr.subDirectMethods(mux))
 }
 
-func (tr *Transport) subDirectMethods(ctx context.Context, mux transport.MethodDispatcher) subFunc {
-	return func() error {
+func (tr *Transport) subDirectMethods(mux transport.MethodDispatcher) subFunc {
+	return func(ctx context.Context) error {
 		return contextToken(ctx, tr.conn.Subscribe(
-			"$iothub/methods/POST/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
-				method, rid, err := parseDirectMethodTopic(m.Topic())
+			directMethodsTopic, byte(tr.mqos), func(_ mqtt.Client, m mqtt.Message) {
+				method, rid, props, err := parseDirectMethodTopic(m.Topic())
 				if err != nil {
 					tr.logger.Errorf("parse error: %s", err)
 					return
 				}
-				rc, b, err := mux.Dispatch(method, m.Payload())
+				// the invocation is running until its response is
+				// published so closing the client doesn't cut it off
+				if t, ok := mux.(transport.MethodResponseTracker); ok {
+					if err = t.StartResponse(); err != nil {
+						tr.logger.Warnf("method %q dropped: %s", method, err)
+						return
+					}
+					defer t.DoneResponse()
+				}
+				rc, b, err := mux.Dispatch(&transport.MethodRequest{
+					Name:       method,
+					RequestID:  strconv.Itoa(rid),
+					Properties: props,
+					Payload:    m.Payload(),
+				})
 				if err != nil {
 					tr.logger.Errorf("dispatch error: %s", err)
 					return
 				}
 				dst := fmt.Sprintf("$iothub/methods/res/%d/?$rid=%d", rc, rid)
-				if err = tr.send(ctx, dst, DefaultQoS, b); err != nil {
+				if err = tr.send(tr.ctx, dst, DefaultQoS, false, b); err != nil {
 					tr.logger.Errorf("method response error: %s", err)
+					if h, ok := mux.(transport.MethodResponseErrorHandler); ok {
+						h.HandleResponseError(method, strconv.Itoa(rid), err)
+					}
 					return
 				}
 			},
@@ -276,32 +780,43 @@ func (tr *Transport) subDirectMethods(ctx context.Context, mux transport.MethodD
 
 // returns method name and rid
 // format: $iothub/methods/POST/{method}/?$rid={rid}
-func parseDirectMethodTopic(s string) (string, int, error) {
+//
+// The topic is parsed before unescaping so method names are
+// delivered intact, e.g. component commands `{component}*{command}`.
+func parseDirectMethodTopic(s string) (string, int, map[string]string, error) {
 	const prefix = "$iothub/methods/POST/"
 
-	s, err := url.QueryUnescape(s)
-	if err != nil {
-		return "", 0, err
-	}
 	u, err := url.Parse(s)
 	if err != nil {
-		return "", 0, err
+		return "", 0, nil, err
 	}
 
 	p := strings.TrimRight(u.Path, "/")
 	if !strings.HasPrefix(p, prefix) {
-		return "", 0, errors.New("malformed direct method topic")
+		return "", 0, nil, errors.New("malformed direct method topic")
 	}
 
 	q := u.Query()
 	if len(q["$rid"]) != 1 {
-		return "", 0, errors.New("$rid is not available")
+		return "", 0, nil, errors.New("$rid is not available")
 	}
 	rid, err := strconv.Atoi(q["$rid"][0])
 	if err != nil {
-		return "", 0, fmt.Errorf("$rid parse error: %s", err)
+		return "", 0, nil, fmt.Errorf("$rid parse error: %s", err)
+	}
+
+	// the rest of parameters are invocation properties, e.g. trace context
+	var props map[string]string
+	for k, v := range q {
+		if k == "$rid" {
+			continue
+		}
+		if props == nil {
+			props = make(map[string]string, len(q)-1)
+		}
+		props[k] = v[0]
 	}
-	return p[len(prefix):], rid, nil
+	return p[len(prefix):], rid, props, nil
 }
 
 func (tr *Transport) RetrieveTwinProperties(ctx context.Context) ([]byte, error) {
@@ -309,9 +824,25 @@ func (tr *Transport) RetrieveTwinProperties(ctx context.Context) ([]byte, error)
 	if err != nil {
 		return nil, err
 	}
+	if tr.gzip {
+		return gunzip(r.body)
+	}
 	return r.body, nil
 }
 
+// gunzip decompresses b when it's gzip-encoded, otherwise returns it as is.
+func gunzip(b []byte) ([]byte, error) {
+	if len(b) < 2 || b[0] != 0x1f || b[1] != 0x8b {
+		return b, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
 func (tr *Transport) UpdateTwinProperties(ctx context.Context, b []byte) (int, error) {
 	r, err := tr.request(ctx, "$iothub/twin/PATCH/properties/reported/?$rid=%d", b)
 	if err != nil {
@@ -326,6 +857,9 @@ func (tr *Transport) request(ctx context.Context, topic string, b []byte) (*resp
 	}
 	rid := atomic.AddUint32(&tr.rid, 1) // increment rid counter
 	dst := fmt.Sprintf(topic, rid)
+	// the entry is removed on any return so responses that come
+	// after the caller gave up are dropped as unknown ones,
+	// the channel is buffered for them to never block the handler.
 	rch := make(chan *resp, 1)
 	tr.mu.Lock()
 	tr.resp[rid] = rch
@@ -336,18 +870,18 @@ func (tr *Transport) request(ctx context.Context, topic string, b []byte) (*resp
 		tr.mu.Unlock()
 	}()
 
-	if err := tr.send(ctx, dst, DefaultQoS, b); err != nil {
+	if err := tr.send(ctx, dst, DefaultQoS, false, b); err != nil {
 		return nil, err
 	}
 
 	select {
 	case r := <-rch:
-		if r.code < 200 && r.code > 299 {
+		if r.code < 200 || r.code > 299 {
 			return nil, fmt.Errorf("request failed with %d response code", r.code)
 		}
 		return r, nil
 	case <-time.After(30 * time.Second):
-		return nil, errors.New("request timed out")
+		return nil, transport.ErrTwinTimeout
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	}
@@ -361,47 +895,47 @@ func (tr *Transport) enableTwinResponses(ctx context.Context) error {
 	if tr.resp != nil {
 		return nil
 	}
-	if err := tr.sub(tr.subTwinResponses(ctx)); err != nil {
+	if err := tr.sub(ctx, twinResponsesTopic, tr.subTwinResponses()); err != nil {
 		return err
 	}
 	tr.resp = make(map[uint32]chan *resp)
 	return nil
 }
 
-func (tr *Transport) subTwinResponses(ctx context.Context) subFunc {
-	return func() error {
+func (tr *Transport) subTwinResponses() subFunc {
+	return func(ctx context.Context) error {
 		return contextToken(ctx, tr.conn.Subscribe(
-			"$iothub/twin/res/#", DefaultQoS, func(_ mqtt.Client, m mqtt.Message) {
-				rc, rid, ver, err := parseTwinPropsTopic(m.Topic())
-				if err != nil {
-					fmt.Printf("parse twin props topic error: %s", err)
-					return
-				}
-
-				tr.mu.RLock()
-				defer tr.mu.RUnlock()
-				for r, rch := range tr.resp {
-					if int(r) != rid {
-						continue
-					}
-					res := &resp{code: rc, ver: ver, body: m.Payload()}
-					select {
-					case rch <- res:
-						// try to push without a goroutine first
-						// if the channel buffer is not busy
-					default:
-						go func() {
-							rch <- res
-						}()
-					}
-					return
-				}
-				tr.logger.Warnf("unknown rid: %q", rid)
+			twinResponsesTopic, byte(tr.tqos), func(_ mqtt.Client, m mqtt.Message) {
+				tr.handleTwinResponse(m.Topic(), m.Payload())
 			},
 		))
 	}
 }
 
+// handleTwinResponse routes a twin response to the request waiting for it,
+// it never blocks, responses to unknown or abandoned requests and
+// duplicates are dropped.
+func (tr *Transport) handleTwinResponse(topic string, payload []byte) {
+	rc, rid, ver, err := parseTwinPropsTopic(topic)
+	if err != nil {
+		tr.logger.Errorf("parse twin props topic error: %s", err)
+		return
+	}
+
+	tr.mu.RLock()
+	rch, ok := tr.resp[uint32(rid)]
+	tr.mu.RUnlock()
+	if !ok {
+		tr.logger.Warnf("unknown rid: %d", rid)
+		return
+	}
+	select {
+	case rch <- &resp{code: rc, ver: ver, body: payload}:
+	default:
+		tr.logger.Warnf("duplicate response for rid: %d", rid)
+	}
+}
+
 // parseTwinPropsTopic parses the given topic name into rc, rid and ver.
 // $iothub/twin/res/{rc}/?$rid={rid}(&$version={ver})?
 func parseTwinPropsTopic(s string) (int, int, int, error) {
@@ -441,10 +975,79 @@ func parseTwinPropsTopic(s string) (int, int, int, error) {
 }
 
 func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
+	dst, qos, err := tr.publishArgs(msg)
+	if err != nil {
+		return err
+	}
+	retain, _ := msg.TransportOptions["retain"].(bool)
+	return tr.send(ctx, dst, qos, retain, msg.Payload)
+}
+
+// SendBatch implements transport.BatchSender, MQTT has no batches so
+// messages are published back to back in order without waiting for
+// acknowledgements in between, and then they're awaited all together.
+func (tr *Transport) SendBatch(ctx context.Context, msgs []*common.Message) []error {
+	errs := make([]error, len(msgs))
+	tr.mu.RLock()
+	conn := tr.conn
+	tr.mu.RUnlock()
+	if conn == nil {
+		for i := range errs {
+			errs[i] = errors.New("not connected")
+		}
+		return errs
+	}
+	ts := make([]mqtt.Token, len(msgs))
+	for i, msg := range msgs {
+		dst, qos, err := tr.publishArgs(msg)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		retain, _ := msg.TransportOptions["retain"].(bool)
+		ts[i] = conn.Publish(dst, byte(qos), retain, msg.Payload)
+	}
+	for i, t := range ts {
+		if t != nil {
+			errs[i] = contextToken(ctx, t)
+		}
+	}
+	return errs
+}
+
+// WireSize returns the size of the PUBLISH packet the message is sent in.
+func (tr *Transport) WireSize(msg *common.Message) (int, error) {
+	dst, qos, err := tr.publishArgs(msg)
+	if err != nil {
+		return 0, err
+	}
+	return publishSize(dst, qos, len(msg.Payload)), nil
+}
+
+// publishSize calculates size of a PUBLISH packet: the fixed header with
+// the variable-length encoded remaining length, the topic prefixed with its
+// length, the packet identifier (QoS > 0 only) and the payload.
+func publishSize(topic string, qos, payload int) int {
+	n := 2 + len(topic) + payload
+	if qos > 0 {
+		n += 2
+	}
+	h := 1
+	for l := n; ; l /= 128 {
+		h++
+		if l < 128 {
+			break
+		}
+	}
+	return h + n
+}
+
+// publishArgs returns the topic and QoS the message is published with.
+func (tr *Transport) publishArgs(msg *common.Message) (string, int, error) {
 	// this is just copying functionality from the nodejs sdk, but
 	// seems like adding meta attributes does nothing or in some cases,
 	// e.g. when $.exp is set the cloud just disconnects.
-	u := make(url.Values, len(msg.Properties)+5)
+	u := make(url.Values, len(msg.Properties)+6)
 	if msg.MessageID != "" {
 		u["$.mid"] = []string{msg.MessageID}
 	}
@@ -457,32 +1060,43 @@ func (tr *Transport) Send(ctx context.Context, msg *common.Message) error {
 	if msg.To != "" {
 		u["$.to"] = []string{msg.To}
 	}
+	if msg.ContentType != "" {
+		u["$.ct"] = []string{msg.ContentType}
+	}
+	if msg.ContentEncoding != "" {
+		u["$.ce"] = []string{msg.ContentEncoding}
+	}
+	if msg.InterfaceID != "" {
+		u["$.ifid"] = []string{msg.InterfaceID}
+	}
 	if msg.ExpiryTime != nil && !msg.ExpiryTime.IsZero() {
 		u["$.exp"] = []string{msg.ExpiryTime.UTC().Format(time.RFC3339)}
 	}
+	if msg.CreationTime != nil && !msg.CreationTime.IsZero() {
+		u["$.ctime"] = []string{msg.CreationTime.UTC().Format(time.RFC3339Nano)}
+	}
 	for k, v := range msg.Properties {
 		u[k] = []string{v}
 	}
 
-	dst := "devices/" + tr.did + "/messages/events/" + u.Encode()
 	qos := DefaultQoS
 	if q, ok := msg.TransportOptions["qos"]; ok {
 		qos = q.(int) // panic if it's not an int
 		if qos != 0 && qos != 1 {
-			return fmt.Errorf("invalid QoS value: %d", qos)
+			return "", 0, fmt.Errorf("invalid QoS value: %d", qos)
 		}
 	}
-	return tr.send(ctx, dst, qos, msg.Payload)
+	return tr.telemetryTopic() + u.Encode(), qos, nil
 }
 
-func (tr *Transport) send(ctx context.Context, topic string, qos int, b []byte) error {
+func (tr *Transport) send(ctx context.Context, topic string, qos int, retain bool, b []byte) error {
 	tr.mu.RLock()
 	if tr.conn == nil {
 		tr.mu.RUnlock()
 		return errors.New("not connected")
 	}
 	tr.mu.RUnlock()
-	return contextToken(ctx, tr.conn.Publish(topic, byte(qos), false, b))
+	return contextToken(ctx, tr.conn.Publish(topic, byte(qos), retain, b))
 }
 
 // mqtt lib doesn't support contexts currently
@@ -506,6 +1120,18 @@ func contextToken(ctx context.Context, t mqtt.Token) error {
 	}
 }
 
+func (tr *Transport) IsConnected() bool {
+	return atomic.LoadInt32(&tr.online) == 1
+}
+
+// disconnectQuiesce is how long Close waits in milliseconds
+// for the DISCONNECT packet and in-flight work to be written.
+const disconnectQuiesce = 250
+
+// Close sends the DISCONNECT packet before closing the connection, so the
+// hub registers the device as disconnected immediately, otherwise, e.g.
+// when the process is killed, the hub notices it only when the keep-alive
+// interval passes and triggers the will message if there's one.
 func (tr *Transport) Close() error {
 	tr.mu.Lock()
 	defer tr.mu.Unlock()
@@ -515,9 +1141,14 @@ func (tr *Transport) Close() error {
 	default:
 		close(tr.done)
 	}
+	tr.cancel()
+	atomic.StoreInt32(&tr.online, 0)
 	if tr.conn != nil && tr.conn.IsConnected() {
-		tr.conn.Disconnect(250)
+		tr.conn.Disconnect(disconnectQuiesce)
 		tr.logger.Debugf("disconnected")
 	}
+	if tr.relay != nil {
+		tr.relay.Close()
+	}
 	return nil
 }
@@ -1,8 +1,26 @@
 package mqtt
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
 	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 )
 
 func TestParseCloudToDeviceTopic(t *testing.T) {
@@ -24,7 +42,7 @@ func TestParseCloudToDeviceTopic(t *testing.T) {
 
 func TestParseDirectMethodTopic(t *testing.T) {
 	s := "$iothub/methods/POST/add/?$rid=666"
-	m, r, err := parseDirectMethodTopic(s)
+	m, r, _, err := parseDirectMethodTopic(s)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -33,6 +51,17 @@ func TestParseDirectMethodTopic(t *testing.T) {
 	}
 }
 
+func TestParseDirectMethodTopicProperties(t *testing.T) {
+	s := "$iothub/methods/POST/add/?$rid=1&traceparent=00-abc-def-01"
+	_, _, props, err := parseDirectMethodTopic(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"traceparent": "00-abc-def-01"}; !reflect.DeepEqual(props, want) {
+		t.Errorf("props = %v, want %v", props, want)
+	}
+}
+
 func TestParseTwinPropsTopic(t *testing.T) {
 	s := "$iothub/twin/res/200/?$rid=12&$version=4"
 	c, r, v, err := parseTwinPropsTopic(s)
@@ -43,3 +72,627 @@ func TestParseTwinPropsTopic(t *testing.T) {
 		t.Errorf("ParseTwinPropsTopic(%q) = %d, %q, %d, _, want %d, %q, %d, _", s, c, r, v, 200, 12, 4)
 	}
 }
+
+func TestConnectError(t *testing.T) {
+	other := errors.New("other")
+	for rc, want := range map[byte]error{
+		packets.ErrRefusedNotAuthorised:         transport.ErrDeviceDisabled,
+		packets.ErrRefusedBadUsernameOrPassword: transport.ErrUnauthorized,
+		packets.ErrRefusedIDRejected:            transport.ErrUnauthorized,
+		packets.ErrRefusedServerUnavailable:     transport.ErrServerUnavailable,
+		packets.ErrRefusedBadProtocolVersion:    transport.ErrBadProtocolVersion,
+	} {
+		err := connectError(rc, other)
+		if !errors.Is(err, want) {
+			t.Errorf("connectError(%d) = %v, want %v", rc, err, want)
+		}
+		cerr, ok := err.(*transport.ConnectError)
+		if !ok || cerr.Code != rc {
+			t.Errorf("connectError(%d) = %#v, want *ConnectError with the code", rc, err)
+			continue
+		}
+		if temp := rc == packets.ErrRefusedServerUnavailable; cerr.Temporary() != temp {
+			t.Errorf("connectError(%d).Temporary() = %t, want %t", rc, cerr.Temporary(), temp)
+		}
+	}
+	if err := connectError(packets.ErrNetworkError, other); err != other {
+		t.Errorf("connectError(%d) = %v, want %v", packets.ErrNetworkError, err, other)
+	}
+}
+
+func TestParseDirectMethodTopicComponent(t *testing.T) {
+	s := "$iothub/methods/POST/thermostat*getMaxMinReport/?$rid=1"
+	m, _, _, err := parseDirectMethodTopic(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != "thermostat*getMaxMinReport" {
+		t.Errorf("parseDirectMethodTopic(%q) = %q, want %q", s, m, "thermostat*getMaxMinReport")
+	}
+}
+
+// doneToken is a completed mqtt token, err is its error.
+type doneToken struct {
+	mqtt.Token
+	err error
+}
+
+func (doneToken) Wait() bool                     { return true }
+func (doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t doneToken) Error() error                 { return t.err }
+
+// fakeClient is an mqtt client that only publishes and
+// subscribes by calling publish and subscribe,
+// publishing fails with publishErr when it's set.
+type fakeClient struct {
+	mqtt.Client
+	publish    func(topic string, payload []byte)
+	publishErr error
+	retained   *bool // set to the retain flag of the last publish when not nil
+	subscribe  func(topic string, cb mqtt.MessageHandler)
+	qos        map[string]byte // subscriptions qos by topic filter when not nil
+}
+
+func (c fakeClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	if c.publishErr != nil {
+		return doneToken{err: c.publishErr}
+	}
+	if c.retained != nil {
+		*c.retained = retained
+	}
+	c.publish(topic, payload.([]byte))
+	return doneToken{}
+}
+
+func (c fakeClient) Subscribe(topic string, qos byte, cb mqtt.MessageHandler) mqtt.Token {
+	if c.qos != nil {
+		c.qos[topic] = qos
+	}
+	c.subscribe(topic, cb)
+	return doneToken{}
+}
+
+type fakeMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m fakeMessage) Topic() string   { return m.topic }
+func (m fakeMessage) Payload() []byte { return m.payload }
+func (m fakeMessage) Qos() byte       { return 1 }
+
+func TestTwinRequestsCleanup(t *testing.T) {
+	tr := New().(*Transport)
+	tr.SetLogger(common.NewLogger("test", common.LevelError, func(v ...interface{}) {}))
+	tr.resp = map[uint32]chan *resp{}
+
+	// odd requests get no response in time
+	var late []string
+	var mu sync.Mutex
+	tr.conn = fakeClient{publish: func(topic string, payload []byte) {
+		_, rid, _, err := parseTwinPropsTopic(
+			strings.Replace(topic, "$iothub/twin/GET", "$iothub/twin/res/200", 1),
+		)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		res := fmt.Sprintf("$iothub/twin/res/200/?$rid=%d", rid)
+		if rid%2 == 0 {
+			go tr.handleTwinResponse(res, []byte(`{}`))
+			return
+		}
+		mu.Lock()
+		late = append(late, res)
+		mu.Unlock()
+	}}
+
+	goroutines := runtime.NumGoroutine()
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			_, _ = tr.RetrieveTwinProperties(ctx)
+		}()
+	}
+	wg.Wait()
+
+	// late and duplicate responses must not block or leak
+	for _, res := range late {
+		tr.handleTwinResponse(res, []byte(`{}`))
+		tr.handleTwinResponse(res, []byte(`{}`))
+	}
+	if n := len(tr.resp); n != 0 {
+		t.Fatalf("%d pending requests left", n)
+	}
+	for i := 0; runtime.NumGoroutine() > goroutines; i++ {
+		if i == 100 {
+			t.Fatalf("goroutines leaked: %d, was %d", runtime.NumGoroutine(), goroutines)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGunzip(t *testing.T) {
+	want := []byte(`{"desired":{},"reported":{}}`)
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(want); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, b := range [][]byte{buf.Bytes(), want} {
+		have, err := gunzip(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("gunzip = %q, want %q", have, want)
+		}
+	}
+}
+
+func TestPublishArgsContent(t *testing.T) {
+	tr := New().(*Transport)
+	tr.did = "dev"
+	topic, _, err := tr.publishArgs(&common.Message{
+		ContentType:     "application/json",
+		ContentEncoding: "utf-8",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "devices/dev/messages/events/%24.ce=utf-8&%24.ct=application%2Fjson"
+	if topic != want {
+		t.Fatalf("topic = %q, want %q", topic, want)
+	}
+
+	ct := time.Date(2020, 1, 2, 3, 4, 5, 6e6, time.UTC)
+	if topic, _, err = tr.publishArgs(&common.Message{CreationTime: &ct}); err != nil {
+		t.Fatal(err)
+	}
+	want = "devices/dev/messages/events/%24.ctime=2020-01-02T03%3A04%3A05.006Z"
+	if topic != want {
+		t.Fatalf("topic = %q, want %q", topic, want)
+	}
+}
+
+func TestBrokerURL(t *testing.T) {
+	for tr, want := range map[*Transport]string{
+		New().(*Transport):                "tls://test.azure-devices.net:8883",
+		New(WithWebSocket()).(*Transport): "wss://test.azure-devices.net:443/$iothub/websocket",
+	} {
+		u := tr.brokerURL("test.azure-devices.net")
+		if u != want {
+			t.Errorf("brokerURL() = %q, want %q", u, want)
+		}
+		if _, err := url.Parse(u); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestPublishSize(t *testing.T) {
+	for _, v := range []struct {
+		topic   string
+		qos     int
+		payload int
+		want    int
+	}{
+		{"a", 0, 0, 5},
+		{"a", 1, 0, 7},
+		{"a", 1, 122, 129},
+		{"a", 1, 123, 131}, // remaining length takes two bytes
+	} {
+		if got := publishSize(v.topic, v.qos, v.payload); got != v.want {
+			t.Errorf("publishSize(%q, %d, %d) = %d, want %d",
+				v.topic, v.qos, v.payload, got, v.want)
+		}
+	}
+}
+
+type methodDispatcherFunc func(method, rid string, b []byte) (int, []byte, error)
+
+func (f methodDispatcherFunc) Dispatch(req *transport.MethodRequest) (int, []byte, error) {
+	return f(req.Name, req.RequestID, req.Payload)
+}
+
+func TestRegisterDirectMethodsReplay(t *testing.T) {
+	tr := New().(*Transport)
+	tr.SetLogger(common.NewLogger("test", common.LevelError, func(v ...interface{}) {}))
+
+	var subs int
+	var handler mqtt.MessageHandler
+	res := make(chan string, 1)
+	tr.conn = fakeClient{
+		publish: func(topic string, payload []byte) {
+			res <- topic
+		},
+		subscribe: func(topic string, cb mqtt.MessageHandler) {
+			subs++
+			handler = cb
+		},
+	}
+
+	mux := methodDispatcherFunc(func(method, rid string, b []byte) (int, []byte, error) {
+		return 200, []byte(`{}`), nil
+	})
+	for i := 0; i < 2; i++ {
+		if err := tr.RegisterDirectMethods(context.Background(), mux); err != nil {
+			t.Fatalf("registration #%d: %s", i+1, err)
+		}
+	}
+	if n := len(tr.subs); n != 1 {
+		t.Fatalf("len(subs) = %d, want %d", n, 1)
+	}
+
+	// reconnect
+	tr.resubscribe()
+	if subs != 3 {
+		t.Fatalf("subscribed %d times, want %d", subs, 3)
+	}
+	handler(nil, fakeMessage{topic: "$iothub/methods/POST/ping/?$rid=1"})
+	if got, want := <-res, "$iothub/methods/res/200/?$rid=1"; got != want {
+		t.Fatalf("response topic = %q, want %q", got, want)
+	}
+}
+
+type messageDispatcherFunc func(msg *common.Message)
+
+func (f messageDispatcherFunc) Dispatch(msg *common.Message) {
+	f(msg)
+}
+
+func TestPersistentSessionPending(t *testing.T) {
+	tr := New(WithPersistentSession()).(*Transport)
+	tr.SetLogger(common.NewLogger("test", common.LevelError, func(v ...interface{}) {}))
+	tr.did = "dev"
+
+	var handler mqtt.MessageHandler
+	tr.conn = fakeClient{subscribe: func(topic string, cb mqtt.MessageHandler) {
+		handler = cb
+	}}
+	message := func(mid int) mqtt.Message {
+		return fakeMessage{topic: fmt.Sprintf("devices/dev/messages/devicebound/%%24.mid=%d", mid)}
+	}
+
+	// delivered right after reconnecting before subscribing
+	for i := 1; i <= 3; i++ {
+		tr.handleUnrouted(nil, message(i))
+	}
+	tr.handleUnrouted(nil, fakeMessage{topic: "$iothub/twin/res/200/?$rid=1"})
+
+	msgc := make(chan *common.Message) // unbuffered to check it never blocks
+	if err := tr.SubscribeEvents(context.Background(), messageDispatcherFunc(func(msg *common.Message) {
+		msgc <- msg
+	})); err != nil {
+		t.Fatal(err)
+	}
+	go handler(nil, message(4))
+
+	for i := 1; i <= 4; i++ {
+		select {
+		case msg := <-msgc:
+			if want := strconv.Itoa(i); msg.MessageID != want {
+				t.Fatalf("MessageID = %q, want %q", msg.MessageID, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d is not delivered", i)
+		}
+	}
+}
+
+func TestPersistentSessionPendingLimit(t *testing.T) {
+	tr := New(WithPersistentSession()).(*Transport)
+	tr.SetLogger(common.NewLogger("test", common.LevelError, func(v ...interface{}) {}))
+	tr.did = "dev"
+
+	for i := 0; i < MaxPendingEvents+2; i++ {
+		tr.handleUnrouted(nil, fakeMessage{
+			topic: fmt.Sprintf("devices/dev/messages/devicebound/%%24.mid=%d", i),
+		})
+	}
+	if n := len(tr.pending); n != MaxPendingEvents {
+		t.Fatalf("%d messages held, want %d", n, MaxPendingEvents)
+	}
+	if n := tr.DroppedMessages(); n != 2 {
+		t.Fatalf("DroppedMessages() = %d, want %d", n, 2)
+	}
+	if mid := tr.pending[0].MessageID; mid != "0" {
+		t.Fatalf("the first held message is %q, want %q", mid, "0")
+	}
+}
+
+// failingDispatcher records method responses failed to be delivered.
+type failingDispatcher struct {
+	methodDispatcherFunc
+	errc chan error
+}
+
+func (d failingDispatcher) HandleResponseError(method, rid string, err error) {
+	d.errc <- fmt.Errorf("%s %s: %s", method, rid, err)
+}
+
+func TestMethodResponseError(t *testing.T) {
+	tr := New().(*Transport)
+	tr.SetLogger(common.NewLogger("test", common.LevelError, func(v ...interface{}) {}))
+
+	var handler mqtt.MessageHandler
+	tr.conn = fakeClient{
+		publishErr: errors.New("connection lost"),
+		subscribe: func(topic string, cb mqtt.MessageHandler) {
+			handler = cb
+		},
+	}
+	d := failingDispatcher{
+		methodDispatcherFunc: func(method, rid string, b []byte) (int, []byte, error) {
+			return 200, []byte(`{}`), nil
+		},
+		errc: make(chan error, 1),
+	}
+	if err := tr.RegisterDirectMethods(context.Background(), d); err != nil {
+		t.Fatal(err)
+	}
+	handler(nil, fakeMessage{topic: "$iothub/methods/POST/reboot/?$rid=7"})
+	select {
+	case err := <-d.errc:
+		if want := "reboot 7: connection lost"; err.Error() != want {
+			t.Fatalf("error = %q, want %q", err, want)
+		}
+	default:
+		t.Fatal("response error is not reported")
+	}
+}
+
+// resubscribeObserver records resubscription errors.
+type resubscribeObserver struct {
+	transport.SubscriptionObserver
+	errs []error
+}
+
+func (o *resubscribeObserver) OnResubscribe(kind transport.SubscriptionKind, name string, err error) {
+	o.errs = append(o.errs, err)
+}
+
+func TestRegisterDirectMethodsContext(t *testing.T) {
+	tr := New().(*Transport)
+	tr.SetLogger(common.NewLogger("test", common.LevelError, func(v ...interface{}) {}))
+	o := &resubscribeObserver{}
+	tr.SetSubscriptionObserver(o)
+
+	var handler mqtt.MessageHandler
+	var published int
+	tr.conn = fakeClient{
+		publish: func(topic string, payload []byte) {
+			published++
+		},
+		subscribe: func(topic string, cb mqtt.MessageHandler) {
+			handler = cb
+		},
+	}
+	d := failingDispatcher{
+		methodDispatcherFunc: func(method, rid string, b []byte) (int, []byte, error) {
+			return 200, []byte(`{}`), nil
+		},
+		errc: make(chan error, 10),
+	}
+
+	// the registration context is done long before methods are invoked
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := tr.RegisterDirectMethods(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	// contextToken picks randomly between a done token and
+	// a done context, so it's repeated to catch the latter
+	for i := 0; i < 10; i++ {
+		tr.resubscribe()
+		handler(nil, fakeMessage{topic: fmt.Sprintf("$iothub/methods/POST/reboot/?$rid=%d", i)})
+	}
+	for _, err := range o.errs {
+		if err != nil {
+			t.Fatalf("resubscribe error: %s", err)
+		}
+	}
+	select {
+	case err := <-d.errc:
+		t.Fatalf("response error: %s", err)
+	default:
+	}
+	if published != 10 {
+		t.Fatalf("published %d responses, want %d", published, 10)
+	}
+}
+
+type twinDispatcherFunc func(b []byte)
+
+func (f twinDispatcherFunc) Dispatch(b []byte) {
+	f(b)
+}
+
+func TestSubscriptionsQoS(t *testing.T) {
+	for _, v := range []struct {
+		opts []TransportOption
+		want map[string]byte
+	}{
+		{nil, map[string]byte{
+			"devices/dev/messages/devicebound/#": DefaultQoS,
+			twinUpdatesTopic:                     DefaultQoS,
+			twinResponsesTopic:                   DefaultQoS,
+			directMethodsTopic:                   DefaultQoS,
+		}},
+		{[]TransportOption{WithEventsQoS(0), WithTwinQoS(1), WithMethodsQoS(0)}, map[string]byte{
+			"devices/dev/messages/devicebound/#": 0,
+			twinUpdatesTopic:                     1,
+			twinResponsesTopic:                   1,
+			directMethodsTopic:                   0,
+		}},
+		{[]TransportOption{WithEventsQoS(1), WithTwinQoS(0), WithMethodsQoS(1)}, map[string]byte{
+			"devices/dev/messages/devicebound/#": 1,
+			twinUpdatesTopic:                     0,
+			twinResponsesTopic:                   0,
+			directMethodsTopic:                   1,
+		}},
+	} {
+		tr := New(v.opts...).(*Transport)
+		tr.SetLogger(common.NewLogger("test", common.LevelError, func(v ...interface{}) {}))
+		tr.did = "dev"
+		qos := map[string]byte{}
+		tr.conn = fakeClient{
+			qos:       qos,
+			subscribe: func(topic string, cb mqtt.MessageHandler) {},
+		}
+
+		ctx := context.Background()
+		if err := tr.SubscribeEvents(ctx, messageDispatcherFunc(func(*common.Message) {})); err != nil {
+			t.Fatal(err)
+		}
+		if err := tr.SubscribeTwinUpdates(ctx, twinDispatcherFunc(func([]byte) {})); err != nil {
+			t.Fatal(err)
+		}
+		if err := tr.enableTwinResponses(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if err := tr.RegisterDirectMethods(ctx, methodDispatcherFunc(nil)); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(qos, v.want) {
+			t.Errorf("subscriptions qos = %v, want %v", qos, v.want)
+		}
+	}
+}
+
+func TestInvalidQoS(t *testing.T) {
+	for name, opt := range map[string]func(int) TransportOption{
+		"WithEventsQoS":  WithEventsQoS,
+		"WithTwinQoS":    WithTwinQoS,
+		"WithMethodsQoS": WithMethodsQoS,
+	} {
+		for _, qos := range []int{-1, 2, 3} {
+			func() {
+				defer func() {
+					if recover() == nil {
+						t.Errorf("%s(%d) doesn't panic", name, qos)
+					}
+				}()
+				opt(qos)
+			}()
+		}
+	}
+}
+
+func TestSendRetain(t *testing.T) {
+	tr := New().(*Transport)
+	var retained bool
+	tr.conn = fakeClient{
+		publish:  func(topic string, payload []byte) {},
+		retained: &retained,
+	}
+	for _, retain := range []bool{true, false} {
+		if err := tr.Send(context.Background(), &common.Message{
+			Payload:          []byte("on"),
+			TransportOptions: map[string]interface{}{"retain": retain},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if retained != retain {
+			t.Fatalf("retained = %t, want %t", retained, retain)
+		}
+	}
+}
+
+type testCreds struct {
+	transport.Credentials
+}
+
+func (testCreds) DeviceID() string        { return "dev" }
+func (testCreds) ModuleID() string        { return "" }
+func (testCreds) Hostname() string        { return "test.azure-devices.net" }
+func (testCreds) GatewayHostname() string { return "" }
+func (testCreds) IsSAS() bool             { return false }
+func (testCreds) TLSConfig() *tls.Config  { return &tls.Config{} }
+
+func TestCloseSendsDisconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// the broker records packets it reads until the connection is torn down
+	pktc := make(chan []packets.ControlPacket, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var pkts []packets.ControlPacket
+		defer func() { pktc <- pkts }()
+		for {
+			p, err := packets.ReadPacket(conn)
+			if err != nil {
+				return
+			}
+			pkts = append(pkts, p)
+			if _, ok := p.(*packets.ConnectPacket); ok {
+				ack := packets.NewControlPacket(packets.Connack)
+				if err = ack.Write(conn); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	tr := New(WithClientOptionsConfig(func(o *mqtt.ClientOptions) {
+		o.Servers = nil
+		o.AddBroker("tcp://" + l.Addr().String())
+	})).(*Transport)
+	tr.SetLogger(common.NewLogger("test", common.LevelError, func(v ...interface{}) {}))
+	if err := tr.Connect(context.Background(), testCreds{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case pkts := <-pktc:
+		if len(pkts) == 0 {
+			t.Fatal("no packets received")
+		}
+		if _, ok := pkts[len(pkts)-1].(*packets.DisconnectPacket); !ok {
+			t.Fatalf("last packet = %v, want DISCONNECT", pkts[len(pkts)-1])
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection is not closed")
+	}
+}
+
+// sasCreds fail to mint tokens with err.
+type sasCreds struct {
+	testCreds
+	err error
+}
+
+func (sasCreds) IsSAS() bool { return true }
+func (c sasCreds) Token(context.Context, string, time.Duration) (string, error) {
+	return "", c.err
+}
+
+func TestConnectTokenError(t *testing.T) {
+	tr := New().(*Transport)
+	tr.SetLogger(common.NewLogger("test", common.LevelError, func(v ...interface{}) {}))
+	want := errors.New("workload api is unavailable")
+	if err := tr.Connect(context.Background(), sasCreds{err: want}); err != want {
+		t.Fatalf("Connect error = %v, want %v", err, want)
+	}
+}
@@ -0,0 +1,210 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+func TestRelayWebSocket(t *testing.T) {
+	hosts := make(chan string, 1)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hosts <- fmt.Sprintf("%s %s %d", r.Host, r.Header.Get("Origin"), len(r.TLS.PeerCertificates))
+		io.WriteString(w, "ok")
+	}))
+	s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	s.StartTLS()
+	defer s.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	p := connectStub(t)
+	defer p.Close()
+	u, err := url.Parse("http://" + p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// client certificates must never reach the relay
+	_, client, err := relayTLS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := startRelay(u, s.Listener.Addr().String(), true, &tls.Config{
+		ServerName:   "127.0.0.1",
+		RootCAs:      pool,
+		Certificates: client.Certificates,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// the handshake is sent in plaintext to the relay the way the mqtt library does
+	res, err := http.Get("http" + strings.TrimPrefix(r.URL(), "ws"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ok" {
+		t.Fatalf("body = %q, want %q", b, "ok")
+	}
+	if host, want := <-hosts, "127.0.0.1 https://127.0.0.1 0"; host != want {
+		t.Fatalf("host, origin and client certificates = %q, want %q", host, want)
+	}
+}
+
+func TestRelayTLS(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer s.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(s.Certificate())
+
+	p := connectStub(t)
+	defer p.Close()
+	u, err := url.Parse("http://" + p.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := startRelay(u, s.Listener.Addr().String(), false, &tls.Config{
+		ServerName: "127.0.0.1",
+		RootCAs:    pool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: r.TLSConfig()}}
+	res, err := c.Get("https://" + r.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "ok" {
+		t.Fatalf("body = %q, want %q", b, "ok")
+	}
+}
+
+func TestRelayRefusesStrays(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialed := make(chan struct{}, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.Close()
+		dialed <- struct{}{}
+	}()
+	u, err := url.Parse("http://" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ws, err := startRelay(u, "127.0.0.1:443", true, &tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	for _, path := range []string{"/$iothub/websocket", "/secret/$iothub/websocket"} {
+		res, err := http.Get("http://" + ws.Addr() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Fatalf("%s: status = %d, want %d", path, res.StatusCode, http.StatusForbidden)
+		}
+	}
+
+	r, err := startRelay(u, "127.0.0.1:8883", false, &tls.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	conn, err := tls.Dial("tcp", r.Addr(), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		_, err = conn.Read(make([]byte, 1))
+		conn.Close()
+	}
+	if err == nil {
+		t.Fatal("connection without the relay certificate is served")
+	}
+
+	select {
+	case <-dialed:
+		t.Fatal("proxy is dialed for a stray connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// connectStub starts a minimal CONNECT proxy.
+func connectStub(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				req, err := http.ReadRequest(br)
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				remote, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					return
+				}
+				defer remote.Close()
+				io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+				go io.Copy(remote, br)
+				io.Copy(conn, remote)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestProxyX509(t *testing.T) {
+	tr := New(WithProxy("http://127.0.0.1:3128")).(*Transport)
+	if err := tr.setBroker(mqtt.NewClientOptions(), "test.azure-devices.net", &tls.Config{}, false); err != errProxyX509 {
+		t.Fatalf("setBroker error = %v, want %v", err, errProxyX509)
+	}
+	if tr.relay != nil {
+		t.Fatal("relay is started")
+	}
+}
@@ -3,11 +3,55 @@ package transport
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/amenzhinsky/iothub/common"
 )
 
+var (
+	// ErrDeviceDisabled is returned by Connect when the hub refuses
+	// the connection because the device is disabled or doesn't exist.
+	ErrDeviceDisabled = errors.New("device is disabled or not registered")
+
+	// ErrUnauthorized is returned by Connect when the hub
+	// refuses the connection because of invalid credentials.
+	ErrUnauthorized = errors.New("unauthorized")
+
+	// ErrServerUnavailable is returned by Connect when the hub
+	// is temporarily unable to accept connections.
+	ErrServerUnavailable = errors.New("server unavailable")
+
+	// ErrBadProtocolVersion is returned by Connect when the hub
+	// doesn't support the protocol version the transport speaks.
+	ErrBadProtocolVersion = errors.New("unacceptable protocol version")
+
+	// ErrTwinTimeout is returned when a twin request gets no response in time.
+	ErrTwinTimeout = errors.New("twin request timed out")
+)
+
+// ConnectError is a connection refusal, Err is one of
+// the refusal errors above, so use errors.Is to match it.
+type ConnectError struct {
+	Code byte // raw protocol return code
+	Err  error
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("connection refused: %s (code = %d)", e.Err, e.Code)
+}
+
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether connecting again may succeed without
+// changing anything, other refusals need the configuration fixed.
+func (e *ConnectError) Temporary() bool {
+	return e.Err == ErrServerUnavailable
+}
+
 // Transport interface.
 type Transport interface {
 	SetLogger(logger common.Logger)
@@ -21,6 +65,111 @@ type Transport interface {
 	Close() error
 }
 
+// ConnectionChecker is implemented by transports that can tell whether
+// their connection is currently up, e.g. when they reconnect on their own.
+type ConnectionChecker interface {
+	// IsConnected must be cheap and never block.
+	IsConnected() bool
+}
+
+// WireSizer is implemented by transports that can tell
+// how many bytes a message takes on the wire.
+type WireSizer interface {
+	WireSize(msg *common.Message) (int, error)
+}
+
+// BatchSender is implemented by transports that can send several messages
+// at once, errs holds an error per message that's nil when it's sent.
+type BatchSender interface {
+	SendBatch(ctx context.Context, msgs []*common.Message) (errs []error)
+}
+
+// SubscriptionKind is a kind of subscription.
+type SubscriptionKind string
+
+const (
+	SubscriptionEvents SubscriptionKind = "events" // cloud-to-device messages
+	SubscriptionTwin   SubscriptionKind = "twin"   // desired state updates
+	SubscriptionMethod SubscriptionKind = "method" // direct methods
+)
+
+// SubscriptionObserver is notified about subscriptions lifecycle,
+// name is the method name for direct methods and empty otherwise,
+// it's also empty when the subscription of all methods is restored.
+//
+// Methods are called synchronously so they must not block.
+type SubscriptionObserver interface {
+	OnSubscribe(kind SubscriptionKind, name string)
+	OnSubscribeError(kind SubscriptionKind, name string, err error)
+
+	// OnResubscribe is called when a subscription is restored
+	// after reconnecting, err is nil when it succeeds.
+	OnResubscribe(kind SubscriptionKind, name string, err error)
+
+	OnUnsubscribe(kind SubscriptionKind, name string)
+}
+
+// ObservableTransport is implemented by transports
+// reporting subscriptions restored after reconnects.
+type ObservableTransport interface {
+	SetSubscriptionObserver(o SubscriptionObserver)
+}
+
+// ConnectionLossNotifier is implemented by transports that can leave
+// reconnecting to the caller, once a handler is set the transport stops
+// reconnecting on its own and reports every connection loss to it,
+// Connect is then called again to re-establish the connection.
+type ConnectionLossNotifier interface {
+	SetConnectionLostHandler(fn func(err error))
+}
+
+// DropReporter is implemented by transports that may drop
+// inbound messages before they're dispatched, e.g. when buffers are full.
+type DropReporter interface {
+	DroppedMessages() uint64
+}
+
+// TokenRenewer is implemented by transports whose connections
+// are authenticated with a SAS token for their whole lifetime.
+type TokenRenewer interface {
+	// TokenExpiry returns the expiration time of the token the
+	// connection is authenticated with, it's zero when there's none.
+	TokenExpiry() time.Time
+
+	// RenewToken re-authenticates the connection with a fresh token.
+	RenewToken(ctx context.Context) error
+}
+
+// Disposition is the outcome of a cloud-to-device message reported to the hub.
+type Disposition int
+
+const (
+	Complete Disposition = iota // processed, removed from the device queue
+	Abandon                     // put back to the device queue for redelivery
+	Reject                      // dead-lettered without redelivery
+)
+
+func (d Disposition) String() string {
+	switch d {
+	case Complete:
+		return "complete"
+	case Abandon:
+		return "abandon"
+	case Reject:
+		return "reject"
+	default:
+		return fmt.Sprintf("Disposition(%d)", int(d))
+	}
+}
+
+// MessageSettler is implemented by transports that settle cloud-to-device
+// messages explicitly, e.g. AMQP, messages stay locked on the hub until
+// they're settled and abandoned ones are redelivered. Transports identify
+// messages they delivered by their TransportOptions, e.g. a lock token.
+type MessageSettler interface {
+	Settle(ctx context.Context, msg *common.Message, d Disposition) error
+}
+
 // MessageDispatcher handles incoming messages.
 type MessageDispatcher interface {
 	Dispatch(msg *common.Message)
@@ -31,9 +180,33 @@ type TwinStateDispatcher interface {
 	Dispatch(b []byte)
 }
 
+// MethodRequest is a direct method invocation.
+type MethodRequest struct {
+	Name       string            // method name
+	RequestID  string            // id the response is correlated by
+	Properties map[string]string // extra invocation properties, e.g. trace context
+	Payload    []byte
+}
+
 // MethodDispatcher handles direct method calls.
 type MethodDispatcher interface {
-	Dispatch(methodName string, b []byte) (rc int, data []byte, err error)
+	Dispatch(req *MethodRequest) (rc int, data []byte, err error)
+}
+
+// MethodResponseErrorHandler is implemented by method dispatchers
+// that need to know about responses failed to be delivered.
+type MethodResponseErrorHandler interface {
+	HandleResponseError(methodName, rid string, err error)
+}
+
+// MethodResponseTracker is implemented by method dispatchers
+// that need to know when responses are sent, e.g. to wait for them
+// when closing. Transports call StartResponse before dispatching
+// and drop the invocation when it fails, otherwise DoneResponse
+// is called once the response is published or failed to be.
+type MethodResponseTracker interface {
+	StartResponse() error
+	DoneResponse()
 }
 
 // Credentials is connection credentials needed for x509 or sas authentication.
@@ -44,3 +217,35 @@ type Credentials interface {
 	IsSAS() bool
 	Token(ctx context.Context, uri string, d time.Duration) (string, error)
 }
+
+// ModuleCredentials is implemented by credentials of module identities.
+type ModuleCredentials interface {
+	// ModuleID is empty for device identities.
+	ModuleID() string
+}
+
+// GatewayCredentials is implemented by credentials that connect
+// through a gateway instead of the hub itself, e.g. a local IoT Edge hub.
+type GatewayCredentials interface {
+	// GatewayHostname is a hostname the transport connects to
+	// instead of Hostname, empty means the hub itself.
+	GatewayHostname() string
+}
+
+// ModuleID returns the module id of creds, it's empty for
+// device identities and credentials not implementing ModuleCredentials.
+func ModuleID(creds Credentials) string {
+	if m, ok := creds.(ModuleCredentials); ok {
+		return m.ModuleID()
+	}
+	return ""
+}
+
+// GatewayHostname returns the gateway hostname of creds, it's empty when
+// connecting to the hub directly or creds don't implement GatewayCredentials.
+func GatewayHostname(creds Credentials) string {
+	if g, ok := creds.(GatewayCredentials); ok {
+		return g.GatewayHostname()
+	}
+	return ""
+}
@@ -0,0 +1,222 @@
+package iotdevice
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/amenzhinsky/iothub/common"
+	"github.com/amenzhinsky/iothub/iotdevice/transport"
+)
+
+// UploadOption is a file upload option.
+type UploadOption func(o *uploadOptions)
+
+type uploadOptions struct {
+	progress func(sent int64)
+}
+
+// WithUploadProgress sets fn to be called with the number of bytes sent to
+// blob storage so far as the file is being read, it's called synchronously.
+func WithUploadProgress(fn func(sent int64)) UploadOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(o *uploadOptions) {
+		o.progress = fn
+	}
+}
+
+// HubError is an error response of IoT Hub to an HTTPS request.
+type HubError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HubError) Error() string {
+	return fmt.Sprintf("iothub: code = %d, body = %q", e.StatusCode, e.Body)
+}
+
+// BlobError is an error response of Azure Blob Storage to a file upload.
+type BlobError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *BlobError) Error() string {
+	return fmt.Sprintf("blob storage: code = %d, body = %q", e.StatusCode, e.Body)
+}
+
+// fileUpload is the hub's response to a file upload request.
+type fileUpload struct {
+	CorrelationID string `json:"correlationId"`
+	HostName      string `json:"hostName"`
+	ContainerName string `json:"containerName"`
+	BlobName      string `json:"blobName"`
+	SASToken      string `json:"sasToken"`
+}
+
+// UploadFile uploads size bytes read from r to the storage account
+// associated with the hub as blobName, it's done over HTTPS regardless
+// of the client's transport: a SAS URI of the blob is requested from
+// the hub, the file is put to it and then the outcome is reported
+// back to the hub that notifies services about uploaded files.
+//
+// Failures of blob storage are *BlobError and of the hub *HubError.
+func (c *Client) UploadFile(ctx context.Context, blobName string, r io.Reader, size int64, opts ...UploadOption) error {
+	if ctx == nil {
+		return errNilContext
+	}
+	if blobName == "" {
+		return errors.New("blob name is empty")
+	}
+	if r == nil {
+		return errors.New("reader is nil")
+	}
+	if transport.ModuleID(c.creds) != "" {
+		return errors.New("file upload is not available to modules")
+	}
+	var o uploadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	hub := c.uploadHTTP
+	if hub == nil {
+		hub = &http.Client{Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: c.creds.TLSConfig(),
+		}}
+	}
+
+	var up fileUpload
+	if err := c.hubRequest(ctx, hub, "/files", map[string]string{
+		"blobName": blobName,
+	}, &up); err != nil {
+		return err
+	}
+
+	perr := c.putBlob(ctx, &up, r, size, o.progress)
+	n := map[string]interface{}{
+		"correlationId":     up.CorrelationID,
+		"isSuccess":         perr == nil,
+		"statusCode":        201,
+		"statusDescription": "uploaded",
+	}
+	if perr != nil {
+		n["statusCode"] = 500
+		if berr, ok := perr.(*BlobError); ok {
+			n["statusCode"] = berr.StatusCode
+		}
+		n["statusDescription"] = perr.Error()
+	}
+	if err := c.hubRequest(ctx, hub, "/files/notifications", n, nil); err != nil {
+		if perr != nil {
+			return perr
+		}
+		return err
+	}
+	return perr
+}
+
+// putBlob puts the file to the blob storage location returned by the hub.
+func (c *Client) putBlob(ctx context.Context, up *fileUpload, r io.Reader, size int64, progress func(int64)) error {
+	if progress != nil {
+		r = &progressReader{r: r, fn: progress}
+	}
+	req, err := http.NewRequest(http.MethodPut, "https://"+up.HostName+"/"+
+		url.PathEscape(up.ContainerName)+"/"+url.PathEscape(up.BlobName)+up.SASToken,
+		ioutil.NopCloser(r),
+	)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+
+	blob := c.blobHTTP
+	if blob == nil {
+		blob = http.DefaultClient
+	}
+	res, err := blob.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &BlobError{StatusCode: res.StatusCode, Body: string(b)}
+	}
+	return nil
+}
+
+// hubRequest posts in to the given path of the device's hub
+// endpoint and decodes the response into out unless it's nil.
+func (c *Client) hubRequest(ctx context.Context, client *http.Client, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	host := transport.GatewayHostname(c.creds)
+	if host == "" {
+		host = c.creds.Hostname()
+	}
+	dev := "/devices/" + url.PathEscape(c.creds.DeviceID())
+	req, err := http.NewRequest(http.MethodPost,
+		"https://"+host+dev+path+"?api-version="+common.APIVersion,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.creds.IsSAS() {
+		token, err := c.creds.Token(ctx, c.creds.Hostname()+dev, time.Hour)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", token)
+	}
+
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &HubError{StatusCode: res.StatusCode, Body: string(b)}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(b, out)
+}
+
+// progressReader reports the number of bytes read so far.
+type progressReader struct {
+	r  io.Reader
+	n  int64
+	fn func(n int64)
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		r.n += int64(n)
+		r.fn(r.n)
+	}
+	return n, err
+}
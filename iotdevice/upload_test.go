@@ -0,0 +1,112 @@
+package iotdevice
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newUploadClient returns a client uploading files to a stub
+// of both the hub and blob storage, blob puts fail with blobCode
+// unless it's zero, notifications are sent to n.
+func newUploadClient(t *testing.T, blobCode int, n chan<- map[string]interface{}) (*Client, *[]byte) {
+	var blob []byte
+	s := httptest.NewTLSServer(nil)
+	t.Cleanup(s.Close)
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/devices/dev/files":
+			if !strings.HasPrefix(r.Header.Get("Authorization"), "SharedAccessSignature ") {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(&fileUpload{
+				CorrelationID: "cid",
+				HostName:      s.Listener.Addr().String(),
+				ContainerName: "box",
+				BlobName:      "dev/log.txt",
+				SASToken:      "?sig=x",
+			})
+		case r.Method == http.MethodPut && r.URL.Path == "/box/dev/log.txt":
+			if r.URL.Query().Get("sig") != "x" || r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			if blobCode != 0 {
+				w.WriteHeader(blobCode)
+				return
+			}
+			blob, _ = ioutil.ReadAll(r.Body)
+			w.WriteHeader(http.StatusCreated)
+		case r.Method == http.MethodPost && r.URL.Path == "/devices/dev/files/notifications":
+			var v map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&v)
+			n <- v
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	creds, err := NewSASCredentialsFromKey(s.Listener.Addr().String(), "dev", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(WithTransport(&fakeTransport{}), WithCredentials(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.uploadHTTP, c.blobHTTP = s.Client(), s.Client()
+	return c, &blob
+}
+
+func TestUploadFile(t *testing.T) {
+	n := make(chan map[string]interface{}, 1)
+	c, blob := newUploadClient(t, 0, n)
+
+	var sent int64
+	if err := c.UploadFile(context.Background(), "log.txt", strings.NewReader("hello"), 5,
+		WithUploadProgress(func(n int64) { sent = n }),
+	); err != nil {
+		t.Fatal(err)
+	}
+	if string(*blob) != "hello" || sent != 5 {
+		t.Fatalf("blob = %q, progress = %d", *blob, sent)
+	}
+	if v := <-n; v["correlationId"] != "cid" || v["isSuccess"] != true {
+		t.Fatalf("notification = %v", v)
+	}
+}
+
+func TestUploadFileBlobError(t *testing.T) {
+	n := make(chan map[string]interface{}, 1)
+	c, _ := newUploadClient(t, http.StatusInsufficientStorage, n)
+
+	err := c.UploadFile(context.Background(), "log.txt", strings.NewReader("hello"), 5)
+	var berr *BlobError
+	if !errors.As(err, &berr) || berr.StatusCode != http.StatusInsufficientStorage {
+		t.Fatalf("UploadFile() = %v, want *BlobError", err)
+	}
+	if v := <-n; v["isSuccess"] != false || v["statusCode"] != float64(http.StatusInsufficientStorage) {
+		t.Fatalf("notification = %v", v)
+	}
+}
+
+func TestUploadFileNilReader(t *testing.T) {
+	n := make(chan map[string]interface{}, 1)
+	c, _ := newUploadClient(t, 0, n)
+
+	if err := c.UploadFile(context.Background(), "log.txt", nil, 5); err == nil {
+		t.Fatal("UploadFile() with a nil reader succeeds")
+	}
+	select {
+	case v := <-n:
+		t.Fatalf("notification = %v, want the hub not requested", v)
+	default:
+	}
+}
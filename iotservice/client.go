@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -20,6 +21,8 @@ import (
 	"github.com/amenzhinsky/iothub/common"
 	"github.com/amenzhinsky/iothub/credentials"
 	"github.com/amenzhinsky/iothub/eventhub"
+	"github.com/amenzhinsky/iothub/internal/clock"
+	"github.com/amenzhinsky/iothub/internal/proxy"
 	"pack.ag/amqp"
 )
 
@@ -70,11 +73,80 @@ func WithTLSConfig(config *tls.Config) ClientOption {
 	}
 }
 
+// WithProxy connects through the given HTTP proxy, AMQP connections
+// including ones to the Event Hub-compatible endpoint use CONNECT
+// tunneling, basic auth credentials are taken from the URL userinfo.
+// Without it HTTPS_PROXY and NO_PROXY are respected.
+//
+// The REST client uses it only when it's not set with WithHTTPClient.
+func WithProxy(proxyURL string) ClientOption {
+	return func(c *Client) error {
+		u, err := proxy.Parse(proxyURL)
+		if err != nil {
+			return err
+		}
+		c.proxy = u
+		return nil
+	}
+}
+
+// WithTokenAttempts sets the number of put-token attempts made before
+// giving up on authorizing the AMQP connection, default is 5.
+//
+// Attempts are separated by exponentially growing delays.
+func WithTokenAttempts(n int) ClientOption {
+	return func(c *Client) error {
+		if n < 1 {
+			return errors.New("number of token attempts must be positive")
+		}
+		c.tokenAttempts = n
+		return nil
+	}
+}
+
+// WithTokenLifetime sets the lifetime of SAS tokens authorizing AMQP
+// connections, default is DefaultTokenLifetime, it's at least a minute.
+func WithTokenLifetime(d time.Duration) ClientOption {
+	return func(c *Client) error {
+		if d < time.Minute {
+			return errors.New("token lifetime must be at least a minute")
+		}
+		c.tokenLifetime = d
+		return nil
+	}
+}
+
+// WithTokenErrorHandler sets fn to be called with *TokenError every time
+// renewing the token of an AMQP connection fails, renewals are retried
+// until the current token expires, see TokenError.Expiry.
+//
+// fn is called from the renewal goroutine so it has to return quickly.
+func WithTokenErrorHandler(fn func(err error)) ClientOption {
+	if fn == nil {
+		panic("fn is nil")
+	}
+	return func(c *Client) error {
+		c.tokenErr = fn
+		return nil
+	}
+}
+
+// withClock overrides the clock used for token renewals, it's for tests.
+func withClock(clk clock.Clock) ClientOption {
+	return func(c *Client) error {
+		c.clock = clk
+		return nil
+	}
+}
+
 // NewLogger creates new iothub service client.
 func New(opts ...ClientOption) (*Client, error) {
 	c := &Client{
-		done:   make(chan struct{}),
-		logger: common.NewLoggerFromEnv("iotservice", "IOTHUB_SERVICE_LOG_LEVEL"),
+		done:          make(chan struct{}),
+		logger:        common.NewLoggerFromEnv("iotservice", "IOTHUB_SERVICE_LOG_LEVEL"),
+		tokenAttempts: 5,
+		tokenLifetime: DefaultTokenLifetime,
+		clock:         clock.Real,
 	}
 
 	var err error
@@ -99,8 +171,13 @@ func New(opts ...ClientOption) (*Client, error) {
 		c.tls = &tls.Config{RootCAs: common.RootCAs()}
 	}
 	if c.http == nil {
+		p := http.ProxyFromEnvironment
+		if c.proxy != nil {
+			p = http.ProxyURL(c.proxy)
+		}
 		c.http = &http.Client{
 			Transport: &http.Transport{
+				Proxy: p,
 				TLSClientConfig: &tls.Config{
 					RootCAs: common.RootCAs(),
 				},
@@ -113,12 +190,18 @@ func New(opts ...ClientOption) (*Client, error) {
 type Client struct {
 	mu     sync.Mutex
 	tls    *tls.Config
+	proxy  *url.URL
 	conn   *amqp.Client
 	done   chan struct{}
 	creds  *credentials.Credentials
 	logger common.Logger
 	http   *http.Client // REST client
 
+	tokenAttempts int
+	tokenLifetime time.Duration
+	tokenErr      func(err error)
+	clock         clock.Clock
+
 	sendMu   sync.Mutex
 	sendLink *amqp.Sender
 }
@@ -133,9 +216,7 @@ func (c *Client) connectToIoTHub(ctx context.Context) (*amqp.Client, error) {
 	if c.conn != nil {
 		return c.conn, nil // already connected
 	}
-	conn, err := amqp.Dial("amqps://"+c.creds.HostName,
-		amqp.ConnTLSConfig(c.tls),
-	)
+	conn, err := c.dialAMQP(c.creds.HostName)
 	if err != nil {
 		return nil, err
 	}
@@ -150,59 +231,147 @@ func (c *Client) connectToIoTHub(ctx context.Context) (*amqp.Client, error) {
 	return conn, nil
 }
 
+// dialAMQP connects to the AMQP broker on host, through a proxy if needed.
+func (c *Client) dialAMQP(host string) (*amqp.Client, error) {
+	addr := net.JoinHostPort(host, "5671")
+	u := c.proxy
+	if u == nil {
+		var err error
+		if u, err = proxy.FromEnvironment(addr); err != nil {
+			return nil, err
+		}
+	}
+	if u == nil {
+		return amqp.Dial("amqps://"+host, amqp.ConnTLSConfig(c.tls))
+	}
+
+	nc, err := proxy.Dial(context.Background(), u, addr)
+	if err != nil {
+		return nil, err
+	}
+	tc := c.tls.Clone()
+	if tc.ServerName == "" {
+		tc.ServerName = host
+	}
+	tlsConn := tls.Client(nc, tc)
+	if err = tlsConn.Handshake(); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	conn, err := amqp.New(tlsConn, amqp.ConnServerHostname(host))
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DefaultTokenLifetime is the default lifetime of SAS tokens
+// authorizing AMQP connections, they're renewed at 80% of it.
+const DefaultTokenLifetime = time.Hour
+
+// tokenRetryInterval is the delay before starting another series
+// of put-token attempts when all attempts of the previous one failed.
+const tokenRetryInterval = time.Minute
+
+// TokenError is returned when the client fails to put a SAS
+// token to the CBS endpoint after exhausting all attempts.
+type TokenError struct {
+	Attempts int
+	Err      error
+
+	// Expiry is when the token in use expires, the hub closes
+	// the connection then unless a renewal succeeds before,
+	// it's zero when the initial token fails to be put.
+	Expiry time.Time
+}
+
+func (e *TokenError) Error() string {
+	return fmt.Sprintf("put token failed after %d attempt(s): %s", e.Attempts, e.Err)
+}
+
 // putTokenContinuously writes token first time in blocking mode and returns
 // maintaining token updates in the background until the client is closed.
 func (c *Client) putTokenContinuously(ctx context.Context, conn *amqp.Client) error {
-	const (
-		tokenUpdateInterval = time.Hour
+	put := func(ctx context.Context) error {
+		return c.newToken(ctx, conn)
+	}
+	if err := c.retryToken(ctx, put); err != nil {
+		return err
+	}
+	go c.renewTokens(put)
+	return nil
+}
 
-		// we need to update tokens before they expire to prevent disconnects
-		// from azure, without interrupting the message flow
-		tokenUpdateSpan = 10 * time.Minute
-	)
+// renewTokens puts a new token with put when 80% of the current token's
+// lifetime passes, failures don't stop the renewals, they're reported
+// and retried every tokenRetryInterval until the current token expires.
+func (c *Client) renewTokens(put func(ctx context.Context) error) {
+	refresh := c.tokenLifetime * 4 / 5
+	expiry := c.clock.Now().Add(c.tokenLifetime)
+	wait := refresh
+	for {
+		select {
+		case <-c.clock.After(wait):
+			if err := c.retryToken(context.Background(), put); err != nil {
+				if terr, ok := err.(*TokenError); ok {
+					terr.Expiry = expiry
+				}
+				c.logger.Errorf("%s", err)
+				if c.tokenErr != nil {
+					c.tokenErr(err)
+				}
+				wait = tokenRetryInterval
+				continue
+			}
+			expiry = c.clock.Now().Add(c.tokenLifetime)
+			wait = refresh
+		case <-c.done:
+			return
+		}
+	}
+}
 
+func (c *Client) retryToken(ctx context.Context, fn func(ctx context.Context) error) error {
+	backoff := time.Second
+	var err error
+	for i := 1; ; i++ {
+		if err = fn(ctx); err == nil {
+			return nil
+		}
+		if i >= c.tokenAttempts {
+			return &TokenError{Attempts: i, Err: err}
+		}
+		c.logger.Warnf("put token attempt %d failed: %s", i, err)
+
+		select {
+		case <-c.clock.After(backoff):
+			if backoff *= 2; backoff > 30*time.Second {
+				backoff = 30 * time.Second
+			}
+		case <-ctx.Done():
+			return &TokenError{Attempts: i, Err: ctx.Err()}
+		case <-c.done:
+			return &TokenError{Attempts: i, Err: errors.New("client is closed")}
+		}
+	}
+}
+
+func (c *Client) newToken(ctx context.Context, conn *amqp.Client) error {
 	token, err := c.creds.GenerateToken(
-		c.creds.HostName, credentials.WithDuration(tokenUpdateInterval),
+		c.creds.HostName,
+		credentials.WithDuration(c.tokenLifetime),
+		credentials.WithCurrentTime(c.clock.Now()),
 	)
 	if err != nil {
 		return err
 	}
-
 	sess, err := conn.NewSession()
 	if err != nil {
 		return err
 	}
 	defer sess.Close(context.Background())
-
-	if err := c.putToken(ctx, sess, token); err != nil {
-		return err
-	}
-
-	go func() {
-		ticker := time.NewTimer(tokenUpdateInterval - tokenUpdateSpan)
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ticker.C:
-				token, err := c.creds.GenerateToken(
-					c.creds.HostName, credentials.WithDuration(tokenUpdateInterval),
-				)
-				if err != nil {
-					c.logger.Errorf("generate token error: %s", err)
-					return
-				}
-				if err := c.putToken(context.Background(), sess, token); err != nil {
-					c.logger.Errorf("put token error: %s", err)
-					return
-				}
-				ticker.Reset(tokenUpdateInterval - tokenUpdateSpan)
-			case <-c.done:
-				return
-			}
-		}
-	}()
-	return nil
+	return c.putToken(ctx, sess, token)
 }
 
 func (c *Client) putToken(ctx context.Context, sess *amqp.Session, token string) error {
@@ -245,10 +414,35 @@ func (c *Client) putToken(ctx context.Context, sess *amqp.Session, token string)
 	return eventhub.CheckMessageResponse(msg)
 }
 
+// DialEventHub connects to the Event Hub-compatible built-in endpoint
+// that device-to-cloud messages are routed to by default.
+//
+// The cs is either a shared access policy connection string of IoT Hub,
+// in that case the endpoint hostname and entity name are discovered
+// automatically, or the Event Hub-compatible connection string of the endpoint.
+//
+// The returned client is ready for subscribing and has to be closed by the caller.
+func DialEventHub(ctx context.Context, cs string, opts ...eventhub.Option) (*eventhub.Client, error) {
+	if strings.Contains(cs, "Endpoint=") {
+		return eventhub.DialConnectionString(cs, opts...)
+	}
+	c, err := New(WithConnectionString(cs))
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.connectToEventHub(ctx, opts...)
+}
+
+// ConnectToEventHub is the same as DialEventHub but reuses the client's credentials.
+func (c *Client) ConnectToEventHub(ctx context.Context, opts ...eventhub.Option) (*eventhub.Client, error) {
+	return c.connectToEventHub(ctx, opts...)
+}
+
 // connectToEventHub connects to IoT Hub endpoint compatible with Eventhub
 // for receiving D2C events, it uses different endpoints and authentication
 // mechanisms than connectToIoTHub.
-func (c *Client) connectToEventHub(ctx context.Context) (*eventhub.Client, error) {
+func (c *Client) connectToEventHub(ctx context.Context, opts ...eventhub.Option) (*eventhub.Client, error) {
 	conn, err := c.connectToIoTHub(ctx)
 	if err != nil {
 		return nil, err
@@ -287,11 +481,15 @@ func (c *Client) connectToEventHub(ctx context.Context) (*eventhub.Client, error
 	tlsCfg := c.tls.Clone()
 	tlsCfg.ServerName = host
 
-	eh, err := eventhub.Dial(host, group,
+	ehOpts := []eventhub.Option{
 		eventhub.WithLogger(c.logger),
 		eventhub.WithTLSConfig(tlsCfg),
 		eventhub.WithSASLPlain(c.creds.SharedAccessKeyName, c.creds.SharedAccessKey),
-	)
+	}
+	if c.proxy != nil {
+		ehOpts = append(ehOpts, eventhub.WithProxy(c.proxy.String()))
+	}
+	eh, err := eventhub.Dial(host, group, append(ehOpts, opts...)...)
 	if err != nil {
 		return nil, err
 	}
@@ -309,7 +507,15 @@ type Event struct {
 // SubscribeEvents subscribes to D2C events.
 //
 // Event handler is blocking, handle asynchronous processing on your own.
-func (c *Client) SubscribeEvents(ctx context.Context, fn EventHandler) error {
+//
+// By default only events enqueued after subscribing are received,
+// opts are applied after the defaults so they can override it
+// or configure the subscription further, e.g. the consumer group.
+func (c *Client) SubscribeEvents(
+	ctx context.Context,
+	fn EventHandler,
+	opts ...eventhub.SubscribeOption,
+) error {
 	// a new connection is established for every invocation,
 	// this made on purpose because normally an app calls the method once
 	eh, err := c.connectToEventHub(ctx)
@@ -320,9 +526,9 @@ func (c *Client) SubscribeEvents(ctx context.Context, fn EventHandler) error {
 
 	return eh.Subscribe(ctx, func(msg *eventhub.Event) error {
 		return fn(&Event{FromAMQPMessage(msg.Message)})
-	},
+	}, append([]eventhub.SubscribeOption{
 		eventhub.WithSubscribeSince(time.Now()),
-	)
+	}, opts...)...)
 }
 
 // SendOption is a send option.
@@ -585,10 +791,10 @@ func deviceKey(device *Device, secondary bool) string {
 }
 
 type call struct {
-	MethodName      string                 `json:"methodName"`
-	ConnectTimeout  int                    `json:"connectTimeoutInSeconds,omitempty"`
-	ResponseTimeout int                    `json:"responseTimeoutInSeconds,omitempty"`
-	Payload         map[string]interface{} `json:"payload"`
+	MethodName      string          `json:"methodName"`
+	ConnectTimeout  int             `json:"connectTimeoutInSeconds,omitempty"`
+	ResponseTimeout int             `json:"responseTimeoutInSeconds,omitempty"`
+	Payload         json.RawMessage `json:"payload"` // marshaled once to check its size
 }
 
 // CallOption is a direct-method invocation option.
@@ -610,6 +816,27 @@ func WithCallResponseTimeout(seconds int) CallOption {
 	}
 }
 
+// MaxMethodPayloadSize is the maximum size of a direct method
+// payload in bytes, IoT Hub rejects larger payloads.
+const MaxMethodPayloadSize = 128 << 10
+
+// PayloadSizeError is returned by Call when the encoded payload exceeds
+// MaxMethodPayloadSize, such requests aren't sent since IoT Hub
+// rejects them with StatusCode anyway.
+type PayloadSizeError struct {
+	Size  int
+	Limit int
+}
+
+func (e *PayloadSizeError) Error() string {
+	return fmt.Sprintf("payload size %d exceeds the limit of %d bytes", e.Size, e.Limit)
+}
+
+// StatusCode returns the HTTP status code IoT Hub rejects such payloads with.
+func (e *PayloadSizeError) StatusCode() int {
+	return http.StatusRequestEntityTooLarge
+}
+
 // Call calls the named direct method on with the given parameters.
 func (c *Client) Call(
 	ctx context.Context,
@@ -627,10 +854,17 @@ func (c *Client) Call(
 	if len(payload) == 0 {
 		return nil, errors.New("payload is empty")
 	}
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > MaxMethodPayloadSize {
+		return nil, &PayloadSizeError{Size: len(b), Limit: MaxMethodPayloadSize}
+	}
 
 	v := &call{
 		MethodName: methodName,
-		Payload:    payload,
+		Payload:    b,
 	}
 	for _, opt := range opts {
 		if err := opt(v); err != nil {
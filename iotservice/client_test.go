@@ -0,0 +1,259 @@
+package iotservice
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amenzhinsky/iothub/eventhub"
+	"github.com/amenzhinsky/iothub/internal/clock"
+)
+
+func TestRetryToken(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	c, err := New(
+		WithConnectionString("HostName=test.azure-devices.net;SharedAccessKeyName=iothubowner;SharedAccessKey=YWJj"),
+		WithTokenAttempts(3),
+		withClock(clk),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	var attempts int
+	go func() {
+		errc <- c.retryToken(context.Background(), func(context.Context) error {
+			attempts++
+			return errors.New("unauthorized")
+		})
+	}()
+
+	// backoffs between attempts are 1s and 2s
+	for _, d := range []time.Duration{time.Second, 2 * time.Second} {
+		for clk.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clk.Advance(d)
+	}
+
+	select {
+	case err := <-errc:
+		terr, ok := err.(*TokenError)
+		if !ok {
+			t.Fatalf("err = %v, want a *TokenError", err)
+		}
+		if terr.Attempts != 3 || attempts != 3 {
+			t.Fatalf("attempts = %d, %d, want 3", terr.Attempts, attempts)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retryToken didn't return")
+	}
+}
+
+func TestRetryTokenSucceeds(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	c, err := New(
+		WithConnectionString("HostName=test.azure-devices.net;SharedAccessKeyName=iothubowner;SharedAccessKey=YWJj"),
+		WithTokenAttempts(5),
+		withClock(clk),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	var attempts int
+	go func() {
+		errc <- c.retryToken(context.Background(), func(context.Context) error {
+			if attempts++; attempts < 3 {
+				return errors.New("unauthorized")
+			}
+			return nil
+		})
+	}()
+	for _, d := range []time.Duration{time.Second, 2 * time.Second} {
+		for clk.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clk.Advance(d)
+	}
+
+	select {
+	case err := <-errc:
+		if err != nil || attempts != 3 {
+			t.Fatalf("err = %v, attempts = %d, want nil and 3", err, attempts)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retryToken didn't return")
+	}
+}
+
+func TestRetryTokenClose(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	c, err := New(
+		WithConnectionString("HostName=test.azure-devices.net;SharedAccessKeyName=iothubowner;SharedAccessKey=YWJj"),
+		withClock(clk),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- c.retryToken(context.Background(), func(context.Context) error {
+			return errors.New("unauthorized")
+		})
+	}()
+	for clk.Waiters() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errc:
+		terr, ok := err.(*TokenError)
+		if !ok || terr.Attempts != 1 {
+			t.Fatalf("err = %v, want a *TokenError after 1 attempt", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("retryToken didn't return")
+	}
+}
+
+func TestWithTokenAttempts(t *testing.T) {
+	if _, err := New(
+		WithConnectionString("HostName=test.azure-devices.net;SharedAccessKeyName=iothubowner;SharedAccessKey=YWJj"),
+		WithTokenAttempts(0),
+	); err == nil {
+		t.Fatal("expected an error on zero attempts")
+	}
+}
+
+func TestRenewTokens(t *testing.T) {
+	start := time.Now()
+	clk := clock.NewFake(start)
+	errs := make(chan error, 1)
+	c, err := New(
+		WithConnectionString("HostName=test.azure-devices.net;SharedAccessKeyName=iothubowner;SharedAccessKey=YWJj"),
+		WithTokenAttempts(1),
+		WithTokenLifetime(10*time.Minute),
+		WithTokenErrorHandler(func(err error) {
+			errs <- err
+		}),
+		withClock(clk),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	puts := make(chan error, 1)
+	puts <- errors.New("unauthorized")
+	go c.renewTokens(func(context.Context) error {
+		select {
+		case err := <-puts:
+			return err
+		default:
+			return nil
+		}
+	})
+
+	// renewed at 80% of the lifetime, retried a minute after failing
+	for _, d := range []time.Duration{8 * time.Minute, time.Minute} {
+		for clk.Waiters() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		clk.Advance(d)
+		if d == time.Minute {
+			break
+		}
+		select {
+		case err := <-errs:
+			terr, ok := err.(*TokenError)
+			if !ok || !terr.Expiry.Equal(start.Add(10*time.Minute)) {
+				t.Fatalf("err = %v, want a *TokenError expiring in 10m", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("token error isn't reported")
+		}
+	}
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected error %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestCallPayloadSize(t *testing.T) {
+	payload := map[string]interface{}{
+		"data": strings.Repeat("x", MaxMethodPayloadSize),
+	}
+	_, err := (&Client{}).Call(context.Background(), "dev", "method", payload)
+	var perr *PayloadSizeError
+	if !errors.As(err, &perr) {
+		t.Fatalf("err = %v, want a *PayloadSizeError", err)
+	}
+	if perr.Limit != MaxMethodPayloadSize || perr.Size <= perr.Limit {
+		t.Errorf("size = %d, limit = %d", perr.Size, perr.Limit)
+	}
+	if perr.StatusCode() != http.StatusRequestEntityTooLarge {
+		t.Errorf("status code = %d, want %d", perr.StatusCode(), http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestDialEventHub(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	srv.StartTLS()
+	srv.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// the endpoint is expected to be dialed with options passed through,
+	// it only reads the protocol header and drops the connection
+	hdrc := make(chan string, 1)
+	go func() {
+		nc, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		hdr := make([]byte, 8)
+		if _, err := io.ReadFull(nc, hdr); err != nil {
+			hdrc <- err.Error()
+			return
+		}
+		hdrc <- string(hdr)
+	}()
+
+	cs := "Endpoint=sb://" + ln.Addr().String() +
+		"/;SharedAccessKeyName=listen;SharedAccessKey=YWJj;EntityPath=hub"
+	if _, err = DialEventHub(context.Background(), cs,
+		eventhub.WithTLSConfig(&tls.Config{InsecureSkipVerify: true}),
+	); err == nil {
+		t.Fatal("expected an error on a dropped connection")
+	}
+	select {
+	case hdr := <-hdrc:
+		if hdr != "AMQP\x03\x01\x00\x00" {
+			t.Fatalf("protocol header = %q, want a SASL one", hdr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("endpoint isn't dialed")
+	}
+
+	if _, err = DialEventHub(context.Background(), "HostName=test.azure-devices.net"); err == nil {
+		t.Fatal("expected an error on an incomplete connection string")
+	}
+}
@@ -8,6 +8,10 @@ import (
 	"pack.ag/amqp"
 )
 
+// creationTimeProperty carries creation times set by devices
+// when they don't map to the AMQP creation-time property.
+const creationTimeProperty = "iothub-creation-time-utc"
+
 // FromAMQPMessage converts a amqp.Message into common.Message.
 //
 // Exported to use with a custom stream when devices telemetry is
@@ -26,7 +30,13 @@ func FromAMQPMessage(msg *amqp.Message) *common.Message {
 			m.CorrelationID = msg.Properties.CorrelationID.(string)
 		}
 		m.To = msg.Properties.To
+		m.ContentType = msg.Properties.ContentType
+		m.ContentEncoding = msg.Properties.ContentEncoding
 		m.ExpiryTime = &msg.Properties.AbsoluteExpiryTime
+		if !msg.Properties.CreationTime.IsZero() {
+			t := msg.Properties.CreationTime
+			m.CreationTime = &t
+		}
 	}
 	for k, v := range msg.Annotations {
 		switch k {
@@ -41,6 +51,14 @@ func FromAMQPMessage(msg *amqp.Message) *common.Message {
 			m.ConnectionAuthMethod = v.(string)
 		case "iothub-message-source":
 			m.MessageSource = v.(string)
+		case "iothub-interface-id":
+			m.InterfaceID = v.(string)
+		case creationTimeProperty:
+			if t, ok := v.(time.Time); ok {
+				m.CreationTime = &t
+			} else {
+				m.Properties[creationTimeProperty] = fmt.Sprint(v)
+			}
 		default:
 			m.Properties[k.(string)] = fmt.Sprint(v)
 		}
@@ -53,6 +71,14 @@ func FromAMQPMessage(msg *amqp.Message) *common.Message {
 			m.Properties[k] = ""
 		}
 	}
+
+	// creation times set over HTTP arrive as application properties
+	if v, ok := m.Properties[creationTimeProperty]; ok && m.CreationTime == nil {
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			m.CreationTime = &t
+			delete(m.Properties, creationTimeProperty)
+		}
+	}
 	return m
 }
 
@@ -62,10 +88,13 @@ func toAMQPMessage(msg *common.Message) *amqp.Message {
 	for k, v := range msg.Properties {
 		props[k] = v
 	}
-	var expiryTime time.Time
+	var expiryTime, creationTime time.Time
 	if msg.ExpiryTime != nil {
 		expiryTime = *msg.ExpiryTime
 	}
+	if msg.CreationTime != nil {
+		creationTime = *msg.CreationTime
+	}
 	return &amqp.Message{
 		Data: [][]byte{msg.Payload},
 		Properties: &amqp.MessageProperties{
@@ -73,7 +102,10 @@ func toAMQPMessage(msg *common.Message) *amqp.Message {
 			UserID:             []byte(msg.UserID),
 			MessageID:          msg.MessageID,
 			CorrelationID:      msg.CorrelationID,
+			ContentType:        msg.ContentType,
+			ContentEncoding:    msg.ContentEncoding,
 			AbsoluteExpiryTime: expiryTime,
+			CreationTime:       creationTime,
 		},
 		ApplicationProperties: props,
 	}
@@ -11,15 +11,31 @@ import (
 func TestToFromAMQPMessage(t *testing.T) {
 	now := time.Now()
 	want := &common.Message{
-		MessageID:     "1",
-		To:            "azure",
-		ExpiryTime:    &now,
-		CorrelationID: "id",
-		UserID:        "admin",
-		Properties:    map[string]string{"k": "v"},
-		Payload:       []byte("hello"),
+		MessageID:       "1",
+		To:              "azure",
+		ExpiryTime:      &now,
+		CreationTime:    &now,
+		CorrelationID:   "id",
+		UserID:          "admin",
+		ContentType:     "application/json",
+		ContentEncoding: "utf-8",
+		Properties:      map[string]string{"k": "v"},
+		Payload:         []byte("hello"),
 	}
 	if have := FromAMQPMessage(toAMQPMessage(want)); !reflect.DeepEqual(have, want) {
 		t.Fatalf("FromAMQPMessage(toAMQPMessage(want)) = %v, want = %v", have, want)
 	}
+
+	// sent over HTTP it's an application property
+	msg := toAMQPMessage(&common.Message{Payload: []byte("hello")})
+	msg.ApplicationProperties[creationTimeProperty] = "2020-01-02T03:04:05.678Z"
+	have := FromAMQPMessage(msg)
+	if have.CreationTime == nil || !have.CreationTime.Equal(
+		time.Date(2020, 1, 2, 3, 4, 5, 678e6, time.UTC),
+	) {
+		t.Fatalf("CreationTime = %v, want 2020-01-02T03:04:05.678Z", have.CreationTime)
+	}
+	if _, ok := have.Properties[creationTimeProperty]; ok {
+		t.Fatalf("%s is left in properties", creationTimeProperty)
+	}
 }
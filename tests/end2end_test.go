@@ -111,11 +111,12 @@ func TestEnd2End(t *testing.T) {
 				mktransport := mktransport
 				t.Run(auth, func(t *testing.T) {
 					for name, test := range map[string]func(*testing.T, ...iotdevice.ClientOption){
-						"DeviceToCloud": testDeviceToCloud,
-						"CloudToDevice": testCloudToDevice,
-						"DirectMethod":  testDirectMethod,
-						"UpdateTwin":    testUpdateTwin,
-						"SubscribeTwin": testSubscribeTwin,
+						"DeviceToCloud":           testDeviceToCloud,
+						"CloudToDevice":           testCloudToDevice,
+						"CloudToDevicePersistent": testCloudToDevicePersistent,
+						"DirectMethod":            testDirectMethod,
+						"UpdateTwin":              testUpdateTwin,
+						"SubscribeTwin":           testSubscribeTwin,
 					} {
 						if suite.test != "*" && suite.test != name {
 							continue
@@ -186,6 +187,7 @@ func testDeviceToCloud(t *testing.T, opts ...iotdevice.ClientOption) {
 
 	payload := []byte(`hello`)
 	props := map[string]string{"a": "a", "b": "b"}
+	created := time.Now().UTC().Truncate(time.Millisecond)
 
 	// send events until one of them is received
 	go func() {
@@ -194,6 +196,7 @@ func testDeviceToCloud(t *testing.T, opts ...iotdevice.ClientOption) {
 				iotdevice.WithSendMessageID(common.GenID()),
 				iotdevice.WithSendCorrelationID(common.GenID()),
 				iotdevice.WithSendProperties(props),
+				iotdevice.WithSendCreationTime(created),
 			); err != nil {
 				errc <- err
 				break
@@ -229,6 +232,9 @@ func testDeviceToCloud(t *testing.T, opts ...iotdevice.ClientOption) {
 		if msg.EnqueuedTime.IsZero() {
 			t.Error("EnqueuedTime is zero")
 		}
+		if msg.CreationTime == nil || !msg.CreationTime.Equal(created) {
+			t.Errorf("CreationTime = %v, want %v", msg.CreationTime, created)
+		}
 		if !bytes.Equal(msg.Payload, payload) {
 			t.Errorf("Payload = %v, want %v", msg.Payload, payload)
 		}
@@ -345,6 +351,69 @@ func testCloudToDevice(t *testing.T, opts ...iotdevice.ClientOption) {
 	}
 }
 
+// testCloudToDevicePersistent checks that a message sent while the device
+// is offline is delivered exactly once after it reconnects with a persistent session.
+func testCloudToDevicePersistent(t *testing.T, opts ...iotdevice.ClientOption) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// mqtt only, the transport passed in opts is replaced
+	opts = append(opts, iotdevice.WithTransport(mqtt.New(mqtt.WithPersistentSession())))
+
+	// make the hub create the session with the c2d subscription
+	dc, sc := newDeviceAndServiceClient(t, ctx, opts...)
+	defer sc.Close()
+	if _, err := dc.SubscribeEvents(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := dc.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mid := common.GenID()
+	if err := sc.SendEvent(ctx, dc.DeviceID(), []byte("offline"),
+		iotservice.WithSendMessageID(mid),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// reconnect and subscribe later to check queued messages aren't lost
+	receive := func(wait time.Duration) int {
+		dc, err := iotdevice.New(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dc.Close()
+		if err = dc.Connect(ctx); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Second)
+		sub, err := dc.SubscribeEvents(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var n int
+		timeout := time.After(wait)
+		for {
+			select {
+			case msg := <-sub.C():
+				if msg.MessageID == mid {
+					n++
+				}
+			case <-timeout:
+				return n
+			}
+		}
+	}
+	if n := receive(15 * time.Second); n != 1 {
+		t.Fatalf("message is delivered %d times, want once", n)
+	}
+	if n := receive(5 * time.Second); n != 0 {
+		t.Fatalf("message is redelivered %d times after reconnecting", n)
+	}
+}
+
 func testUpdateTwin(t *testing.T, opts ...iotdevice.ClientOption) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -423,7 +492,7 @@ func testDirectMethod(t *testing.T, opts ...iotdevice.ClientOption) {
 	dc, sc := newDeviceAndServiceClient(t, ctx, opts...)
 	defer closeDeviceService(t, dc, sc)
 
-	if err := dc.RegisterMethod(ctx, "sum", func(v map[string]interface{}) (map[string]interface{}, error) {
+	if err := dc.RegisterMethod(ctx, "sum", func(_ context.Context, v map[string]interface{}) (map[string]interface{}, error) {
 		return map[string]interface{}{
 			"result": v["a"].(float64) + v["b"].(float64),
 		}, nil